@@ -3,10 +3,17 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	stdlog "log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
@@ -19,6 +26,10 @@ import (
 
 var logger kitlog.Logger
 
+// stdio is the path that denotes reading from stdin, or writing to stdout. Our logs are
+// always written to stderr, which allows us to be used within a pipeline.
+const stdio = "-"
+
 var (
 	app = kingpin.New("pgreplay", "Replay Postgres logs against database").Version(versionStanza())
 
@@ -29,24 +40,96 @@ var (
 	metricsAddress = app.Flag("metrics-address", "Address to bind HTTP metrics listener").Default("0.0.0.0").String()
 	metricsPort    = app.Flag("metrics-port", "Port to bind HTTP metrics listener").Default("9445").Uint16()
 	fromS3Bucket   = app.Flag("from-s3-bucket", "Integration to get logs from a S3 Bucket").String()
+	logLinePrefix  = app.Flag("log-line-prefix", "Postgres log_line_prefix used to write the errlog input").Default(pgreplay.DefaultLogLinePrefix).String()
+	pcapPort       = app.Flag("pcap-port", "Port the Postgres server listens on in pcap input").Default("5432").Uint16()
+	includeRules   = app.Flag("include", "Only keep items matching field=value or field~regex, on user, database, application_name, session_id or query (repeatable)").Strings()
+	excludeRules   = app.Flag("exclude", "Drop items matching field=value or field~regex, on user, database, application_name, session_id or query (repeatable)").Strings()
+	filterRules    = app.Flag("filter-rules", "File of include and exclude rules, one per line").ExistingFile()
+	transformRules = app.Flag("transform-rules", "File of rules that drop or rewrite queries, one per line").ExistingFile()
+	transformSets  = app.Flag("transform-preset", "Apply a preset of transformation rules, either strip-transactions or shared-advisory-locks (repeatable)").Strings()
+	sampleSessions = app.Flag("sample-sessions", "Keep this fraction of whole sessions, such as 0.1").Default("1").Float64()
+	sampleSeed     = app.Flag("sample-seed", "Seed choosing which sessions are sampled").Default("0").Int64()
+	sampleBy       = app.Flag("sample-by", "Sample the same fraction of sessions of each user or database").Enum(pgreplay.SampleStrata...)
+	csvlogVersion  = app.Flag("csvlog-version", "Postgres major version that wrote the csvlog input (detected from each line by default)").Int()
+	verifyChecksum = app.Flag("verify-checksum", "Verify the checksum of each JSON input before using any of its items, which reads the input twice").Bool()
+
+	filter             = app.Command("filter", "Process an errlog file into a pgreplay preprocessed JSON log")
+	filterJsonInput    = filter.Flag("json-input", "JSON input files, directories or globs (- for stdin)").Strings()
+	filterErrlogInput  = filter.Flag("errlog-input", "Postgres errlog input files, directories or globs (- for stdin)").Strings()
+	filterCsvLogInput  = filter.Flag("csvlog-input", "Postgres CSV log input files, directories or globs (- for stdin)").Strings()
+	filterJsonLogInput = filter.Flag("jsonlog-input", "Postgres jsonlog input files, directories or globs (- for stdin)").Strings()
+	filterPcapInput    = filter.Flag("pcap-input", "Packet capture (libpcap) input files, directories or globs (- for stdin)").Strings()
+	filterBinaryInput  = filter.Flag("binary-input", "pgreplay binary input files, directories or globs (- for stdin)").Strings()
+	filterOutputSet    bool
+	filterOutput       = filter.Flag("output", "Output file, or - for stdout").IsSetByUser(&filterOutputSet).String()
+	filterFormat       = filter.Flag("format", "Output format, either json or the seekable binary format").Default("json").Enum("json", "binary")
+	filterNullOutput   = filter.Flag("null-output", "Don't output anything, for testing parsing only").Bool()
+	filterMinDuration  = filter.Flag("min-duration", "Only keep statements that originally took at least this long (e.g. 10ms)").Duration()
+	filterMaxDuration  = filter.Flag("max-duration", "Only keep statements that originally took at most this long (e.g. 1s)").Duration()
+	filterAnonymise    = filter.Flag("anonymise", "Anonymise bind parameters and query constants before writing them").Bool()
+	filterAnonKey      = filter.Flag("anonymise-key", "Secret key for anonymising values, which must be kept to reproduce them").Envar("PGREPLAY_ANONYMISE_KEY").String()
+	filterAnonRules    = filter.Flag("anonymise-rules", "File of rules choosing the parameters or columns to anonymise for each query fingerprint").ExistingFile()
+	filterCompression  = filter.Flag("output-compression", "Compress the output (defaults to the --output file extension)").Enum(
+		pgreplay.CompressionNone, pgreplay.CompressionGzip, pgreplay.CompressionZstd, pgreplay.CompressionXz,
+	)
+
+	inspect             = app.Command("inspect", "Summarise a log to help decide what to replay")
+	inspectJsonInput    = inspect.Flag("json-input", "JSON input files, directories or globs (- for stdin)").Strings()
+	inspectErrlogInput  = inspect.Flag("errlog-input", "Postgres errlog input files, directories or globs (- for stdin)").Strings()
+	inspectCsvLogInput  = inspect.Flag("csvlog-input", "Postgres CSV log input files, directories or globs (- for stdin)").Strings()
+	inspectJsonLogInput = inspect.Flag("jsonlog-input", "Postgres jsonlog input files, directories or globs (- for stdin)").Strings()
+	inspectPcapInput    = inspect.Flag("pcap-input", "Packet capture (libpcap) input files, directories or globs (- for stdin)").Strings()
+	inspectBinaryInput  = inspect.Flag("binary-input", "pgreplay binary input files, directories or globs (- for stdin)").Strings()
+	inspectInterval     = inspect.Flag("interval", "Interval over which to measure queries per second").Default("1m").Duration()
+	inspectTop          = inspect.Flag("top", "Number of the most frequent query fingerprints to report").Default("10").Int()
+	inspectFormat       = inspect.Flag("format", "Output format, either table or json").Default("table").Enum("table", "json")
+
+	split          = app.Command("split", "Partition a pgreplay JSON log into shards that can be replayed in parallel")
+	splitJsonInput = split.Flag("json-input", "JSON input files, directories or globs (- for stdin)").Required().Strings()
+	splitShards    = split.Flag("shards", "Number of shards to write").Required().Int()
+	splitBy        = split.Flag("by", "Partition items by session, user or database").Default("session").Enum(pgreplay.SplitKeys...)
+	splitOutputDir = split.Flag("output-dir", "Directory to write the shards and their manifest into").Required().String()
 
-	filter            = app.Command("filter", "Process an errlog file into a pgreplay preprocessed JSON log")
-	filterJsonInput   = filter.Flag("json-input", "JSON input file").ExistingFile()
-	filterErrlogInput = filter.Flag("errlog-input", "Postgres errlog input file").ExistingFile()
-	filterCsvLogInput = filter.Flag("csvlog-input", "Postgres CSV log input file").String()
-	filterOutput      = filter.Flag("output", "JSON output file").String()
-	filterNullOutput  = filter.Flag("null-output", "Don't output anything, for testing parsing only").Bool()
-
-	run            = app.Command("run", "Replay from log files against a real database")
-	runHost        = run.Flag("host", "PostgreSQL database host").Required().String()
-	runPort        = run.Flag("port", "PostgreSQL database port").Default("5432").Uint16()
-	runDatname     = run.Flag("database", "PostgreSQL root database").Default("postgres").String()
-	runUser        = run.Flag("user", "PostgreSQL root user").Default("postgres").String()
-	runPassword    = run.Flag("password", "PostgreSQl password user (the default value is obtained from the DB_PASSWORD env var)").Default(os.Getenv("DB_PASSWORD")).String()
-	runReplayRate  = run.Flag("replay-rate", "Rate of playback, will execute queries at Nx speed").Default("1").Float()
-	runErrlogInput = run.Flag("errlog-input", "Path to PostgreSQL errlog").ExistingFile()
-	runCsvLogInput = run.Flag("csvlog-input", "Path to PostgreSQL CSV log").String()
-	runJsonInput   = run.Flag("json-input", "Path to preprocessed pgreplay JSON log file").ExistingFile()
+	merge            = app.Command("merge", "Merge several pgreplay JSON logs into one workload ordered by timestamp")
+	mergeInputs      = merge.Arg("inputs", "JSON input files, directories or globs, each of which is a source").Required().Strings()
+	mergeNamespace   = merge.Flag("namespace-sessions", "Prefix session IDs with the position of their source, such as 2:5c7404eb.d6bd").Bool()
+	mergeOffsets     = merge.Flag("offset", "Shift the timestamps of a source by this duration, given once for each source in order (e.g. --offset=0s --offset=-24h)").DurationList()
+	mergeOutputSet   bool
+	mergeOutput      = merge.Flag("output", "JSON output file, or - for stdout").IsSetByUser(&mergeOutputSet).Required().String()
+	mergeCompression = merge.Flag("output-compression", "Compress the JSON output (defaults to the --output file extension)").Enum(
+		pgreplay.CompressionNone, pgreplay.CompressionGzip, pgreplay.CompressionZstd, pgreplay.CompressionXz,
+	)
+
+	capture            = app.Command("capture", "Proxy connections to Postgres, recording their traffic into a pgreplay JSON log")
+	captureListen      = capture.Flag("listen", "Address to accept client connections on").Default(":6432").String()
+	captureUpstream    = capture.Flag("upstream", "Address of the Postgres server to proxy to").Required().String()
+	captureOutputSet   bool
+	captureOutput      = capture.Flag("output", "JSON output file, or - for stdout").IsSetByUser(&captureOutputSet).Required().String()
+	captureCompression = capture.Flag("output-compression", "Compress the JSON output (defaults to the --output file extension)").Enum(
+		pgreplay.CompressionNone, pgreplay.CompressionGzip, pgreplay.CompressionZstd, pgreplay.CompressionXz,
+	)
+
+	run             = app.Command("run", "Replay from log files against a real database")
+	runHost         = run.Flag("host", "PostgreSQL database host").Required().String()
+	runPort         = run.Flag("port", "PostgreSQL database port").Default("5432").Uint16()
+	runDatname      = run.Flag("database", "PostgreSQL root database").Default("postgres").String()
+	runUser         = run.Flag("user", "PostgreSQL root user").Default("postgres").String()
+	runPassword     = run.Flag("password", "PostgreSQl password user (the default value is obtained from the DB_PASSWORD env var)").Default(os.Getenv("DB_PASSWORD")).String()
+	runReplayRate   = run.Flag("replay-rate", "Rate of playback, will execute queries at Nx speed").Default("1").Float()
+	runPoolSize     = run.Flag("pool-size", "Multiplex sessions onto pools of this many connections for each user and database, as pgbouncer does in transaction mode").Default("0").Int()
+	runUserPools    = run.Flag("user-pool-size", "Size of the pools of a user, such as alice=20, overriding --pool-size (repeatable)").Strings()
+	runDBPools      = run.Flag("database-pool-size", "Size of the pools of a database, such as app=20, overriding --pool-size (repeatable)").Strings()
+	runParamTypes   = run.Flag("parameter-types", "Type bind parameters with the types we captured, by describing queries without them, or not at all").Default(pgreplay.ParameterTypesCaptured).Enum(pgreplay.ParameterTypeModes...)
+	runAmplify      = run.Flag("amplify", "Replay this many copies of every session, multiplying the original concurrency").Default("1").Int()
+	runAmplifyDelay = run.Flag("amplify-jitter", "Delay each copy of a session by up to this long, so copies don't run in lockstep").Default("0s").Duration()
+	runPerturb      = run.Flag("amplify-perturb", "Move the integer parameters of each copy by up to this much in either direction").Default("0").Int64()
+	runAmplifySeed  = run.Flag("amplify-seed", "Seed choosing the jitter and perturbation of copies").Default("0").Int64()
+	runErrlogInput  = run.Flag("errlog-input", "Paths to PostgreSQL errlogs, directories or globs (- for stdin)").Strings()
+	runCsvLogInput  = run.Flag("csvlog-input", "Paths to PostgreSQL CSV logs, directories or globs (- for stdin)").Strings()
+	runJsonLogInput = run.Flag("jsonlog-input", "Paths to PostgreSQL jsonlogs, directories or globs (- for stdin)").Strings()
+	runPcapInput    = run.Flag("pcap-input", "Paths to packet captures (libpcap) of Postgres traffic, directories or globs (- for stdin)").Strings()
+	runJsonInput    = run.Flag("json-input", "Paths to preprocessed pgreplay JSON log files, directories or globs (- for stdin)").Strings()
+	runBinaryInput  = run.Flag("binary-input", "Paths to preprocessed pgreplay binary log files, directories or globs (- for stdin)").Strings()
 )
 
 func main() {
@@ -69,6 +152,14 @@ func main() {
 		err           error
 		start, finish *time.Time
 		s3Bucket      bool = false
+		prefix        *pgreplay.LogLinePrefix
+		csvParser     pgreplay.ParserFunc = pgreplay.ParseCsvLog
+		jsonParser    pgreplay.ParserFunc = pgreplay.ParseJSON
+		itemFilter    pgreplay.ItemFilter
+		transformer   *pgreplay.Transformer
+		sampler       *pgreplay.SessionSampler
+		amplifier     *pgreplay.Amplifier
+		pool          pgreplay.PoolConfig
 	)
 
 	// Validations
@@ -78,31 +169,100 @@ func main() {
 	if finish, err = parseTimestamp(*finishFlag); err != nil {
 		kingpin.Fatalf("--finish flag %s", err)
 	}
+	// kingpin parses a bare - as an empty value, so recover the stdio path we were given
+	if filterOutputSet && *filterOutput == "" {
+		*filterOutput = stdio
+	}
+	if captureOutputSet && *captureOutput == "" {
+		*captureOutput = stdio
+	}
+	if mergeOutputSet && *mergeOutput == "" {
+		*mergeOutput = stdio
+	}
+	if *filterMaxDuration > 0 && *filterMinDuration > *filterMaxDuration {
+		kingpin.Fatalf("--min-duration must not exceed --max-duration")
+	}
+	if prefix, err = pgreplay.ParseLogLinePrefix(*logLinePrefix); err != nil {
+		kingpin.Fatalf("--log-line-prefix flag %s", err)
+	}
+	if *csvlogVersion != 0 {
+		layout, err := pgreplay.CsvLogLayoutForVersion(*csvlogVersion)
+		if err != nil {
+			kingpin.Fatalf("--csvlog-version flag %s", err)
+		}
+
+		csvParser = pgreplay.NewCsvLogParser(layout)
+	}
+	if *verifyChecksum {
+		jsonParser = pgreplay.ParseVerifiedJSON
+	}
+	if itemFilter, err = loadItemFilter(*includeRules, *excludeRules, *filterRules); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	if transformer, err = loadTransformer(*transformSets, *transformRules); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+	if sampler, err = pgreplay.NewSessionSampler(*sampleSessions, *sampleSeed, *sampleBy); err != nil {
+		kingpin.Fatalf("--sample-sessions flag %s", err)
+	}
+	// kingpin only applies the defaults of the command being run
+	if command == run.FullCommand() {
+		if amplifier, err = pgreplay.NewAmplifier(*runAmplify, *runAmplifyDelay, *runPerturb, *runAmplifySeed); err != nil {
+			kingpin.Fatalf("--amplify flag %s", err)
+		}
+		if pool, err = loadPoolConfig(*runPoolSize, *runUserPools, *runDBPools); err != nil {
+			kingpin.Fatalf("%s", err)
+		}
+	}
 	if *fromS3Bucket != "" {
 		if _, ok := os.LookupEnv("PGREPLAY_PID"); !ok {
 			kingpin.Fatalf("--from-s3-bucket flag is enabled, please add the PGREPLAY_PID env var to get the pid")
 		}
+		if start == nil || finish == nil {
+			kingpin.Fatalf("--from-s3-bucket flag requires both --start and --finish")
+		}
 		s3Bucket = true
 	}
 
 	switch command {
 	case filter.FullCommand():
 		var items chan pgreplay.Item
+		var source string
 
-		switch checkSingleFormat(filterJsonInput, filterErrlogInput, filterCsvLogInput) {
+		inputs := checkSingleFormat(filterJsonInput, filterErrlogInput, filterCsvLogInput, filterJsonLogInput, filterPcapInput, filterBinaryInput)
+		switch inputs {
 		case filterJsonInput:
-			items = parseLog(*filterJsonInput, s3Bucket, pgreplay.ParseJSON, *start, *finish)
+			items, source = parseLog(*filterJsonInput, s3Bucket, jsonParser, start, finish), "json"
 		case filterErrlogInput:
-			items = parseLog(*filterErrlogInput, s3Bucket, pgreplay.ParseErrlog, *start, *finish)
+			items, source = parseLog(*filterErrlogInput, s3Bucket, pgreplay.NewErrlogParser(prefix), start, finish), "errlog"
 		case filterCsvLogInput:
-			items = parseLog(*filterCsvLogInput, s3Bucket, pgreplay.ParseCsvLog, *start, *finish)
+			items, source = parseLog(*filterCsvLogInput, s3Bucket, csvParser, start, finish), "csvlog"
+		case filterJsonLogInput:
+			items, source = parseLog(*filterJsonLogInput, s3Bucket, pgreplay.ParseJsonLog, start, finish), "jsonlog"
+		case filterPcapInput:
+			items, source = parseLog(*filterPcapInput, s3Bucket, pgreplay.NewPcapParser(*pcapPort), start, finish), "pcap"
+		case filterBinaryInput:
+			items, source = parseLog(*filterBinaryInput, s3Bucket, pgreplay.NewBinaryParser(start), start, finish), "binary"
 		default:
 			logger.Log("event", "postgres.error", "error", "you must provide an input")
 			os.Exit(255)
 		}
 
 		// Apply the start and end filters
+		items = transformer.Transform(items)
 		items = pgreplay.NewStreamer(start, finish, logger).Filter(items)
+		items = itemFilter.Filter(items)
+		items = sampler.Sample(items)
+		items = pgreplay.FilterDuration(items, *filterMinDuration, *filterMaxDuration)
+
+		if *filterAnonymise {
+			anonymiser, err := loadAnonymiser(*filterAnonKey, *filterAnonRules)
+			if err != nil {
+				kingpin.Fatalf("%s", err)
+			}
+
+			items = anonymiser.Anonymise(items)
+		}
 
 		if *filterNullOutput {
 			logger.Log("event", "filter.null_output", "msg", "Null output enabled, logs won't be serialized")
@@ -110,6 +270,7 @@ func main() {
 				// no-op
 			}
 
+			logTransformSummary(transformer)
 			return
 		}
 
@@ -117,29 +278,143 @@ func main() {
 			kingpin.Fatalf("must provide output file when no --null-output")
 		}
 
-		outputFile, err := os.Create(*filterOutput)
+		if *filterFormat == "binary" {
+			writeBinaryItems(items, *filterOutput, *filterCompression)
+		} else {
+			metadata := newMetadata(source, *inputs, start, finish)
+			metadata.Filters, metadata.Transforms = describeFilters()
+			if *filterMinDuration > 0 {
+				metadata.Filters = append(metadata.Filters, fmt.Sprintf("min-duration %s", *filterMinDuration))
+			}
+			if *filterMaxDuration > 0 {
+				metadata.Filters = append(metadata.Filters, fmt.Sprintf("max-duration %s", *filterMaxDuration))
+			}
+			if *filterAnonymise {
+				metadata.Transforms = append(metadata.Transforms, "anonymise")
+			}
+
+			writeItems(items, *filterOutput, *filterCompression, metadata)
+		}
+
+		logTransformSummary(transformer)
+
+	case inspect.FullCommand():
+		if *inspectInterval <= 0 {
+			kingpin.Fatalf("--interval must be positive")
+		}
+
+		var items chan pgreplay.Item
+		inspector := pgreplay.NewInspector(*inspectInterval, *inspectTop)
+
+		switch checkSingleFormat(inspectJsonInput, inspectErrlogInput, inspectCsvLogInput, inspectJsonLogInput, inspectPcapInput, inspectBinaryInput) {
+		case inspectJsonInput:
+			items = parseLog(*inspectJsonInput, s3Bucket, inspector.Parser(jsonParser), start, finish)
+		case inspectErrlogInput:
+			items = parseLog(*inspectErrlogInput, s3Bucket, inspector.Parser(pgreplay.NewErrlogParser(prefix)), start, finish)
+		case inspectCsvLogInput:
+			items = parseLog(*inspectCsvLogInput, s3Bucket, inspector.Parser(csvParser), start, finish)
+		case inspectJsonLogInput:
+			items = parseLog(*inspectJsonLogInput, s3Bucket, inspector.Parser(pgreplay.ParseJsonLog), start, finish)
+		case inspectPcapInput:
+			items = parseLog(*inspectPcapInput, s3Bucket, inspector.Parser(pgreplay.NewPcapParser(*pcapPort)), start, finish)
+		case inspectBinaryInput:
+			items = parseLog(*inspectBinaryInput, s3Bucket, inspector.Parser(pgreplay.NewBinaryParser(start)), start, finish)
+		}
+
+		// Inspect what we would replay, after the same filters as filter and run
+		items = transformer.Transform(items)
+		items = pgreplay.NewStreamer(start, finish, logger).Filter(items)
+		items = itemFilter.Filter(items)
+		items = sampler.Sample(items)
+
+		inspection := inspector.Inspect(items)
+
+		if *inspectFormat == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(inspection)
+		} else {
+			err = inspection.WriteTable(os.Stdout)
+		}
+
 		if err != nil {
-			kingpin.Fatalf("failed to create output file: %v", err)
+			kingpin.Fatalf("failed to write inspection: %v", err)
 		}
 
-		// Buffer the writes by 32MB to enable much faster filtering
-		buffer := bufio.NewWriterSize(outputFile, 32*1000*1000)
+	case split.FullCommand():
+		if *splitShards < 1 {
+			kingpin.Fatalf("--shards must be at least 1")
+		}
 
-		for item := range items {
-			bytes, err := pgreplay.ItemMarshalJSON(item)
-			if err != nil {
-				kingpin.Fatalf("failed to serialize item: %v", err)
-			}
+		items := parseLog(*splitJsonInput, s3Bucket, jsonParser, start, finish)
+		items = pgreplay.NewStreamer(start, finish, logger).Filter(items)
 
-			if _, err := buffer.Write(append(bytes, byte('\n'))); err != nil {
-				kingpin.Fatalf("failed to write to output file: %v", err)
+		metadata := newMetadata("json", *splitJsonInput, start, finish)
+		if err := splitItems(items, *splitBy, *splitShards, *splitOutputDir, *metadata); err != nil {
+			kingpin.Fatalf("failed to split log: %v", err)
+		}
+
+	case merge.FullCommand():
+		if len(*mergeOffsets) > 0 && len(*mergeOffsets) != len(*mergeInputs) {
+			kingpin.Fatalf("--offset must be given once for each of the %d inputs", len(*mergeInputs))
+		}
+
+		sources := make([]chan pgreplay.Item, 0, len(*mergeInputs))
+		for idx, input := range *mergeInputs {
+			var namespace string
+			var offset time.Duration
+
+			if *mergeNamespace {
+				namespace = fmt.Sprintf("%d:", idx+1)
+			}
+			if len(*mergeOffsets) > 0 {
+				offset = (*mergeOffsets)[idx]
 			}
+
+			items := parseLog([]string{input}, false, jsonParser, start, finish)
+			sources = append(sources, pgreplay.AdjustSource(items, namespace, offset))
+		}
+
+		items := pgreplay.MergeItems(sources...)
+		items = pgreplay.NewStreamer(start, finish, logger).Filter(items)
+
+		metadata := newMetadata("json", *mergeInputs, start, finish)
+		if *mergeNamespace {
+			metadata.Transforms = append(metadata.Transforms, "namespace-sessions")
+		}
+		for _, offset := range *mergeOffsets {
+			metadata.Transforms = append(metadata.Transforms, fmt.Sprintf("offset %s", offset))
+		}
+
+		writeItems(items, *mergeOutput, *mergeCompression, metadata)
+
+	case capture.FullCommand():
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		listener, err := net.Listen("tcp", *captureListen)
+		if err != nil {
+			kingpin.Fatalf("failed to listen: %v", err)
 		}
 
-		buffer.Flush()
-		outputFile.Close()
+		logger.Log("event", "capture.listen", "address", listener.Addr(), "upstream", *captureUpstream)
+		items := pgreplay.NewProxy(logger, *captureUpstream).Serve(ctx, listener)
+
+		// Serve closes the items channel once we've been signalled to stop and every
+		// connection has closed. Like every JSON log we write, the capture begins with a
+		// header summarising it, so we spool the items until then.
+		metadata := newMetadata("capture", nil, nil, nil)
+		metadata.SourceFiles = []string{*captureUpstream}
+
+		writeItems(items, *captureOutput, *captureCompression, metadata)
+		logger.Log("event", "capture.finished")
 
 	case run.FullCommand():
+		// Refuse logs we can't replay before connecting to anything
+		if len(*runJsonInput) > 0 && !s3Bucket {
+			checkMetadata(*runJsonInput)
+		}
+
 		ctx := context.Background()
 		database, err := pgreplay.NewDatabase(
 			ctx,
@@ -149,6 +424,9 @@ func main() {
 				Database: *runDatname,
 				User:     *runUser,
 				Password: *runPassword,
+
+				ParameterTypes: *runParamTypes,
+				Pool:           pool,
 			},
 		)
 
@@ -159,18 +437,27 @@ func main() {
 
 		var items chan pgreplay.Item
 
-		switch checkSingleFormat(runJsonInput, runErrlogInput, runCsvLogInput) {
+		switch checkSingleFormat(runJsonInput, runErrlogInput, runCsvLogInput, runJsonLogInput, runPcapInput, runBinaryInput) {
 		case runJsonInput:
-			items = parseLog(*runJsonInput, s3Bucket, pgreplay.ParseJSON, *start, *finish)
+			items = parseLog(*runJsonInput, s3Bucket, jsonParser, start, finish)
 		case runErrlogInput:
-			items = parseLog(*runErrlogInput, s3Bucket, pgreplay.ParseErrlog, *start, *finish)
+			items = parseLog(*runErrlogInput, s3Bucket, pgreplay.NewErrlogParser(prefix), start, finish)
 		case runCsvLogInput:
-			items = parseLog(*runCsvLogInput, s3Bucket, pgreplay.ParseCsvLog, *start, *finish)
+			items = parseLog(*runCsvLogInput, s3Bucket, csvParser, start, finish)
+		case runJsonLogInput:
+			items = parseLog(*runJsonLogInput, s3Bucket, pgreplay.ParseJsonLog, start, finish)
+		case runPcapInput:
+			items = parseLog(*runPcapInput, s3Bucket, pgreplay.NewPcapParser(*pcapPort), start, finish)
+		case runBinaryInput:
+			items = parseLog(*runBinaryInput, s3Bucket, pgreplay.NewBinaryParser(start), start, finish)
 		default:
 			logger.Log("event", "postgres.error", "error", "you must provide an input")
 			os.Exit(255)
 		}
 
+		items = sampler.Sample(itemFilter.Filter(transformer.Transform(items)))
+		items = amplifier.Amplify(items)
+
 		replay_started := time.Now()
 		stream, err := pgreplay.NewStreamer(start, finish, logger).Stream(items, *runReplayRate)
 		if err != nil {
@@ -214,6 +501,183 @@ var (
 	GoVersion = runtime.Version()
 )
 
+// loadItemFilter builds the filter for the rules given on the command line, along with
+// those of the rules file if one was given.
+func loadItemFilter(includes, excludes []string, path string) (pgreplay.ItemFilter, error) {
+	var rules []pgreplay.FilterRule
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return pgreplay.ItemFilter{}, err
+		}
+
+		defer file.Close()
+
+		if rules, err = pgreplay.LoadFilterRules(file); err != nil {
+			return pgreplay.ItemFilter{}, errors.Wrapf(err, "--filter-rules %s", path)
+		}
+	}
+
+	for _, value := range includes {
+		rule, err := pgreplay.ParseFilterRule(false, value)
+		if err != nil {
+			return pgreplay.ItemFilter{}, errors.Wrap(err, "--include")
+		}
+
+		rules = append(rules, rule)
+	}
+
+	for _, value := range excludes {
+		rule, err := pgreplay.ParseFilterRule(true, value)
+		if err != nil {
+			return pgreplay.ItemFilter{}, errors.Wrap(err, "--exclude")
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return pgreplay.NewItemFilter(rules), nil
+}
+
+// loadTransformer builds a transformer from the given presets, followed by the rules of
+// the rules file if one was given.
+func loadTransformer(presets []string, path string) (*pgreplay.Transformer, error) {
+	var rules []pgreplay.TransformRule
+
+	for _, preset := range presets {
+		presetRules, err := pgreplay.PresetTransformRules(preset)
+		if err != nil {
+			return nil, errors.Wrap(err, "--transform-preset")
+		}
+
+		rules = append(rules, presetRules...)
+	}
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.Close()
+
+		fileRules, err := pgreplay.LoadTransformRules(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "--transform-rules %s", path)
+		}
+
+		rules = append(rules, fileRules...)
+	}
+
+	return pgreplay.NewTransformer(rules), nil
+}
+
+// loadAnonymiser builds an anonymiser with the given key, and the rules of the rules file
+// if one was given.
+func loadAnonymiser(key, path string) (*pgreplay.Anonymiser, error) {
+	if key == "" {
+		return nil, errors.New("--anonymise requires --anonymise-key or PGREPLAY_ANONYMISE_KEY")
+	}
+
+	var rules []pgreplay.AnonymiseRule
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.Close()
+
+		if rules, err = pgreplay.LoadAnonymiseRules(file); err != nil {
+			return nil, errors.Wrapf(err, "--anonymise-rules %s", path)
+		}
+	}
+
+	return pgreplay.NewAnonymiser([]byte(key), rules), nil
+}
+
+// splitItems writes items into shard files within the directory, along with a manifest
+// describing each of them. Each shard begins with a header completed from the metadata.
+func splitItems(items chan pgreplay.Item, by string, shards int, dir string, metadata pgreplay.JSONMetadata) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files := make([]*os.File, shards)
+	outputs := make([]pgreplay.Shard, shards)
+	for idx := range files {
+		file, err := os.Create(filepath.Join(dir, fmt.Sprintf("shard-%03d.jsonl", idx)))
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		spool, err := os.CreateTemp(dir, ".pgreplay-spool-*")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		files[idx], outputs[idx] = file, pgreplay.Shard{Output: file, Spool: spool}
+	}
+
+	summaries, err := pgreplay.SplitItems(items, by, metadata, outputs)
+	if err != nil {
+		return err
+	}
+
+	for idx, file := range files {
+		summaries[idx].Path = filepath.Base(file.Name())
+		logger.Log("event", "split.shard", "path", file.Name(), "items", summaries[idx].Items, "sessions", summaries[idx].Sessions)
+	}
+
+	manifest, err := json.MarshalIndent(pgreplay.ShardManifest{By: by, Shards: summaries}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, "manifest.json"), append(manifest, '\n'), 0644)
+}
+
+// loadPoolConfig builds the pools that sessions are multiplexed onto, if any
+func loadPoolConfig(size int, users, databases []string) (pgreplay.PoolConfig, error) {
+	var (
+		config = pgreplay.PoolConfig{Size: size}
+		err    error
+	)
+
+	if size < 0 {
+		return config, fmt.Errorf("--pool-size must not be negative")
+	}
+
+	if size == 0 && (len(users) > 0 || len(databases) > 0) {
+		return config, fmt.Errorf("--user-pool-size and --database-pool-size require --pool-size")
+	}
+
+	if config.UserSizes, err = pgreplay.ParsePoolSizes(users); err != nil {
+		return config, fmt.Errorf("--user-pool-size flag %s", err)
+	}
+
+	if config.DatabaseSizes, err = pgreplay.ParsePoolSizes(databases); err != nil {
+		return config, fmt.Errorf("--database-pool-size flag %s", err)
+	}
+
+	return config, nil
+}
+
+// logTransformSummary reports how many items each transformation rule touched, once the
+// transformed items have all been consumed.
+func logTransformSummary(transformer *pgreplay.Transformer) {
+	for _, summary := range transformer.Summary() {
+		logger.Log("event", "transform.summary", "rule", summary.Rule, "items", summary.Items)
+	}
+}
+
 func versionStanza() string {
 	return fmt.Sprintf(
 		"pgreplay Version: %v\nGit SHA: %v\nGo Version: %v\nGo OS/Arch: %v/%v\nBuilt at: %v",
@@ -221,10 +685,10 @@ func versionStanza() string {
 	)
 }
 
-func checkSingleFormat(formats ...*string) (result *string) {
+func checkSingleFormat(formats ...*[]string) (result *[]string) {
 	var supplied = 0
 	for _, format := range formats {
-		if *format != "" {
+		if len(*format) > 0 {
 			result = format
 			supplied++
 		}
@@ -237,35 +701,328 @@ func checkSingleFormat(formats ...*string) (result *string) {
 	return result // which becomes the one that isn't empty
 }
 
-func parseLog(path string, fromS3 bool, parser pgreplay.ParserFunc, start, finish time.Time) chan pgreplay.Item {
+// writeItems serializes every item to the output path as a line of JSON, compressing the
+// output according to the given format or the extension of the path. Statements and
+// executes are fingerprinted as they're written. Unless metadata is nil, the output
+// begins with a header completed from it.
+func writeItems(items chan pgreplay.Item, path, compression string, metadata *pgreplay.JSONMetadata) {
+	outputFile, output := createOutput(path, compression)
+
+	// Buffer the writes by 32MB to enable much faster filtering
+	buffer := bufio.NewWriterSize(output, 32*1000*1000)
+
+	if metadata != nil {
+		spool, err := os.CreateTemp(spoolDir(path), ".pgreplay-spool-*")
+		if err != nil {
+			kingpin.Fatalf("failed to create spool file: %v", err)
+		}
+
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if *metadata, err = pgreplay.WriteJSONLog(buffer, spool, *metadata, pgreplay.FingerprintItems(items)); err != nil {
+			kingpin.Fatalf("failed to write to output file: %v", err)
+		}
+
+		logger.Log("event", "output.metadata", "items", metadata.Items, "sessions", metadata.Sessions, "checksum", metadata.Checksum)
+	} else {
+		for item := range pgreplay.FingerprintItems(items) {
+			bytes, err := pgreplay.ItemMarshalJSON(item)
+			if err != nil {
+				kingpin.Fatalf("failed to serialize item: %v", err)
+			}
+
+			if _, err := buffer.Write(append(bytes, byte('\n'))); err != nil {
+				kingpin.Fatalf("failed to write to output file: %v", err)
+			}
+		}
+	}
+
+	if err := buffer.Flush(); err != nil {
+		kingpin.Fatalf("failed to write to output file: %v", err)
+	}
+	if err := output.Close(); err != nil {
+		kingpin.Fatalf("failed to compress output file: %v", err)
+	}
+	outputFile.Close()
+}
+
+// spoolDir chooses where to spool items before writing them, preferring the directory of
+// the output as it's sure to have space for them
+func spoolDir(path string) string {
+	if path == stdio {
+		return ""
+	}
+
+	return filepath.Dir(path)
+}
+
+// newMetadata begins the header of a JSON log produced from the inputs
+func newMetadata(source string, inputs []string, start, finish *time.Time) *pgreplay.JSONMetadata {
+	files, err := expandPaths(inputs)
+	if err != nil {
+		files = inputs // we've already parsed them, so this isn't the place to complain
+	}
+
+	return &pgreplay.JSONMetadata{
+		PgreplayVersion: Version,
+		SourceFormat:    source,
+		SourceFiles:     files,
+		Start:           start,
+		Finish:          finish,
+	}
+}
+
+// describeFilters lists the global options that filter and transform items, for the
+// header of JSON logs
+func describeFilters() (filters, transforms []string) {
+	for _, rule := range *includeRules {
+		filters = append(filters, "include "+rule)
+	}
+	for _, rule := range *excludeRules {
+		filters = append(filters, "exclude "+rule)
+	}
+	if *filterRules != "" {
+		filters = append(filters, "filter-rules "+*filterRules)
+	}
+	if *sampleSessions != 1 {
+		sample := fmt.Sprintf("sample-sessions %v seed %d", *sampleSessions, *sampleSeed)
+		if *sampleBy != "" {
+			sample += " by " + *sampleBy
+		}
+
+		filters = append(filters, sample)
+	}
+	for _, preset := range *transformSets {
+		transforms = append(transforms, "transform-preset "+preset)
+	}
+	if *transformRules != "" {
+		transforms = append(transforms, "transform-rules "+*transformRules)
+	}
+
+	return filters, transforms
+}
+
+// checkMetadata reads the header of every JSON input before we replay them, refusing to
+// start if we can't read any of them, and publishing their size so we can report our
+// progress. Headers can't be read from stdin without consuming it, so we skip it.
+func checkMetadata(inputs []string) {
+	paths, err := expandPaths(inputs)
+	if err != nil {
+		kingpin.Fatalf("failed to find logfiles: %s", err)
+	}
+
+	var headers []pgreplay.JSONMetadata
+	for _, path := range paths {
+		if path == stdio {
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			kingpin.Fatalf("failed to open logfile: %s", err)
+		}
+
+		input, err := pgreplay.NewDecompressingReader(file)
+		if err != nil {
+			kingpin.Fatalf("failed to decompress logfile: %s", err)
+		}
+
+		metadata, err := pgreplay.ReadJSONMetadata(input)
+		file.Close()
+		if err != nil {
+			kingpin.Fatalf("cannot replay %s: %s", path, err)
+		}
+
+		if metadata == nil {
+			logger.Log("event", "run.metadata", "file", path, "msg", "Log has no metadata header")
+			continue
+		}
+
+		logger.Log(
+			"event", "run.metadata", "file", path, "items", metadata.Items,
+			"first", metadata.First, "last", metadata.Last,
+			"pgreplay_version", metadata.PgreplayVersion, "source_format", metadata.SourceFormat,
+		)
+
+		headers = append(headers, *metadata)
+	}
+
+	pgreplay.ObserveMetadata(headers)
+}
+
+// writeBinaryItems is writeItems for the binary format. Only uncompressed files can be
+// seeked by run --start, as we can't seek within a compressed stream.
+func writeBinaryItems(items chan pgreplay.Item, path, compression string) {
+	outputFile, output := createOutput(path, compression)
+
+	// Buffer the writes by 32MB to enable much faster filtering
+	buffer := bufio.NewWriterSize(output, 32*1000*1000)
+
+	writer, err := pgreplay.NewBinaryWriter(buffer)
+	if err != nil {
+		kingpin.Fatalf("failed to write to output file: %v", err)
+	}
+
+	for item := range pgreplay.FingerprintItems(items) {
+		if err := writer.Write(item); err != nil {
+			kingpin.Fatalf("failed to write to output file: %v", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		kingpin.Fatalf("failed to write to output file: %v", err)
+	}
+	if err := buffer.Flush(); err != nil {
+		kingpin.Fatalf("failed to write to output file: %v", err)
+	}
+	if err := output.Close(); err != nil {
+		kingpin.Fatalf("failed to compress output file: %v", err)
+	}
+	outputFile.Close()
+}
+
+// createOutput creates the output file, or uses stdout, and wraps it with a compressor
+// for the given format or the extension of the path
+func createOutput(path, compression string) (*os.File, io.WriteCloser) {
+	var err error
+
+	outputFile := os.Stdout
+	if path != stdio {
+		if outputFile, err = os.Create(path); err != nil {
+			kingpin.Fatalf("failed to create output file: %v", err)
+		}
+	}
+
+	if compression == "" {
+		compression = pgreplay.CompressionFromPath(path)
+	}
+
+	output, err := pgreplay.NewCompressingWriter(outputFile, compression)
+	if err != nil {
+		kingpin.Fatalf("failed to compress output file: %v", err)
+	}
+
+	return outputFile, output
+}
+
+// parseLog parses every input file concurrently and merges the items into a single
+// stream ordered by timestamp. Each input may be a file, a directory of files or a glob.
+func parseLog(inputs []string, fromS3 bool, parser pgreplay.ParserFunc, start, finish *time.Time) chan pgreplay.Item {
 	if fromS3 {
 		return aws.StreamItemsFromS3(context.Background(), logger, *fromS3Bucket, aws.ParserHelper{
 			Parser: parser,
-			Start:  start,
-			Finish: finish,
+			Start:  *start,
+			Finish: *finish,
 		})
 	}
 
-	file, err := os.Open(path)
+	paths, err := expandPaths(inputs)
 	if err != nil {
-		kingpin.Fatalf("failed to open logfile: %s", err)
+		kingpin.Fatalf("failed to find logfiles: %s", err)
 	}
 
-	items, logerrs, done := parser(file)
+	sources := make([]chan pgreplay.Item, 0, len(paths))
+	for _, path := range paths {
+		sources = append(sources, parseFile(path, parser))
+	}
+
+	return pgreplay.MergeItems(sources...)
+}
+
+func parseFile(path string, parser pgreplay.ParserFunc) chan pgreplay.Item {
+	file := os.Stdin
+	if path != stdio {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			kingpin.Fatalf("failed to open logfile: %s", err)
+		}
+	}
+
+	input, err := pgreplay.NewDecompressingReader(file)
+	if err != nil {
+		kingpin.Fatalf("failed to decompress logfile: %s", err)
+	}
+
+	items, logerrs, done := parser(input)
 
 	go func() {
-		logger.Log("event", "parse.finished", "error", <-done)
+		logger.Log("event", "parse.finished", "file", path, "error", <-done)
+		input.Close()
+		file.Close()
 	}()
 
 	go func() {
 		for err := range logerrs {
-			level.Debug(logger).Log("event", "parse.error", "error", err)
+			level.Debug(logger).Log("event", "parse.error", "file", path, "error", err)
 		}
 	}()
 
 	return items
 }
 
+// expandPaths resolves each input into the files it refers to. Directories expand to the
+// regular files they contain and globs to their matches, both in lexical order. The stdio
+// path is passed through untouched, and may only be given once.
+func expandPaths(inputs []string) ([]string, error) {
+	var paths []string
+	var stdin bool
+
+	for _, input := range inputs {
+		// kingpin parses a bare - as an empty value, which is never a valid path otherwise
+		if input == stdio || input == "" {
+			if stdin {
+				return nil, fmt.Errorf("stdin can only be read once")
+			}
+
+			stdin = true
+			paths = append(paths, stdio)
+			continue
+		}
+
+		matches := []string{input}
+		if strings.ContainsAny(input, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(input); err != nil {
+				return nil, err
+			}
+
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", input)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if !info.IsDir() {
+				paths = append(paths, match)
+				continue
+			}
+
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, entry := range entries {
+				if entry.Type().IsRegular() {
+					paths = append(paths, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no input files found")
+	}
+
+	return paths, nil
+}
+
 // parseTimestamp parsed a Postgres friendly timestamp
 func parseTimestamp(in string) (*time.Time, error) {
 	if in == "" {
@@ -64,7 +64,15 @@ func StreamItemsFromS3(ctx context.Context, logger kitlog.Logger, bucketName str
 				continue
 			}
 
-			items, logerrs, done := ph.Parser(file)
+			input, err := pgreplay.NewDecompressingReader(file)
+			if err != nil {
+				logger.Log("event", "file.error", "error", err)
+				os.Remove(file.Name())
+				file.Close()
+				continue
+			}
+
+			items, logerrs, done := ph.Parser(input)
 			go func() {
 				logger.Log("event", "parse.finished", "file", file.Name(), "error", <-done)
 			}()
@@ -80,7 +88,8 @@ func StreamItemsFromS3(ctx context.Context, logger kitlog.Logger, bucketName str
 				out <- i
 			}
 
-			// Clean tmp File
+			// Clean tmp File, closing the decompressor before the file it reads from
+			input.Close()
 			os.Remove(file.Name())
 			file.Close()
 			level.Debug(logger).Log("event", "file.cleaner", "msg", "file cleaned", "path", file.Name())
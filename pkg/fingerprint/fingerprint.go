@@ -0,0 +1,185 @@
+// Package fingerprint identifies queries that differ only in their constants, in the
+// spirit of pg_stat_statements. Queries are normalised by replacing every constant and
+// bind parameter with a placeholder, so 'select * from users where id = 1' and 'select *
+// from users where id = $1' share a fingerprint.
+package fingerprint
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Placeholder replaces constants and bind parameters in normalised queries
+const Placeholder = "?"
+
+// Fingerprint is the normalised text of a query, along with a short ID derived from it
+type Fingerprint struct {
+	ID   string
+	Text string
+}
+
+// Compute fingerprints the given query
+func Compute(query string) Fingerprint {
+	text := Normalise(query)
+
+	hash := fnv.New64a()
+	hash.Write([]byte(text))
+
+	return Fingerprint{ID: fmt.Sprintf("%016x", hash.Sum64()), Text: text}
+}
+
+// Normalise produces the normalised text of a query. Constants and parameters become
+// placeholders, IN lists of them collapse to 'in (...)', unquoted identifiers and keywords
+// are lowercased, comments are removed, and whitespace is made consistent.
+func Normalise(query string) string {
+	tokens := significant(Lex(query))
+	tokens = replaceConstants(tokens)
+	tokens = collapseInLists(tokens)
+
+	// Trailing semicolons don't change the query
+	for len(tokens) > 0 && tokens[len(tokens)-1].Text == ";" {
+		tokens = tokens[:len(tokens)-1]
+	}
+
+	var builder strings.Builder
+	for idx, token := range tokens {
+		if idx > 0 && spaced(tokens[idx-1], token) {
+			builder.WriteByte(' ')
+		}
+
+		builder.WriteString(token.Text)
+	}
+
+	return builder.String()
+}
+
+// significant removes whitespace and comments, and lowercases unquoted identifiers
+func significant(tokens []Token) []Token {
+	result := make([]Token, 0, len(tokens))
+	for _, token := range tokens {
+		switch token.Kind {
+		case Whitespace, Comment:
+			continue
+		case Identifier:
+			token.Text = strings.ToLower(token.Text)
+		}
+
+		result = append(result, token)
+	}
+
+	return result
+}
+
+// replaceConstants swaps constants and parameters for placeholders. A minus sign that
+// negates a constant is folded into it, as it isn't a subtraction.
+func replaceConstants(tokens []Token) []Token {
+	result := make([]Token, 0, len(tokens))
+	for _, token := range tokens {
+		switch token.Kind {
+		case String, Number, Parameter:
+			if last := len(result) - 1; last >= 0 && result[last].Text == "-" && token.Kind == Number && negates(result[:last]) {
+				result = result[:last]
+			}
+
+			result = append(result, Token{Parameter, Placeholder})
+		default:
+			result = append(result, token)
+		}
+	}
+
+	return result
+}
+
+// negates reports whether a minus following these tokens is unary
+func negates(preceding []Token) bool {
+	if len(preceding) == 0 {
+		return true
+	}
+
+	previous := preceding[len(preceding)-1]
+	switch previous.Kind {
+	case Operator:
+		return true
+	case Punctuation:
+		return previous.Text != ")" && previous.Text != "]"
+	case Identifier:
+		return keywords[previous.Text]
+	}
+
+	return false
+}
+
+// collapseInLists replaces 'in (?, ?, ?)' with 'in (...)', so that queries fingerprint
+// the same regardless of how many values they list.
+func collapseInLists(tokens []Token) []Token {
+	result := make([]Token, 0, len(tokens))
+	for idx := 0; idx < len(tokens); idx++ {
+		result = append(result, tokens[idx])
+
+		if tokens[idx].Kind != Identifier || tokens[idx].Text != "in" {
+			continue
+		}
+
+		if end, ok := placeholderList(tokens, idx+1); ok {
+			result = append(result, Token{Punctuation, "("}, Token{Parameter, "..."}, Token{Punctuation, ")"})
+			idx = end
+		}
+	}
+
+	return result
+}
+
+// placeholderList finds the closing parenthesis of a list of placeholders that begins at
+// start, allowing each to be cast such as '?::int'.
+func placeholderList(tokens []Token, start int) (int, bool) {
+	if start >= len(tokens) || tokens[start].Text != "(" {
+		return 0, false
+	}
+
+	expectValue := true
+	for idx := start + 1; idx < len(tokens); idx++ {
+		token := tokens[idx]
+
+		switch {
+		case expectValue && token.Kind == Parameter:
+			expectValue = false
+		case !expectValue && token.Text == "::" && idx+1 < len(tokens) && tokens[idx+1].Kind == Identifier:
+			idx++
+		case !expectValue && token.Text == ",":
+			expectValue = true
+		case !expectValue && token.Text == ")":
+			return idx, true
+		default:
+			return 0, false
+		}
+	}
+
+	return 0, false
+}
+
+// spaced decides whether to separate two tokens with a space in the normalised text
+func spaced(previous, next Token) bool {
+	switch {
+	case previous.Text == "(" || previous.Text == "[" || previous.Text == "." || previous.Text == "::":
+		return false
+	case next.Text == ")" || next.Text == "]" || next.Text == "," || next.Text == ";" || next.Text == "." || next.Text == "::":
+		return false
+	case next.Text == "(" || next.Text == "[":
+		// Function calls and array subscripts hug their identifier, but keywords don't
+		return previous.Kind != QuotedIdentifier && (previous.Kind != Identifier || keywords[previous.Text])
+	}
+
+	return true
+}
+
+// keywords are those that may precede a parenthesis or a negative number, which helps
+// us tell them apart from function names and column references.
+var keywords = map[string]bool{
+	"all": true, "and": true, "any": true, "as": true, "between": true, "by": true,
+	"case": true, "else": true, "exists": true, "filter": true, "from": true, "in": true,
+	"into": true, "is": true, "join": true, "like": true, "limit": true, "not": true,
+	"offset": true, "on": true, "or": true, "over": true, "returning": true, "select": true,
+	"set": true, "some": true, "then": true, "union": true, "using": true, "values": true,
+	"when": true, "where": true, "with": true, "within": true,
+}
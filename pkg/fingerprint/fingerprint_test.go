@@ -0,0 +1,76 @@
+package fingerprint
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lex", func() {
+	DescribeTable("Tokenises",
+		func(query string, expected []Token) {
+			Expect(Lex(query)).To(Equal(expected))
+		},
+		Entry("quotes and comment markers within strings", `'it''s -- not /* a comment'`, []Token{
+			{String, `'it''s -- not /* a comment'`},
+		}),
+		Entry("escape strings", `E'\'quoted\''`, []Token{{String, `E'\'quoted\''`}}),
+		Entry("dollar quoted strings", `$fn$ select 'a' $$ $fn$`, []Token{{String, `$fn$ select 'a' $$ $fn$`}}),
+		Entry("parameters", `$1+$22`, []Token{{Parameter, "$1"}, {Operator, "+"}, {Parameter, "$22"}}),
+		Entry("nested comments", "/* a /* b */ c */1", []Token{{Comment, "/* a /* b */ c */"}, {Number, "1"}}),
+		Entry("line comments", "1 -- one\n2", []Token{
+			{Number, "1"}, {Whitespace, " "}, {Comment, "-- one"}, {Whitespace, "\n"}, {Number, "2"},
+		}),
+		Entry("negative comparisons", "a=-1.5e3", []Token{
+			{Identifier, "a"}, {Operator, "="}, {Operator, "-"}, {Number, "1.5e3"},
+		}),
+		Entry("quoted identifiers", `"Users"."id"`, []Token{
+			{QuotedIdentifier, `"Users"`}, {Punctuation, "."}, {QuotedIdentifier, `"id"`},
+		}),
+		Entry("casts", "'1'::int", []Token{{String, "'1'"}, {Operator, "::"}, {Identifier, "int"}}),
+	)
+})
+
+var _ = Describe("Normalise", func() {
+	DescribeTable("Normalises",
+		func(query, expected string) {
+			Expect(Normalise(query)).To(Equal(expected))
+		},
+		Entry("constants",
+			"SELECT * FROM users WHERE id = 1 AND email = 'alice@example.com'",
+			"select * from users where id = ? and email = ?"),
+		Entry("bind parameters",
+			"select * from users where id = $1",
+			"select * from users where id = ?"),
+		Entry("negative numbers",
+			"select a - 1 from t where b = -2",
+			"select a - ? from t where b = ?"),
+		Entry("IN lists",
+			"select * from t where id in (1, 2, 3) and kind IN ($1::text, $2::text)",
+			"select * from t where id in (...) and kind in (...)"),
+		Entry("IN subqueries",
+			"select * from t where id in (select id from u)",
+			"select * from t where id in (select id from u)"),
+		Entry("comments, whitespace and semicolons",
+			"/* app:api */ select\n\tcount(*)  from t -- trailing\n;",
+			"select count(*) from t"),
+		Entry("quoted identifiers keep their case",
+			`SELECT "Users"."Name" FROM "Users"`,
+			`select "Users"."Name" from "Users"`),
+		Entry("dollar quoted bodies",
+			"select $body$ it's -- fine $body$, 1",
+			"select ?, ?"),
+		Entry("function calls and keywords",
+			"SELECT coalesce(a, 0) FROM t WHERE exists(SELECT 1)",
+			"select coalesce(a, ?) from t where exists (select ?)"),
+	)
+
+	It("Shares fingerprints between queries differing in constants", func() {
+		a := Compute("select * from users where id in (1, 2) and name = 'alice'")
+		b := Compute("SELECT *\nFROM users WHERE id IN ($1) AND name = $2")
+
+		Expect(a).To(Equal(b))
+		Expect(a.ID).To(HaveLen(16))
+		Expect(Compute("select * from accounts where id = 1").ID).NotTo(Equal(a.ID))
+	})
+})
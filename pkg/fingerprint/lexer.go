@@ -0,0 +1,262 @@
+package fingerprint
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	Identifier       TokenKind = iota // unquoted identifiers and keywords
+	QuotedIdentifier                  // "Identifier"
+	String                            // 'string', E'string', $$string$$ and friends
+	Number                            // 42, 3.14, 1e10, .5
+	Parameter                         // $1
+	Operator                          // +, <=, ||, ::, ...
+	Punctuation                       // ( ) [ ] , ; .
+	Whitespace
+	Comment // -- comment, /* comment */
+)
+
+// Token is a single lexical element of a query
+type Token struct {
+	Kind TokenKind
+	Text string
+}
+
+// operatorChars are those Postgres allows in operators
+const operatorChars = "+-*/<>=~!@#%^&|`?:"
+
+// Lex splits a query into tokens following the lexical rules of Postgres, so that quotes
+// and comment markers within string literals, dollar quoted bodies and comments never
+// confuse us. Lex never fails: unterminated strings or comments run to the end of the
+// query, as Postgres would have rejected it anyway.
+func Lex(query string) []Token {
+	var tokens []Token
+
+	for pos := 0; pos < len(query); {
+		kind, end := lexToken(query, pos)
+		tokens = append(tokens, Token{kind, query[pos:end]})
+		pos = end
+	}
+
+	return tokens
+}
+
+func lexToken(query string, pos int) (TokenKind, int) {
+	c := query[pos]
+
+	switch {
+	case isSpace(c):
+		end := pos + 1
+		for end < len(query) && isSpace(query[end]) {
+			end++
+		}
+
+		return Whitespace, end
+
+	case strings.HasPrefix(query[pos:], "--"):
+		if end := strings.IndexByte(query[pos:], '\n'); end >= 0 {
+			return Comment, pos + end
+		}
+
+		return Comment, len(query)
+
+	case strings.HasPrefix(query[pos:], "/*"):
+		return Comment, lexBlockComment(query, pos)
+
+	case c == '\'':
+		return String, lexQuoted(query, pos, '\'', false)
+
+	case c == '"':
+		return QuotedIdentifier, lexQuoted(query, pos, '"', false)
+
+	case c == '$':
+		if end, ok := lexDollarQuoted(query, pos); ok {
+			return String, end
+		}
+
+		end := pos + 1
+		for end < len(query) && isDigit(query[end]) {
+			end++
+		}
+
+		if end > pos+1 {
+			return Parameter, end
+		}
+
+		return Operator, end
+
+	case isDigit(c) || (c == '.' && pos+1 < len(query) && isDigit(query[pos+1])):
+		return Number, lexNumber(query, pos)
+
+	case isIdentifierStart(query, pos):
+		// String constants can be prefixed: E'escaped', B'0101', X'ff', N'national' and
+		// U&'unicode'
+		if end, ok := lexPrefixedString(query, pos); ok {
+			return String, end
+		}
+
+		end := pos
+		for end < len(query) && isIdentifierPart(query, end) {
+			end += runeLength(query, end)
+		}
+
+		return Identifier, end
+
+	case strings.IndexByte("()[],;.", c) >= 0:
+		return Punctuation, pos + 1
+
+	case strings.IndexByte(operatorChars, c) >= 0:
+		end := pos + 1
+		for end < len(query) && strings.IndexByte(operatorChars, query[end]) >= 0 {
+			// Comments begin even in the middle of an operator
+			if strings.HasPrefix(query[end:], "--") || strings.HasPrefix(query[end:], "/*") {
+				break
+			}
+
+			end++
+		}
+
+		// Postgres only allows multi character operators to end in + or - if they
+		// contain one of ~!@#%^&|`?, so that 'a=-1' compares a with -1
+		for end > pos+1 && strings.IndexByte("+-", query[end-1]) >= 0 &&
+			!strings.ContainsAny(query[pos:end], "~!@#%^&|`?") {
+			end--
+		}
+
+		return Operator, end
+	}
+
+	return Operator, pos + runeLength(query, pos)
+}
+
+// lexBlockComment finds the end of a comment, which Postgres allows to be nested
+func lexBlockComment(query string, pos int) int {
+	depth := 0
+	for idx := pos; idx < len(query)-1; idx++ {
+		switch query[idx : idx+2] {
+		case "/*":
+			depth++
+			idx++
+		case "*/":
+			depth--
+			idx++
+
+			if depth == 0 {
+				return idx + 1
+			}
+		}
+	}
+
+	return len(query)
+}
+
+// lexQuoted finds the end of a quoted string or identifier, where the quote is escaped by
+// doubling it, or with a backslash in escape strings.
+func lexQuoted(query string, pos int, quote byte, backslashes bool) int {
+	for idx := pos + 1; idx < len(query); idx++ {
+		switch query[idx] {
+		case '\\':
+			if backslashes {
+				idx++
+			}
+		case quote:
+			if idx+1 < len(query) && query[idx+1] == quote {
+				idx++
+				continue
+			}
+
+			return idx + 1
+		}
+	}
+
+	return len(query)
+}
+
+// lexDollarQuoted finds the end of a $tag$ quoted string, if one begins at pos
+func lexDollarQuoted(query string, pos int) (int, bool) {
+	end := pos + 1
+	if end < len(query) && isIdentifierStart(query, end) {
+		for end < len(query) && query[end] != '$' && isIdentifierPart(query, end) {
+			end += runeLength(query, end)
+		}
+	}
+
+	if end >= len(query) || query[end] != '$' {
+		return 0, false
+	}
+
+	tag := query[pos : end+1]
+	if close := strings.Index(query[end+1:], tag); close >= 0 {
+		return end + 1 + close + len(tag), true
+	}
+
+	return len(query), true
+}
+
+func lexPrefixedString(query string, pos int) (int, bool) {
+	rest := query[pos:]
+
+	switch {
+	case len(rest) > 1 && (rest[0] == 'e' || rest[0] == 'E') && rest[1] == '\'':
+		return lexQuoted(query, pos+1, '\'', true), true
+	case len(rest) > 1 && strings.IndexByte("bBxXnN", rest[0]) >= 0 && rest[1] == '\'':
+		return lexQuoted(query, pos+1, '\'', false), true
+	case len(rest) > 2 && (rest[0] == 'u' || rest[0] == 'U') && rest[1] == '&' && rest[2] == '\'':
+		return lexQuoted(query, pos+2, '\'', false), true
+	}
+
+	return 0, false
+}
+
+func lexNumber(query string, pos int) int {
+	end := pos
+	for end < len(query) && (isDigit(query[end]) || query[end] == '_') {
+		end++
+	}
+
+	if end < len(query) && query[end] == '.' && !strings.HasPrefix(query[end:], "..") {
+		end++
+		for end < len(query) && (isDigit(query[end]) || query[end] == '_') {
+			end++
+		}
+	}
+
+	if end < len(query) && (query[end] == 'e' || query[end] == 'E') {
+		exponent := end + 1
+		if exponent < len(query) && (query[exponent] == '+' || query[exponent] == '-') {
+			exponent++
+		}
+
+		if exponent < len(query) && isDigit(query[exponent]) {
+			end = exponent
+			for end < len(query) && isDigit(query[end]) {
+				end++
+			}
+		}
+	}
+
+	return end
+}
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentifierStart(query string, pos int) bool {
+	c := query[pos]
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= utf8.RuneSelf
+}
+
+func isIdentifierPart(query string, pos int) bool {
+	return isIdentifierStart(query, pos) || isDigit(query[pos]) || query[pos] == '$'
+}
+
+func runeLength(query string, pos int) int {
+	if _, size := utf8.DecodeRuneInString(query[pos:]); size > 0 {
+		return size
+	}
+
+	return 1
+}
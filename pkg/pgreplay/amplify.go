@@ -0,0 +1,170 @@
+package pgreplay
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// Amplifier clones every session several times, so that replaying a log can drive more
+// concurrency than it originally had. The first copy of each session is the original,
+// and each clone has a session ID derived from it, such as '5c7404eb.d6bd/2'.
+//
+// Clones are delayed by a random jitter, fixed for each clone of a session, so they
+// don't run in lockstep with the original. They can also perturb their integer
+// parameters, so that clones don't always hit the same rows in the cache. Where the log
+// captured the types of parameters we only perturb those of int2, int4 and int8. Without
+// types we perturb every parameter written as a plain integer, which can include text
+// such as phone numbers, though never those with leading zeros.
+type Amplifier struct {
+	copies  int
+	jitter  time.Duration
+	perturb int64
+	seed    int64
+}
+
+// NewAmplifier creates an amplifier that produces the given number of copies of each
+// session, including the original. Clones are delayed by up to jitter, and their integer
+// parameters moved by up to perturb in either direction.
+func NewAmplifier(copies int, jitter time.Duration, perturb int64, seed int64) (*Amplifier, error) {
+	if copies < 1 {
+		return nil, fmt.Errorf("must produce at least one copy of each session, not %d", copies)
+	}
+
+	if jitter < 0 || perturb < 0 {
+		return nil, fmt.Errorf("jitter and perturbation must not be negative")
+	}
+
+	return &Amplifier{copies: copies, jitter: jitter, perturb: perturb, seed: seed}, nil
+}
+
+// Amplify emits every item along with its clones, in timestamp order. As clones are only
+// ever delayed, and by no more than our jitter, we hold back items until no later input
+// could come before them.
+func (a *Amplifier) Amplify(items chan Item) chan Item {
+	if a.copies == 1 {
+		return items
+	}
+
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		var (
+			pending  itemHeap
+			sequence int
+		)
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			for clone := 0; clone < a.copies; clone++ {
+				heap.Push(&pending, itemHead{a.clone(item, clone), sequence})
+				sequence++
+			}
+
+			// Every item still to come is at least as late as this one, as are all its
+			// clones
+			for pending.Len() > 0 && !pending[0].item.GetTimestamp().After(item.GetTimestamp()) {
+				out <- heap.Pop(&pending).(itemHead).item
+			}
+		}
+
+		for pending.Len() > 0 {
+			out <- heap.Pop(&pending).(itemHead).item
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+// clone returns the given copy of the item, where the zeroth copy is the original
+func (a *Amplifier) clone(item Item, clone int) Item {
+	if clone == 0 {
+		return item
+	}
+
+	session := item.GetSessionID()
+
+	details := item.GetDetails()
+	details.SessionID = SessionID(fmt.Sprintf("%s/%d", session, clone))
+	if a.jitter > 0 {
+		details.Timestamp = details.Timestamp.Add(time.Duration(a.hash(string(session), clone) % uint64(a.jitter)))
+	}
+
+	item = WithDetails(item, details)
+
+	parameters := itemParameters(item)
+	if a.perturb == 0 || parameters == nil {
+		return item
+	}
+
+	types := itemParameterTypes(item)
+
+	perturbed := make([]interface{}, len(parameters))
+	for idx, parameter := range parameters {
+		var oid uint32
+		if idx < len(types) {
+			oid = types[idx]
+		}
+
+		perturbed[idx] = a.perturbParameter(parameter, oid, clone)
+	}
+
+	return withParameters(item, perturbed)
+}
+
+// perturbParameter moves integer parameters by a deterministic offset, so the same value
+// in a clone is always moved alike. Parameters of a known type are only moved if they're
+// integers, and then stay within the range of their type. Values never change sign, to
+// avoid producing invalid IDs.
+func (a *Amplifier) perturbParameter(parameter interface{}, oid uint32, clone int) interface{} {
+	bits := 64
+	switch oid {
+	case 0: // unknown, so we go by how the value is written
+	case oidInt2:
+		bits = 16
+	case oidInt4:
+		bits = 32
+	case oidInt8:
+	default:
+		return parameter
+	}
+
+	value, ok := parameter.(string)
+	if !ok || !integerValue.MatchString(value) {
+		return parameter
+	}
+
+	integer, err := strconv.ParseInt(value, 10, bits)
+	if err != nil {
+		return parameter
+	}
+
+	offset := int64(a.hash(value, clone)%uint64(2*a.perturb+1)) - a.perturb
+	max := int64(1)<<(bits-1) - 1
+
+	// Move the other way if we changed sign, which includes overflowing, or left the
+	// range of the type
+	perturbed := integer + offset
+	if (integer < 0) != (perturbed < 0) || perturbed > max || perturbed < -max-1 {
+		perturbed = integer - offset
+	}
+
+	return strconv.FormatInt(perturbed, 10)
+}
+
+func (a *Amplifier) hash(value string, clone int) uint64 {
+	hash := fnv.New64a()
+	binary.Write(hash, binary.BigEndian, a.seed)
+	binary.Write(hash, binary.BigEndian, int64(clone))
+	hash.Write([]byte(value))
+
+	return hash.Sum64()
+}
@@ -0,0 +1,148 @@
+package pgreplay
+
+import (
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Amplifier", func() {
+	var (
+		alice = Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+		bob   = Details{Timestamp: time20190225.Add(time.Second), SessionID: "b", User: "bob", Database: "pgreplay_test"}
+		items = []Item{
+			Connect{alice},
+			Execute{alice, "select * from users where id = $1", 0}.Bind([]interface{}{"42", "alice", nil}),
+			Disconnect{alice},
+			Connect{bob},
+			Disconnect{bob},
+		}
+		amplify = func(amplifier *Amplifier) []Item {
+			in := make(chan Item, len(items))
+			for _, item := range items {
+				in <- item
+			}
+			close(in)
+
+			var out []Item
+			for item := range amplifier.Amplify(in) {
+				out = append(out, item)
+			}
+
+			return out
+		}
+		sessions = func(items []Item) map[SessionID][]string {
+			result := map[SessionID][]string{}
+			for _, item := range items {
+				result[item.GetSessionID()] = append(result[item.GetSessionID()], ItemType(item))
+			}
+
+			return result
+		}
+	)
+
+	It("Clones every session with derived IDs", func() {
+		amplifier, err := NewAmplifier(3, 0, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		out := amplify(amplifier)
+
+		Expect(out).To(HaveLen(15))
+		Expect(sessions(out)).To(Equal(map[SessionID][]string{
+			"a":   {"Connect", "BoundExecute", "Disconnect"},
+			"a/1": {"Connect", "BoundExecute", "Disconnect"},
+			"a/2": {"Connect", "BoundExecute", "Disconnect"},
+			"b":   {"Connect", "Disconnect"},
+			"b/1": {"Connect", "Disconnect"},
+			"b/2": {"Connect", "Disconnect"},
+		}))
+	})
+
+	It("Delays clones by a fixed jitter per session, keeping timestamp order", func() {
+		amplifier, err := NewAmplifier(4, 10*time.Second, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		out := amplify(amplifier)
+		Expect(out).To(HaveLen(20))
+
+		delays := map[SessionID]time.Duration{}
+		for idx, item := range out {
+			if idx > 0 {
+				Expect(item.GetTimestamp()).NotTo(BeTemporally("<", out[idx-1].GetTimestamp()))
+			}
+
+			// Every item of a clone is delayed alike
+			if session := item.GetSessionID(); session[0] == 'a' {
+				delay := item.GetTimestamp().Sub(time20190225)
+				Expect(delay).To(BeNumerically("<", 10*time.Second))
+
+				if previous, ok := delays[session]; ok {
+					Expect(delay).To(Equal(previous))
+				}
+
+				delays[session] = delay
+			}
+		}
+
+		Expect(delays["a"]).To(BeZero())
+		Expect(delays).To(HaveLen(4))
+	})
+
+	It("Perturbs the integer parameters of clones", func() {
+		amplifier, err := NewAmplifier(2, 0, 5, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		var original, clone BoundExecute
+		for _, item := range amplify(amplifier) {
+			if execute, ok := item.(BoundExecute); ok && execute.SessionID == "a" {
+				original = execute
+			} else if ok {
+				clone = execute
+			}
+		}
+
+		Expect(original.Parameters).To(Equal([]interface{}{"42", "alice", nil}))
+		Expect(clone.Parameters[0]).To(BeElementOf("37", "38", "39", "40", "41", "42", "43", "44", "45", "46", "47"))
+		Expect(clone.Parameters[1:]).To(Equal([]interface{}{"alice", nil}))
+	})
+
+	It("Never changes the sign of perturbed integers", func() {
+		amplifier, err := NewAmplifier(2, 0, 1000, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, value := range []string{"0", "1", "-1", "9223372036854775807"} {
+			perturbed := amplifier.perturbParameter(value, 0, 1).(string)
+			Expect(perturbed[0] == '-').To(Equal(value[0] == '-'), "%s became %s", value, perturbed)
+		}
+	})
+
+	It("Only perturbs parameters captured with an integer type", func() {
+		amplifier, err := NewAmplifier(2, 0, 1000, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		// A zip code, sent as text, keeps its value
+		Expect(amplifier.perturbParameter("90210", oidText, 1)).To(Equal("90210"))
+		Expect(amplifier.perturbParameter("90210", oidInt4, 1)).NotTo(Equal("90210"))
+
+		// Perturbed values stay within the range of their type
+		perturbed, err := strconv.ParseInt(amplifier.perturbParameter("32767", oidInt2, 1).(string), 10, 16)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(perturbed).To(BeNumerically("<", 32767))
+	})
+
+	It("Perturbs untyped parameters written as integers, except those with leading zeros", func() {
+		amplifier, err := NewAmplifier(2, 0, 1000, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(amplifier.perturbParameter("90210", 0, 1)).NotTo(Equal("90210"))
+		Expect(amplifier.perturbParameter("0123", 0, 1)).To(Equal("0123"))
+		Expect(amplifier.perturbParameter("+441234", 0, 1)).To(Equal("+441234"))
+	})
+
+	It("Rejects fewer than one copy", func() {
+		_, err := NewAmplifier(0, 0, 0, 0)
+		Expect(err).To(MatchError(ContainSubstring("at least one copy")))
+	})
+})
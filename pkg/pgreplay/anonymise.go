@@ -0,0 +1,671 @@
+package pgreplay
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocardless/pgreplay-go/pkg/fingerprint"
+)
+
+// AnonymiseRule limits which values are anonymised in the queries of one fingerprint. By
+// default we anonymise every bind parameter and constant, but a rule can restrict this to
+// those in certain parameter positions, or those compared with or inserted into certain
+// columns. Rules are written as one of:
+//
+//	<fingerprint> parameters 1, 3   anonymise only $1 and $3
+//	<fingerprint> columns email     anonymise only values given for the email column
+//	<fingerprint> none              leave the values of these queries untouched
+type AnonymiseRule struct {
+	Fingerprint string
+	Parameters  []int
+	Columns     []string
+}
+
+// ParseAnonymiseRule parses a single rule
+func ParseAnonymiseRule(rule string) (AnonymiseRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 {
+		return AnonymiseRule{}, fmt.Errorf(
+			"rule '%s' must be '<fingerprint> parameters <positions>', '<fingerprint> columns <columns>' or '<fingerprint> none'", rule,
+		)
+	}
+
+	parsed := AnonymiseRule{Fingerprint: fields[0]}
+	values := strings.FieldsFunc(strings.Join(fields[2:], " "), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+
+	switch fields[1] {
+	case "none":
+		if len(values) > 0 {
+			return AnonymiseRule{}, fmt.Errorf("rule '%s' must not list values with none", rule)
+		}
+	case "parameters":
+		for _, value := range values {
+			position, err := strconv.Atoi(value)
+			if err != nil || position < 1 {
+				return AnonymiseRule{}, fmt.Errorf("rule '%s' has invalid parameter position '%s'", rule, value)
+			}
+
+			parsed.Parameters = append(parsed.Parameters, position)
+		}
+	case "columns":
+		for _, value := range values {
+			parsed.Columns = append(parsed.Columns, strings.ToLower(value))
+		}
+	default:
+		return AnonymiseRule{}, fmt.Errorf("rule '%s' must select parameters, columns or none", rule)
+	}
+
+	if fields[1] != "none" && len(values) == 0 {
+		return AnonymiseRule{}, fmt.Errorf("rule '%s' must list at least one %s", rule, strings.TrimSuffix(fields[1], "s"))
+	}
+
+	return parsed, nil
+}
+
+// LoadAnonymiseRules reads rules from a file with one rule per line. Blank lines and
+// lines beginning with # are ignored:
+//
+//	# Only the email of users is sensitive
+//	8b7688523e44f4ec columns email
+func LoadAnonymiseRules(input io.Reader) ([]AnonymiseRule, error) {
+	var rules []AnonymiseRule
+
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule, err := ParseAnonymiseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// Anonymiser replaces sensitive values in bind parameters and query constants with
+// values derived from a keyed hash. The same value always anonymises to the same result
+// under the same key, wherever it appears, so joins and the selectivity of indexes are
+// preserved. Results keep the shape of the original: emails remain emails, UUIDs remain
+// UUIDs, dates remain valid dates and integers keep their number of digits.
+type Anonymiser struct {
+	key   []byte
+	rules map[string][]AnonymiseRule
+}
+
+func NewAnonymiser(key []byte, rules []AnonymiseRule) *Anonymiser {
+	byFingerprint := map[string][]AnonymiseRule{}
+	for _, rule := range rules {
+		byFingerprint[rule.Fingerprint] = append(byFingerprint[rule.Fingerprint], rule)
+	}
+
+	return &Anonymiser{key: key, rules: byFingerprint}
+}
+
+// Anonymise anonymises the values of every item that has a query
+func (a *Anonymiser) Anonymise(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			out <- a.anonymise(item)
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+func (a *Anonymiser) anonymise(item Item) Item {
+	query, ok := itemQuery(item)
+	if !ok {
+		return item
+	}
+
+	selection := a.selection(item)
+
+	// Only anonymise the parameters that are selected, either by position or because
+	// the query gives them for a selected column
+	tokens := fingerprint.Lex(query)
+	parameters := itemParameters(item)
+	anonymised := make([]interface{}, len(parameters))
+	for idx, parameter := range parameters {
+		anonymised[idx] = parameter
+		if value, ok := parameter.(string); ok && selection.parameter(idx+1, tokens) {
+			anonymised[idx] = a.Value(value)
+		}
+	}
+
+	if parameters != nil {
+		item = withParameters(item, anonymised)
+	}
+
+	if rewritten := a.anonymiseQuery(tokens, selection); rewritten != query {
+		item = withQuery(item, rewritten)
+	}
+
+	return item
+}
+
+// anonymiseQuery replaces the selected string and numeric constants of a query
+func (a *Anonymiser) anonymiseQuery(tokens []fingerprint.Token, selection anonymiseSelection) string {
+	var builder strings.Builder
+	for idx, token := range tokens {
+		text := token.Text
+
+		switch {
+		case token.Kind != fingerprint.String && token.Kind != fingerprint.Number:
+		case !selection.constant(idx, tokens) || structural(idx, tokens):
+		case token.Kind == fingerprint.Number:
+			text = a.Value(text)
+		case text[0] == '\'':
+			value := strings.ReplaceAll(strings.TrimSuffix(text[1:], "'"), "''", "'")
+			text = "'" + strings.ReplaceAll(a.Value(value), "'", "''") + "'"
+		case text[0] == 'e' || text[0] == 'E':
+			// Escapes could be broken by anonymising their characters, so we drop them,
+			// leaving the escaped character behind
+			value := strings.ReplaceAll(strings.TrimSuffix(text[2:], "'"), "''", "'")
+			value = strings.NewReplacer(`\\`, `\`, `\`, "").Replace(value)
+			text = "'" + strings.ReplaceAll(a.Value(value), "'", "''") + "'"
+		default:
+			// Bit strings, dollar quoted function bodies and unicode escapes are unlikely
+			// to be customer data, so are left alone
+		}
+
+		builder.WriteString(text)
+	}
+
+	return builder.String()
+}
+
+// structural reports whether a constant shapes the query rather than being data, such as
+// a LIMIT, the precision of a type or an interval.
+func structural(idx int, tokens []fingerprint.Token) bool {
+	// Configuration is never customer data, and must remain valid
+	if first, ok := nextSignificant(-1, tokens); ok {
+		switch strings.ToLower(tokens[first].Text) {
+		case "set", "show", "reset":
+			return true
+		}
+	}
+
+	// Constants of these types must keep their syntax, such as interval '1 day' or
+	// 'users'::regclass
+	if next, ok := nextSignificant(idx, tokens); ok && tokens[next].Text == "::" {
+		if name, ok := nextSignificant(next, tokens); ok && structuralTypes[strings.ToLower(tokens[name].Text)] {
+			return true
+		}
+	}
+
+	previous, ok := previousSignificant(idx, tokens)
+	if !ok {
+		return false
+	}
+
+	switch text := strings.ToLower(tokens[previous].Text); {
+	case structuralTypes[text]:
+		return true
+	case text == "limit" || text == "offset" || text == "fetch" || text == "first" || text == "next":
+		return tokens[idx].Kind == fingerprint.Number
+	case text == "(" || text == ",":
+		// Type modifiers like numeric(10, 2) and varchar(255) follow a type name
+		if open, _ := enclosingParenthesis(previous, tokens); open >= 0 {
+			name, ok := previousSignificant(open, tokens)
+			return ok && typeModifiers[strings.ToLower(tokens[name].Text)]
+		}
+	}
+
+	return false
+}
+
+var structuralTypes = map[string]bool{
+	"interval": true, "regclass": true, "regproc": true, "regprocedure": true, "regtype": true,
+	"regnamespace": true, "regconfig": true,
+}
+
+var typeModifiers = map[string]bool{
+	"numeric": true, "decimal": true, "varchar": true, "char": true, "character": true,
+	"varying": true, "bit": true, "timestamp": true, "timestamptz": true, "time": true,
+	"interval": true, "float": true,
+}
+
+// anonymiseSelection decides which values of a query to anonymise
+type anonymiseSelection struct {
+	all        bool
+	parameters map[int]bool
+	columns    map[string]bool
+}
+
+func (a *Anonymiser) selection(item Item) anonymiseSelection {
+	id, _ := QueryFingerprint(item)
+	rules, ok := a.rules[id]
+	if !ok {
+		return anonymiseSelection{all: true}
+	}
+
+	selection := anonymiseSelection{parameters: map[int]bool{}, columns: map[string]bool{}}
+	for _, rule := range rules {
+		for _, position := range rule.Parameters {
+			selection.parameters[position] = true
+		}
+		for _, column := range rule.Columns {
+			selection.columns[column] = true
+		}
+	}
+
+	return selection
+}
+
+// parameter reports whether to anonymise the parameter at the given position
+func (s anonymiseSelection) parameter(position int, tokens []fingerprint.Token) bool {
+	if s.all || s.parameters[position] {
+		return true
+	}
+
+	if len(s.columns) == 0 {
+		return false
+	}
+
+	placeholder := "$" + strconv.Itoa(position)
+	for idx, token := range tokens {
+		if token.Kind == fingerprint.Parameter && token.Text == placeholder && s.columns[columnOf(idx, tokens)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// constant reports whether to anonymise the constant at the given token index
+func (s anonymiseSelection) constant(idx int, tokens []fingerprint.Token) bool {
+	return s.all || (len(s.columns) > 0 && s.columns[columnOf(idx, tokens)])
+}
+
+// columnOf finds the column that a value is given for, from the comparison it's part of
+// ('email = $1', 'id in (1, 2)') or its position in the VALUES of an INSERT. It returns
+// an empty string if there isn't one.
+func columnOf(idx int, tokens []fingerprint.Token) string {
+	previous, ok := previousSignificant(idx, tokens)
+	if !ok {
+		return ""
+	}
+
+	switch text := strings.ToLower(tokens[previous].Text); {
+	case comparisons[text]:
+		return columnBefore(previous, tokens)
+
+	case text == "(" || text == ",":
+		open, position := enclosingParenthesis(previous, tokens)
+		if open < 0 {
+			return ""
+		}
+
+		keyword, ok := previousSignificant(open, tokens)
+		if !ok {
+			return ""
+		}
+
+		switch strings.ToLower(tokens[keyword].Text) {
+		case "in":
+			if not, ok := previousSignificant(keyword, tokens); ok && strings.ToLower(tokens[not].Text) == "not" {
+				keyword = not
+			}
+
+			return columnBefore(keyword, tokens)
+		case "values", ",":
+			return insertColumn(open, position, tokens)
+		}
+	}
+
+	return ""
+}
+
+var comparisons = map[string]bool{
+	"=": true, "<>": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true,
+	"like": true, "ilike": true,
+}
+
+// columnBefore returns the name of the column ending just before idx, without any table
+// qualification. Names are lowercased, as rules match columns whatever their case.
+func columnBefore(idx int, tokens []fingerprint.Token) string {
+	column, ok := previousSignificant(idx, tokens)
+	if !ok {
+		return ""
+	}
+
+	switch tokens[column].Kind {
+	case fingerprint.Identifier:
+		return strings.ToLower(tokens[column].Text)
+	case fingerprint.QuotedIdentifier:
+		return strings.ToLower(strings.ReplaceAll(strings.Trim(tokens[column].Text, `"`), `""`, `"`))
+	}
+
+	return ""
+}
+
+// enclosingParenthesis finds the parenthesis enclosing the token at idx, along with the
+// position of that token within the comma separated list it opens
+func enclosingParenthesis(idx int, tokens []fingerprint.Token) (int, int) {
+	depth, position := 0, 0
+	for ; idx >= 0; idx-- {
+		switch tokens[idx].Text {
+		case ")", "]":
+			depth++
+		case "[":
+			depth--
+		case "(":
+			if depth == 0 {
+				return idx, position
+			}
+
+			depth--
+		case ",":
+			if depth == 0 {
+				position++
+			}
+		}
+	}
+
+	return -1, 0
+}
+
+// insertColumn returns the column at the given position of the column list of an
+// 'INSERT INTO table (columns) VALUES (...), (...)', where open is the parenthesis of one
+// of the lists of values.
+func insertColumn(open, position int, tokens []fingerprint.Token) string {
+	// Walk back over any previous lists of values to the VALUES keyword
+	idx := open
+	for {
+		previous, ok := previousSignificant(idx, tokens)
+		if !ok {
+			return ""
+		}
+
+		if strings.ToLower(tokens[previous].Text) == "values" {
+			idx = previous
+			break
+		}
+
+		if tokens[previous].Text != "," {
+			return ""
+		}
+
+		if closing, ok := previousSignificant(previous, tokens); !ok || tokens[closing].Text != ")" {
+			return ""
+		} else if idx, _ = matchingParenthesis(closing, tokens); idx < 0 {
+			return ""
+		}
+	}
+
+	closing, ok := previousSignificant(idx, tokens)
+	if !ok || tokens[closing].Text != ")" {
+		return ""
+	}
+
+	start, _ := matchingParenthesis(closing, tokens)
+	if start < 0 {
+		return ""
+	}
+
+	// Collect the columns of the list, which are each a single identifier
+	var columns []string
+	for column := start + 1; column < closing; column++ {
+		switch tokens[column].Kind {
+		case fingerprint.Identifier, fingerprint.QuotedIdentifier:
+			columns = append(columns, columnBefore(column+1, tokens))
+		}
+	}
+
+	if position >= len(columns) {
+		return ""
+	}
+
+	return columns[position]
+}
+
+// matchingParenthesis finds the parenthesis that opens the one closed at idx
+func matchingParenthesis(idx int, tokens []fingerprint.Token) (int, int) {
+	return enclosingParenthesis(idx-1, tokens)
+}
+
+func nextSignificant(idx int, tokens []fingerprint.Token) (int, bool) {
+	for idx++; idx < len(tokens); idx++ {
+		if kind := tokens[idx].Kind; kind != fingerprint.Whitespace && kind != fingerprint.Comment {
+			return idx, true
+		}
+	}
+
+	return 0, false
+}
+
+func previousSignificant(idx int, tokens []fingerprint.Token) (int, bool) {
+	for idx--; idx >= 0; idx-- {
+		if kind := tokens[idx].Kind; kind != fingerprint.Whitespace && kind != fingerprint.Comment {
+			return idx, true
+		}
+	}
+
+	return 0, false
+}
+
+var (
+	anonymiseEmail   = regexp.MustCompile(`^([^@\s]+)@([^@\s]+)\.([A-Za-z]+)$`)
+	anonymiseUUID    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	integerValue     = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+	anonymiseDecimal = regexp.MustCompile(`^(-?[0-9]*\.?[0-9]*)([eE][-+]?[0-9]+)?$`)
+	anonymiseBoolean = regexp.MustCompile(`^(?i)(t|f|true|false|yes|no|on|off)$`)
+	anonymiseDate    = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(\D|$)`)
+)
+
+// Value anonymises a single value, preserving its shape
+func (a *Anonymiser) Value(value string) string {
+	switch {
+	case value == "" || anonymiseBoolean.MatchString(value):
+		return value
+	case anonymiseUUID.MatchString(value):
+		digits := a.stream("uuid", value).hex(32)
+		return fmt.Sprintf("%s-%s-4%s-%c%s-%s", digits[0:8], digits[8:12], digits[13:16],
+			"89ab"[strings.IndexByte("0123456789abcdef", digits[16])%4], digits[17:20], digits[20:32])
+	case anonymiseEmail.MatchString(value):
+		parts := anonymiseEmail.FindStringSubmatch(value)
+		return a.characters(parts[1]) + "@" + a.characters(parts[2]) + "." + parts[3]
+	case integerValue.MatchString(value):
+		return a.integer(value)
+	case anonymiseDecimal.MatchString(value):
+		// Keep the exponent, so the value keeps its magnitude
+		parts := anonymiseDecimal.FindStringSubmatch(value)
+		return a.characters(parts[1]) + parts[2]
+	case anonymiseDate.MatchString(value):
+		if date, ok := a.date(value); ok {
+			return date
+		}
+	}
+
+	return a.characters(value)
+}
+
+// integer anonymises an integer to another with the same number of digits, so the
+// values of a column keep a similar range. Integers that fit in an int4 or int8 continue
+// to fit.
+func (a *Anonymiser) integer(value string) string {
+	sign, digits := "", value
+	if strings.HasPrefix(value, "-") {
+		sign, digits = "-", value[1:]
+	}
+
+	if len(digits) > 19 {
+		return sign + a.characters(digits)
+	}
+
+	var low, high uint64 = 0, 9
+	if len(digits) > 1 {
+		low = pow10(len(digits) - 1)
+		high = low*10 - 1
+	}
+
+	switch {
+	case len(digits) == 10 && high > 2147483647:
+		if original, _ := strconv.ParseUint(digits, 10, 64); original <= 2147483647 {
+			high = 2147483647
+		}
+	case len(digits) == 19:
+		high = 9223372036854775807
+	}
+
+	return sign + strconv.FormatUint(low+a.stream("integer", value).uint64()%(high-low+1), 10)
+}
+
+func pow10(n int) uint64 {
+	result := uint64(1)
+	for ; n > 0; n-- {
+		result *= 10
+	}
+
+	return result
+}
+
+// date shifts the date of a date or timestamp by up to a year in either direction. The
+// time of day is kept, as is whatever follows the date.
+func (a *Anonymiser) date(value string) (string, bool) {
+	date, err := time.Parse("2006-01-02", value[:10])
+	if err != nil {
+		return "", false
+	}
+
+	days := int(a.stream("date", value).uint64()%731) - 365
+	return date.AddDate(0, 0, days).Format("2006-01-02") + value[10:], true
+}
+
+// characters replaces each letter with a letter of the same case and each digit with a
+// digit, leaving punctuation and whitespace in place. The character following a % is
+// kept too, so that format strings such as 'hello %s' remain valid.
+func (a *Anonymiser) characters(value string) string {
+	stream := a.stream("characters", value)
+
+	var builder strings.Builder
+	for idx, r := range value {
+		switch {
+		case idx > 0 && value[idx-1] == '%':
+			builder.WriteRune(r)
+		case r >= 'a' && r <= 'z':
+			builder.WriteByte('a' + stream.byte()%26)
+		case r >= 'A' && r <= 'Z':
+			builder.WriteByte('A' + stream.byte()%26)
+		case r >= '0' && r <= '9':
+			builder.WriteByte('0' + stream.byte()%10)
+		case r > 127:
+			// Letters outside of ASCII are replaced by ASCII letters of the same count
+			builder.WriteByte('a' + stream.byte()%26)
+		default:
+			builder.WriteRune(r)
+		}
+	}
+
+	return builder.String()
+}
+
+// stream returns a deterministic stream of bytes keyed on our key and the value. The
+// kind of value is mixed in so that, for example, an integer and the digits of a string
+// don't anonymise in lockstep.
+func (a *Anonymiser) stream(kind, value string) *anonymiseStream {
+	return &anonymiseStream{key: a.key, seed: kind + "\x00" + value}
+}
+
+type anonymiseStream struct {
+	key     []byte
+	seed    string
+	counter uint64
+	buffer  []byte
+}
+
+func (s *anonymiseStream) byte() byte {
+	if len(s.buffer) == 0 {
+		mac := hmac.New(sha256.New, s.key)
+		binary.Write(mac, binary.BigEndian, s.counter)
+		mac.Write([]byte(s.seed))
+
+		s.buffer = mac.Sum(nil)
+		s.counter++
+	}
+
+	b := s.buffer[0]
+	s.buffer = s.buffer[1:]
+
+	return b
+}
+
+func (s *anonymiseStream) uint64() uint64 {
+	var result uint64
+	for idx := 0; idx < 8; idx++ {
+		result = result<<8 | uint64(s.byte())
+	}
+
+	return result
+}
+
+func (s *anonymiseStream) hex(n int) string {
+	var builder strings.Builder
+	for idx := 0; idx < n; idx++ {
+		builder.WriteByte("0123456789abcdef"[s.byte()%16])
+	}
+
+	return builder.String()
+}
+
+// itemParameters returns the bind parameters of executes
+func itemParameters(item Item) []interface{} {
+	switch item := item.(type) {
+	case BoundExecute:
+		return item.Parameters
+	case *BoundExecute:
+		return item.Parameters
+	case ExecutePrepared:
+		return item.Parameters
+	case *ExecutePrepared:
+		return item.Parameters
+	default:
+		return nil
+	}
+}
+
+// withParameters returns a copy of the execute with its parameters replaced
+func withParameters(item Item, parameters []interface{}) Item {
+	switch item := item.(type) {
+	case BoundExecute:
+		item.Parameters = parameters
+		return item
+	case *BoundExecute:
+		copied := *item
+		copied.Parameters = parameters
+		return &copied
+	case ExecutePrepared:
+		item.Parameters = parameters
+		return item
+	case *ExecutePrepared:
+		copied := *item
+		copied.Parameters = parameters
+		return &copied
+	default:
+		return item
+	}
+}
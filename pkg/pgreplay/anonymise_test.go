@@ -0,0 +1,152 @@
+package pgreplay
+
+import (
+	"strings"
+
+	"github.com/gocardless/pgreplay-go/pkg/fingerprint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Anonymiser", func() {
+	var (
+		details    = Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+		anonymiser = NewAnonymiser([]byte("secret"), nil)
+		anonymise  = func(anonymiser *Anonymiser, items ...Item) []Item {
+			in := make(chan Item, len(items))
+			for _, item := range items {
+				in <- item
+			}
+			close(in)
+
+			var out []Item
+			for item := range anonymiser.Anonymise(in) {
+				out = append(out, item)
+			}
+
+			return out
+		}
+	)
+
+	DescribeTable("Preserves the shape of values",
+		func(value string, shape string) {
+			anonymised := anonymiser.Value(value)
+
+			Expect(anonymised).To(MatchRegexp(shape))
+			Expect(anonymiser.Value(value)).To(Equal(anonymised), "anonymises deterministically")
+		},
+		Entry("email", "alice@example.com", `^[a-z]{5}@[a-z]{7}\.com$`),
+		Entry("uuid", "1b4e28ba-2fa1-11d2-883f-0016d3cca427", `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		Entry("integer", "48213", `^[1-9][0-9]{4}$`),
+		Entry("negative integer", "-7", `^-[0-9]$`),
+		Entry("int4", "2000000000", `^[1-2][0-9]{9}$`),
+		Entry("decimal", "12.50", `^[0-9]{2}\.[0-9]{2}$`),
+		Entry("exponent", "1.5e10", `^[0-9]\.[0-9]e10$`),
+		Entry("date", "1989-04-12", `^19[89][0-9]-[01][0-9]-[0-3][0-9]$`),
+		Entry("timestamp", "2019-02-25 15:08:27.222+00", `^20(18|19|20)-[01][0-9]-[0-3][0-9] 15:08:27\.222\+00$`),
+		Entry("name", "Alice Smith", `^[A-Z][a-z]{4} [A-Z][a-z]{4}$`),
+		Entry("format string", "hello %s", `^[a-z]{5} %s$`),
+		Entry("boolean", "true", `^true$`),
+		Entry("empty", "", `^$`),
+	)
+
+	It("Keeps integers that fit in an int4 within range", func() {
+		for _, value := range []string{"2147483647", "1000000000", "1999999999"} {
+			Expect(anonymiser.Value(value) <= "2147483647").To(BeTrue())
+		}
+	})
+
+	It("Anonymises differently with a different key", func() {
+		Expect(NewAnonymiser([]byte("other"), nil).Value("alice")).NotTo(Equal(anonymiser.Value("alice")))
+	})
+
+	It("Anonymises parameters and constants consistently", func() {
+		out := anonymise(anonymiser,
+			Connect{details},
+			Statement{details, "select * from users where email = 'alice@example.com' and id = 42 limit 10", 0},
+			Execute{details, "select * from users where email = $1 and id = $2", 0}.Bind([]interface{}{"alice@example.com", "42"}),
+		)
+
+		email, id := anonymiser.Value("alice@example.com"), anonymiser.Value("42")
+
+		Expect(out).To(HaveLen(3))
+		Expect(out[0]).To(Equal(Connect{details}))
+		Expect(out[1].(Statement).Query).To(Equal(
+			"select * from users where email = '" + email + "' and id = " + id + " limit 10",
+		))
+		Expect(out[2].(BoundExecute).Parameters).To(Equal([]interface{}{email, id}))
+	})
+
+	DescribeTable("Leaves structural constants alone",
+		func(query string) {
+			out := anonymise(anonymiser, Statement{details, query, 0})
+			Expect(out[0].(Statement).Query).To(Equal(query))
+		},
+		Entry("configuration", "SET statement_timeout = '1s'"),
+		Entry("type modifiers", "select cast(amount as numeric(10, 2)) from payments"),
+		Entry("intervals", "select now() - interval '1 day'"),
+		Entry("casts to regclass", "select 'users'::regclass"),
+		Entry("dollar quoted bodies", "do $$ begin perform 1; end $$"),
+	)
+
+	It("Drops escapes from escape strings", func() {
+		out := anonymise(anonymiser, Statement{details, `select E'it\'s'`, 0})
+		Expect(out[0].(Statement).Query).To(Equal("select '" + strings.ReplaceAll(anonymiser.Value("it's"), "'", "''") + "'"))
+	})
+
+	Describe("Rules", func() {
+		var (
+			query = "insert into users (name, email, tier) values ($1, $2, 'gold'), ('bob', 'bob@example.com', 'silver')"
+			id    = fingerprint.Compute(query).ID
+			item  = Execute{details, query, 0}.Bind([]interface{}{"alice", "alice@example.com"})
+			apply = func(rules string) BoundExecute {
+				parsed, err := LoadAnonymiseRules(strings.NewReader(rules))
+				Expect(err).NotTo(HaveOccurred())
+
+				return anonymise(NewAnonymiser([]byte("secret"), parsed), item)[0].(BoundExecute)
+			}
+		)
+
+		It("Selects parameters by position", func() {
+			out := apply(id + " parameters 2")
+
+			Expect(out.Parameters).To(Equal([]interface{}{"alice", anonymiser.Value("alice@example.com")}))
+			Expect(out.Query).To(Equal(query))
+		})
+
+		It("Selects parameters and constants by column", func() {
+			out := apply("# Names and tiers aren't sensitive\n" + id + " columns email")
+
+			Expect(out.Parameters).To(Equal([]interface{}{"alice", anonymiser.Value("alice@example.com")}))
+			Expect(out.Query).To(Equal(strings.Replace(query, "bob@example.com", anonymiser.Value("bob@example.com"), 1)))
+		})
+
+		It("Selects columns of comparisons", func() {
+			query := `select * from users u where u."Email" in ('a@example.com', $1) and name = 'bob'`
+			rules, err := LoadAnonymiseRules(strings.NewReader(fingerprint.Compute(query).ID + " columns Email"))
+			Expect(err).NotTo(HaveOccurred())
+
+			out := anonymise(NewAnonymiser([]byte("secret"), rules), Execute{details, query, 0}.Bind([]interface{}{"b@example.com"}))[0].(BoundExecute)
+
+			Expect(out.Parameters).To(Equal([]interface{}{anonymiser.Value("b@example.com")}))
+			Expect(out.Query).To(Equal(strings.Replace(query, "a@example.com", anonymiser.Value("a@example.com"), 1)))
+		})
+
+		It("Leaves queries untouched with none", func() {
+			Expect(apply(id + " none")).To(Equal(item))
+		})
+
+		DescribeTable("Rejects invalid rules",
+			func(rules, message string) {
+				_, err := LoadAnonymiseRules(strings.NewReader(rules))
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("missing selection", "abc", "line 1: rule 'abc' must be"),
+			Entry("unknown selection", "abc rows 1", "must select parameters, columns or none"),
+			Entry("invalid position", "abc parameters 0", "invalid parameter position '0'"),
+			Entry("no columns", "abc columns", "must list at least one column"),
+		)
+	})
+})
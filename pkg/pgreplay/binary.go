@@ -0,0 +1,701 @@
+package pgreplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// The binary format is a compact alternative to our JSON format for very large logs. A
+// file begins with a header of BinaryMagic and the format version, followed by records
+// that are each a uvarint length and a payload whose first byte is the kind of record.
+//
+// Items are grouped into blocks of BinaryBlockSize. Each block begins with a block record
+// holding the timestamp the block's item timestamps are relative to, and has its own
+// string table: the first use of a session ID, user, database, query or name within the
+// block writes a string record, and items refer to strings by their position in the
+// table. As blocks depend on nothing before them, readers can begin at any block.
+//
+// The file ends with an index record listing the first timestamp and offset of every
+// block, and a trailer of the index's offset and BinaryMagic. This lets readers with a
+// start time seek straight to the block containing it.
+//
+// Version 2 added the parameter types of prepares and executes. We still read version 1.
+const (
+	BinaryMagic   = "PGRB"
+	BinaryVersion = 2
+)
+
+// BinaryBlockSize is the number of items in each block of the binary format
+var BinaryBlockSize = 4096
+
+const (
+	binaryRecordBlock byte = iota + 1
+	binaryRecordString
+	binaryRecordItem
+	binaryRecordIndex
+)
+
+// binaryItemTypes assigns each item type the byte that identifies it in the binary format
+var binaryItemTypes = []string{
+	ConnectLabel, StatementLabel, BoundExecuteLabel, PrepareLabel, ExecutePreparedLabel,
+	DeallocateLabel, DiscardAllLabel, DisconnectLabel,
+}
+
+// Bits of the mask recording which optional details an item has
+const (
+	binaryApplicationName uint64 = 1 << iota
+	binaryClientAddr
+	binaryBackendPID
+	binaryVirtualXID
+	binaryTransactionID
+	binaryQueryID
+	binaryFingerprint
+)
+
+// Tags of bind parameters, which may be NULL, text, or any other JSON value
+const (
+	binaryParameterNull byte = iota
+	binaryParameterString
+	binaryParameterJSON
+)
+
+const binaryTrailerSize = 8 + len(BinaryMagic)
+
+// binaryMaxRecordSize protects us from allocating absurd buffers for corrupt records
+const binaryMaxRecordSize = 1 << 30
+
+type binaryIndexEntry struct {
+	timestamp time.Time
+	offset    int64
+}
+
+// BinaryWriter writes items in the binary format. Close must be called to write the
+// index, without which the file can still be read but not seeked.
+type BinaryWriter struct {
+	output  *bufio.Writer
+	offset  int64
+	items   int
+	strings map[string]uint64
+	last    time.Time
+	index   []binaryIndexEntry
+	payload []byte
+	err     error
+}
+
+// NewBinaryWriter writes the header of the binary format to the output
+func NewBinaryWriter(output io.Writer) (*BinaryWriter, error) {
+	w := &BinaryWriter{output: bufio.NewWriter(output)}
+
+	if _, err := w.output.WriteString(BinaryMagic); err != nil {
+		return nil, err
+	}
+
+	if err := w.output.WriteByte(BinaryVersion); err != nil {
+		return nil, err
+	}
+
+	w.offset = int64(len(BinaryMagic) + 1)
+
+	return w, nil
+}
+
+// Write appends an item, which must be no earlier than those written before it
+func (w *BinaryWriter) Write(item Item) error {
+	label := ItemType(item)
+	if label == "" {
+		return nil // it's not important for us to serialize this
+	}
+
+	details := item.GetDetails()
+
+	if w.items%BinaryBlockSize == 0 {
+		w.index = append(w.index, binaryIndexEntry{details.Timestamp, w.offset})
+		w.strings = map[string]uint64{}
+		w.last = details.Timestamp
+		w.record(binaryRecordBlock, binary.AppendVarint(nil, details.Timestamp.UnixNano()))
+	}
+
+	w.items++
+
+	// Interning writes the string records that the item refers to, so we must do so
+	// before writing the item itself
+	payload := w.payload[:0]
+	payload = append(payload, byte(binaryItemType(label)))
+	payload = binary.AppendVarint(payload, int64(details.Timestamp.Sub(w.last)))
+	payload = binary.AppendUvarint(payload, w.intern(string(details.SessionID)))
+	payload = binary.AppendUvarint(payload, w.intern(details.User))
+	payload = binary.AppendUvarint(payload, w.intern(details.Database))
+	payload = w.appendOptionalDetails(payload, details)
+
+	switch item := item.(type) {
+	case Statement:
+		payload = w.appendStatement(payload, item)
+	case *Statement:
+		payload = w.appendStatement(payload, *item)
+	case BoundExecute:
+		payload = w.appendBoundExecute(payload, item)
+	case *BoundExecute:
+		payload = w.appendBoundExecute(payload, *item)
+	case ExecutePrepared:
+		payload = w.appendBoundExecute(payload, item.BoundExecute)
+		payload = binary.AppendUvarint(payload, w.intern(item.Name))
+	case *ExecutePrepared:
+		payload = w.appendBoundExecute(payload, item.BoundExecute)
+		payload = binary.AppendUvarint(payload, w.intern(item.Name))
+	case Prepare:
+		payload = w.appendPrepare(payload, item)
+	case *Prepare:
+		payload = w.appendPrepare(payload, *item)
+	case Deallocate:
+		payload = binary.AppendUvarint(payload, w.intern(item.Name))
+	case *Deallocate:
+		payload = binary.AppendUvarint(payload, w.intern(item.Name))
+	}
+
+	w.payload = payload
+	w.last = details.Timestamp
+	w.record(binaryRecordItem, payload)
+
+	return w.err
+}
+
+func (w *BinaryWriter) appendOptionalDetails(payload []byte, details Details) []byte {
+	var mask uint64
+	for bit, present := range []bool{
+		details.ApplicationName != "",
+		details.ClientAddr != "",
+		details.BackendPID != 0,
+		details.VirtualXID != "",
+		details.TransactionID != 0,
+		details.QueryID != 0,
+		details.Fingerprint != "",
+	} {
+		if present {
+			mask |= 1 << bit // in the order of the mask bits
+		}
+	}
+
+	payload = binary.AppendUvarint(payload, mask)
+
+	if mask&binaryApplicationName != 0 {
+		payload = binary.AppendUvarint(payload, w.intern(details.ApplicationName))
+	}
+	if mask&binaryClientAddr != 0 {
+		payload = binary.AppendUvarint(payload, w.intern(details.ClientAddr))
+	}
+	if mask&binaryBackendPID != 0 {
+		payload = binary.AppendVarint(payload, int64(details.BackendPID))
+	}
+	if mask&binaryVirtualXID != 0 {
+		payload = binary.AppendUvarint(payload, w.intern(details.VirtualXID))
+	}
+	if mask&binaryTransactionID != 0 {
+		payload = binary.AppendUvarint(payload, details.TransactionID)
+	}
+	if mask&binaryQueryID != 0 {
+		payload = binary.AppendVarint(payload, details.QueryID)
+	}
+	if mask&binaryFingerprint != 0 {
+		payload = binary.AppendUvarint(payload, w.intern(details.Fingerprint))
+	}
+
+	return payload
+}
+
+func (w *BinaryWriter) appendStatement(payload []byte, statement Statement) []byte {
+	payload = binary.AppendUvarint(payload, w.intern(statement.Query))
+	return binary.AppendVarint(payload, int64(statement.OriginalDuration))
+}
+
+func (w *BinaryWriter) appendPrepare(payload []byte, prepare Prepare) []byte {
+	payload = binary.AppendUvarint(payload, w.intern(prepare.Name))
+	payload = binary.AppendUvarint(payload, w.intern(prepare.Query))
+	return appendParameterTypes(payload, prepare.ParameterTypes)
+}
+
+func (w *BinaryWriter) appendBoundExecute(payload []byte, execute BoundExecute) []byte {
+	payload = binary.AppendUvarint(payload, w.intern(execute.Query))
+	payload = binary.AppendVarint(payload, int64(execute.OriginalDuration))
+	payload = binary.AppendUvarint(payload, uint64(len(execute.Parameters)))
+
+	for _, parameter := range execute.Parameters {
+		switch parameter := parameter.(type) {
+		case nil:
+			payload = append(payload, binaryParameterNull)
+		case string:
+			payload = append(payload, binaryParameterString)
+			payload = binary.AppendUvarint(payload, uint64(len(parameter)))
+			payload = append(payload, parameter...)
+		default:
+			encoded, err := json.Marshal(parameter)
+			if err != nil && w.err == nil {
+				w.err = err
+			}
+
+			payload = append(payload, binaryParameterJSON)
+			payload = binary.AppendUvarint(payload, uint64(len(encoded)))
+			payload = append(payload, encoded...)
+		}
+	}
+
+	return appendParameterTypes(payload, execute.ParameterTypes)
+}
+
+func appendParameterTypes(payload []byte, types []uint32) []byte {
+	payload = binary.AppendUvarint(payload, uint64(len(types)))
+	for _, oid := range types {
+		payload = binary.AppendUvarint(payload, uint64(oid))
+	}
+
+	return payload
+}
+
+// Close writes the index and trailer, and flushes our output. It doesn't close the
+// underlying writer.
+func (w *BinaryWriter) Close() error {
+	indexOffset := w.offset
+
+	payload := binary.AppendUvarint(nil, uint64(len(w.index)))
+	for _, entry := range w.index {
+		payload = binary.AppendVarint(payload, entry.timestamp.UnixNano())
+		payload = binary.AppendUvarint(payload, uint64(entry.offset))
+	}
+
+	w.record(binaryRecordIndex, payload)
+	if w.err != nil {
+		return w.err
+	}
+
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(indexOffset))
+	if _, err := w.output.Write(append(trailer, BinaryMagic...)); err != nil {
+		return err
+	}
+
+	return w.output.Flush()
+}
+
+// intern returns the position of the string in the block's table, defining it first if
+// this is its first use within the block
+func (w *BinaryWriter) intern(value string) uint64 {
+	if ref, ok := w.strings[value]; ok {
+		return ref
+	}
+
+	ref := uint64(len(w.strings))
+	w.strings[value] = ref
+	w.record(binaryRecordString, []byte(value))
+
+	return ref
+}
+
+// record writes a record of the given kind. Errors are remembered and returned by the
+// next call to Write or Close, as the buffered output reports them late anyway.
+func (w *BinaryWriter) record(kind byte, payload []byte) {
+	if w.err != nil {
+		return
+	}
+
+	header := binary.AppendUvarint(nil, uint64(len(payload)+1))
+	header = append(header, kind)
+
+	if _, w.err = w.output.Write(header); w.err != nil {
+		return
+	}
+
+	if _, w.err = w.output.Write(payload); w.err != nil {
+		return
+	}
+
+	w.offset += int64(len(header) + len(payload))
+}
+
+func binaryItemType(label string) int {
+	for idx, candidate := range binaryItemTypes {
+		if candidate == label {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// ParseBinary reads every item of a log in the binary format
+func ParseBinary(input io.Reader) (items chan Item, errs chan error, done chan error) {
+	return NewBinaryParser(nil)(input)
+}
+
+// NewBinaryParser creates a parser for the binary format. When given a start time and an
+// input that can seek, such as an uncompressed file, the parser uses the index to skip
+// every block that ends before the start. Items before the start may still be returned
+// from the block containing it.
+func NewBinaryParser(start *time.Time) ParserFunc {
+	return func(input io.Reader) (chan Item, chan error, chan error) {
+		items, errs, done := make(chan Item, ItemBufferSize), make(chan error), make(chan error, 1)
+
+		go func() {
+			err := parseBinary(input, start, items)
+
+			close(items)
+			close(errs)
+
+			done <- err
+			close(done)
+		}()
+
+		return items, errs, done
+	}
+}
+
+func parseBinary(input io.Reader, start *time.Time, items chan Item) error {
+	header := make([]byte, len(BinaryMagic)+1)
+	if _, err := io.ReadFull(input, header); err != nil {
+		return fmt.Errorf("failed to read binary header: %w", err)
+	}
+
+	if string(header[:len(BinaryMagic)]) != BinaryMagic {
+		return fmt.Errorf("input is not in the pgreplay binary format")
+	}
+
+	version := header[len(BinaryMagic)]
+	if version < 1 || version > BinaryVersion {
+		return fmt.Errorf("unsupported binary format version %d, expected at most %d", version, BinaryVersion)
+	}
+
+	if seeker, ok := input.(io.ReadSeeker); ok && start != nil {
+		if err := seekBinary(seeker, *start); err != nil {
+			return err
+		}
+	}
+
+	decoder := binaryDecoder{version: version}
+	reader := bufio.NewReader(input)
+
+	for {
+		record, err := readBinaryRecord(reader, decoder.buffer)
+		if err == io.EOF {
+			return fmt.Errorf("binary log ended without an index, and may be truncated")
+		}
+		if err != nil {
+			return err
+		}
+
+		decoder.buffer = record
+		kind, payload := record[0], record[1:]
+
+		switch kind {
+		case binaryRecordBlock:
+			base, n := binary.Varint(payload)
+			if n <= 0 {
+				return fmt.Errorf("invalid block record")
+			}
+
+			decoder.last = time.Unix(0, base).UTC()
+			decoder.strings = decoder.strings[:0]
+		case binaryRecordString:
+			decoder.strings = append(decoder.strings, string(payload))
+		case binaryRecordItem:
+			item, err := decoder.item(payload)
+			if err != nil {
+				return err
+			}
+
+			items <- item
+		case binaryRecordIndex:
+			return nil
+		default:
+			return fmt.Errorf("unknown binary record kind %d", kind)
+		}
+	}
+}
+
+// seekBinary moves the input to the start of the last block that begins no later than
+// start, leaving the input at the beginning if there isn't one.
+func seekBinary(input io.ReadSeeker, start time.Time) error {
+	index, err := readBinaryIndex(input)
+	if err != nil {
+		return err
+	}
+
+	// Find the first block that begins after our start, so the block before it is the one
+	// that contains it
+	next := sort.Search(len(index), func(idx int) bool {
+		return index[idx].timestamp.After(start)
+	})
+
+	offset := int64(len(BinaryMagic) + 1)
+	if next > 0 {
+		offset = index[next-1].offset
+	}
+
+	_, err = input.Seek(offset, io.SeekStart)
+	return err
+}
+
+func readBinaryIndex(input io.ReadSeeker) ([]binaryIndexEntry, error) {
+	if _, err := input.Seek(-int64(binaryTrailerSize), io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, binaryTrailerSize)
+	if _, err := io.ReadFull(input, trailer); err != nil {
+		return nil, err
+	}
+
+	if string(trailer[8:]) != BinaryMagic {
+		return nil, fmt.Errorf("binary log has no index, and may be truncated")
+	}
+
+	if _, err := input.Seek(int64(binary.BigEndian.Uint64(trailer)), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	record, err := readBinaryRecord(bufio.NewReader(input), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, payload := record[0], record[1:]
+	if kind != binaryRecordIndex {
+		return nil, fmt.Errorf("binary log trailer does not point to an index")
+	}
+
+	fields := binaryFields{payload: payload}
+	index := make([]binaryIndexEntry, fields.uvarint())
+	for idx := range index {
+		index[idx] = binaryIndexEntry{time.Unix(0, fields.varint()), int64(fields.uvarint())}
+	}
+
+	return index, fields.err
+}
+
+// readBinaryRecord reads the next record, whose first byte is its kind, reusing the
+// buffer where it's large enough
+func readBinaryRecord(reader *bufio.Reader, buffer []byte) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if length == 0 || length > binaryMaxRecordSize {
+		return nil, fmt.Errorf("invalid binary record of %d bytes", length)
+	}
+
+	if uint64(cap(buffer)) < length {
+		buffer = make([]byte, length)
+	}
+
+	buffer = buffer[:length]
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return buffer, nil
+}
+
+type binaryDecoder struct {
+	version byte
+	strings []string
+	last    time.Time
+	buffer  []byte
+}
+
+func (d *binaryDecoder) item(payload []byte) (Item, error) {
+	fields := binaryFields{payload: payload, strings: d.strings, version: d.version}
+
+	kind := fields.byte()
+	if int(kind) >= len(binaryItemTypes) {
+		return nil, fmt.Errorf("unknown binary item type %d", kind)
+	}
+
+	details := Details{Timestamp: d.last.Add(time.Duration(fields.varint()))}
+	details.SessionID = SessionID(fields.string())
+	details.User = fields.string()
+	details.Database = fields.string()
+
+	mask := fields.uvarint()
+	if mask&binaryApplicationName != 0 {
+		details.ApplicationName = fields.string()
+	}
+	if mask&binaryClientAddr != 0 {
+		details.ClientAddr = fields.string()
+	}
+	if mask&binaryBackendPID != 0 {
+		details.BackendPID = int(fields.varint())
+	}
+	if mask&binaryVirtualXID != 0 {
+		details.VirtualXID = fields.string()
+	}
+	if mask&binaryTransactionID != 0 {
+		details.TransactionID = fields.uvarint()
+	}
+	if mask&binaryQueryID != 0 {
+		details.QueryID = fields.varint()
+	}
+	if mask&binaryFingerprint != 0 {
+		details.Fingerprint = fields.string()
+	}
+
+	d.last = details.Timestamp
+
+	var item Item
+	switch binaryItemTypes[kind] {
+	case ConnectLabel:
+		item = &Connect{details}
+	case StatementLabel:
+		item = &Statement{details, fields.string(), time.Duration(fields.varint())}
+	case BoundExecuteLabel:
+		execute := Execute{details, fields.string(), time.Duration(fields.varint())}
+		parameters := fields.parameters()
+		item = &BoundExecute{execute, parameters, fields.parameterTypes()}
+	case ExecutePreparedLabel:
+		execute := Execute{details, fields.string(), time.Duration(fields.varint())}
+		parameters := fields.parameters()
+		item = &ExecutePrepared{BoundExecute{execute, parameters, fields.parameterTypes()}, fields.string()}
+	case PrepareLabel:
+		name, query := fields.string(), fields.string()
+		item = &Prepare{details, name, query, fields.parameterTypes()}
+	case DeallocateLabel:
+		item = &Deallocate{details, fields.string()}
+	case DiscardAllLabel:
+		item = &DiscardAll{details}
+	case DisconnectLabel:
+		item = &Disconnect{details}
+	}
+
+	return item, fields.err
+}
+
+// binaryFields decodes the fields of a record in order, remembering the first error so
+// that it can be checked once at the end
+type binaryFields struct {
+	payload []byte
+	strings []string
+	version byte
+	err     error
+}
+
+func (f *binaryFields) fail(field string) {
+	if f.err == nil {
+		f.err = fmt.Errorf("invalid binary record: malformed %s", field)
+	}
+
+	f.payload = nil
+}
+
+func (f *binaryFields) byte() byte {
+	if len(f.payload) == 0 {
+		f.fail("byte")
+		return 0
+	}
+
+	b := f.payload[0]
+	f.payload = f.payload[1:]
+
+	return b
+}
+
+func (f *binaryFields) uvarint() uint64 {
+	value, n := binary.Uvarint(f.payload)
+	if n <= 0 {
+		f.fail("uvarint")
+		return 0
+	}
+
+	f.payload = f.payload[n:]
+
+	return value
+}
+
+func (f *binaryFields) varint() int64 {
+	value, n := binary.Varint(f.payload)
+	if n <= 0 {
+		f.fail("varint")
+		return 0
+	}
+
+	f.payload = f.payload[n:]
+
+	return value
+}
+
+// string resolves a reference to the string table
+func (f *binaryFields) string() string {
+	ref := f.uvarint()
+	if ref >= uint64(len(f.strings)) {
+		f.fail("string reference")
+		return ""
+	}
+
+	return f.strings[ref]
+}
+
+func (f *binaryFields) bytes() []byte {
+	length := f.uvarint()
+	if length > uint64(len(f.payload)) {
+		f.fail("bytes")
+		return nil
+	}
+
+	value := f.payload[:length]
+	f.payload = f.payload[length:]
+
+	return value
+}
+
+func (f *binaryFields) parameters() []interface{} {
+	count := f.uvarint()
+	if count > uint64(len(f.payload)) {
+		f.fail("parameters")
+		return nil
+	}
+
+	parameters := make([]interface{}, count)
+	for idx := range parameters {
+		switch f.byte() {
+		case binaryParameterNull:
+		case binaryParameterString:
+			parameters[idx] = string(f.bytes())
+		case binaryParameterJSON:
+			if err := json.Unmarshal(f.bytes(), &parameters[idx]); err != nil {
+				f.fail("parameter")
+			}
+		default:
+			f.fail("parameter")
+		}
+	}
+
+	return parameters
+}
+
+// parameterTypes decodes the types of parameters, which version 1 didn't record
+func (f *binaryFields) parameterTypes() []uint32 {
+	if f.version < 2 {
+		return nil
+	}
+
+	count := f.uvarint()
+	if count == 0 {
+		return nil
+	}
+
+	if count > uint64(len(f.payload)) {
+		f.fail("parameter types")
+		return nil
+	}
+
+	types := make([]uint32, count)
+	for idx := range types {
+		types[idx] = uint32(f.uvarint())
+	}
+
+	return types
+}
@@ -0,0 +1,172 @@
+package pgreplay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Binary format", func() {
+	var (
+		details = Details{
+			Timestamp:       time20190225,
+			SessionID:       "5c7404eb.d6bd",
+			User:            "alice",
+			Database:        "pgreplay_test",
+			ApplicationName: "psql",
+			ClientAddr:      "10.0.0.1",
+			BackendPID:      54973,
+			VirtualXID:      "3/17",
+			TransactionID:   1234,
+			QueryID:         -42,
+			Fingerprint:     "5e9fa4f9a9b8ad5c",
+		}
+		at = func(offset time.Duration) Details {
+			return Details{
+				Timestamp: time20190225.Add(offset),
+				SessionID: "5c7404eb.d6bd",
+				User:      "alice",
+				Database:  "pgreplay_test",
+			}
+		}
+
+		write = func(items ...Item) []byte {
+			var buffer bytes.Buffer
+
+			writer, err := NewBinaryWriter(&buffer)
+			Expect(err).NotTo(HaveOccurred())
+			for _, item := range items {
+				Expect(writer.Write(item)).To(Succeed())
+			}
+			Expect(writer.Close()).To(Succeed())
+
+			return buffer.Bytes()
+		}
+		read = func(parser ParserFunc, input io.Reader) ([]Item, error) {
+			items, _, done := parser(input)
+
+			var result []Item
+			for item := range items {
+				result = append(result, item)
+			}
+
+			return result, <-done
+		}
+		// Timestamps come back in UTC, so compare items by their JSON
+		expectSameItems = func(actual, expected []Item) {
+			Expect(actual).To(HaveLen(len(expected)))
+			for idx, item := range actual {
+				expectedJSON, err := ItemMarshalJSON(expected[idx])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ItemMarshalJSON(item)).To(MatchJSON(expectedJSON))
+			}
+		}
+	)
+
+	AfterEach(func() {
+		BinaryBlockSize = 4096
+	})
+
+	It("Round-trips every item type", func() {
+		items := []Item{
+			&Connect{details},
+			&Statement{details, "select now()", 1500 * time.Microsecond},
+			&BoundExecute{Execute{at(time.Second), "select $1, $2, $3", 0}, []interface{}{"1", nil, "hello"}, []uint32{23, 0, 25}},
+			&Prepare{at(2 * time.Second), "stmt", "select $1", []uint32{3802}},
+			&ExecutePrepared{BoundExecute{Execute{at(3 * time.Second), "select $1", time.Millisecond}, []interface{}{"2"}, nil}, "stmt"},
+			&Deallocate{at(3 * time.Second), "stmt"},
+			&DiscardAll{at(4 * time.Second)},
+			&Disconnect{at(5 * time.Second)},
+		}
+
+		parsed, err := read(ParseBinary, bytes.NewReader(write(items...)))
+		Expect(err).NotTo(HaveOccurred())
+		expectSameItems(parsed, items)
+	})
+
+	It("Reads across blocks with their own string tables", func() {
+		BinaryBlockSize = 3
+
+		var items []Item
+		for idx := 0; idx < 10; idx++ {
+			details := at(time.Duration(idx) * time.Second)
+			details.SessionID = SessionID(fmt.Sprintf("session-%d", idx%4))
+			items = append(items, &Statement{details, fmt.Sprintf("select %d", idx%2), 0})
+		}
+
+		parsed, err := read(ParseBinary, bytes.NewReader(write(items...)))
+		Expect(err).NotTo(HaveOccurred())
+		expectSameItems(parsed, items)
+	})
+
+	Describe("Seeking to a start time", func() {
+		var input []byte
+
+		BeforeEach(func() {
+			BinaryBlockSize = 4
+
+			var items []Item
+			for idx := 0; idx < 20; idx++ {
+				items = append(items, &Statement{at(time.Duration(idx) * time.Second), "select 1", 0})
+			}
+
+			input = write(items...)
+		})
+
+		It("Skips the blocks before the start", func() {
+			start := time20190225.Add(9 * time.Second)
+
+			parsed, err := read(NewBinaryParser(&start), bytes.NewReader(input))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(HaveLen(12)) // from the block beginning at 8s
+			Expect(parsed[0].GetTimestamp()).To(BeTemporally("==", time20190225.Add(8*time.Second)))
+		})
+
+		It("Reads everything when starting before the log", func() {
+			start := time20190225.Add(-time.Hour)
+
+			parsed, err := read(NewBinaryParser(&start), bytes.NewReader(input))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(HaveLen(20))
+		})
+
+		It("Reads from the beginning when the input can't seek", func() {
+			start := time20190225.Add(9 * time.Second)
+
+			parsed, err := read(NewBinaryParser(&start), bytes.NewBuffer(input))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(HaveLen(20))
+		})
+	})
+
+	It("Rejects input in another format", func() {
+		_, err := read(ParseBinary, bytes.NewReader([]byte(`{"type":"Connect"}`)))
+		Expect(err).To(MatchError(ContainSubstring("not in the pgreplay binary format")))
+	})
+
+	It("Reads the first version of the format", func() {
+		input := write(&Connect{details}, &Statement{details, "select 1", 0})
+		input[len(BinaryMagic)] = 1 // neither item differs between the versions
+
+		parsed, err := read(ParseBinary, bytes.NewReader(input))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed).To(HaveLen(2))
+	})
+
+	It("Rejects other versions of the format", func() {
+		_, err := read(ParseBinary, bytes.NewReader([]byte(BinaryMagic+"\x09")))
+		Expect(err).To(MatchError(ContainSubstring("unsupported binary format version 9")))
+	})
+
+	It("Reports truncated input", func() {
+		input := write(&Connect{details}, &Statement{details, "select 1", 0})
+
+		parsed, err := read(ParseBinary, bytes.NewReader(input[:len(input)-binaryTrailerSize-4]))
+		Expect(err).To(HaveOccurred())
+		Expect(parsed).To(HaveLen(2))
+	})
+})
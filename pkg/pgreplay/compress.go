@@ -0,0 +1,136 @@
+package pgreplay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+	CompressionXz    = "xz"
+)
+
+// compressionMagic lists the magic bytes that begin a stream of each compression format
+var compressionMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{CompressionGzip, []byte{0x1f, 0x8b}},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionBzip2, []byte("BZh")},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// DetectCompression peeks at the start of the reader to identify the compression format
+// from its magic bytes, returning CompressionNone for uncompressed input.
+func DetectCompression(input *bufio.Reader) string {
+	for _, candidate := range compressionMagic {
+		header, _ := input.Peek(len(candidate.magic))
+		if bytes.Equal(header, candidate.magic) {
+			return candidate.format
+		}
+	}
+
+	return CompressionNone
+}
+
+// NewDecompressingReader wraps the given input with a decompressor for whichever format
+// the input is compressed with, passing uncompressed input through untouched. This allows
+// every parser to transparently stream from compressed logs.
+//
+// Uncompressed input that can seek, such as a regular file, is returned as an
+// io.ReadSeeker so that parsers can skip through it.
+func NewDecompressingReader(input io.Reader) (io.ReadCloser, error) {
+	seeker, _ := input.(io.ReadSeeker)
+
+	var position int64
+	if seeker != nil {
+		var err error
+		if position, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil // pipes and terminals can't seek
+		}
+	}
+
+	buffered := bufio.NewReader(input)
+
+	switch DetectCompression(buffered) {
+	case CompressionGzip:
+		return gzip.NewReader(buffered)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	case CompressionBzip2:
+		return io.NopCloser(bzip2.NewReader(buffered)), nil
+	case CompressionXz:
+		reader, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(reader), nil
+	default:
+		// Rewind the bytes we peeked, so the file can be read directly
+		if seeker != nil {
+			if _, err := seeker.Seek(position, io.SeekStart); err == nil {
+				return nopSeekCloser{seeker}, nil
+			}
+		}
+
+		return io.NopCloser(buffered), nil
+	}
+}
+
+type nopSeekCloser struct{ io.ReadSeeker }
+
+func (nopSeekCloser) Close() error { return nil }
+
+// CompressionFromPath infers the compression format from the extension of a file path
+func CompressionFromPath(path string) string {
+	switch filepath.Ext(path) {
+	case ".gz":
+		return CompressionGzip
+	case ".zst":
+		return CompressionZstd
+	case ".xz":
+		return CompressionXz
+	default:
+		return CompressionNone
+	}
+}
+
+// NewCompressingWriter wraps the output with a compressor for the given format. Closing
+// the returned writer flushes the compressor, but does not close the underlying output.
+// We don't support writing bzip2, as the standard library only provides a decompressor.
+func NewCompressingWriter(output io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case CompressionNone, "":
+		return nopWriteCloser{output}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(output), nil
+	case CompressionZstd:
+		return zstd.NewWriter(output)
+	case CompressionXz:
+		return xz.NewWriter(output)
+	default:
+		return nil, fmt.Errorf("unsupported output compression: %s", format)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,71 @@
+package pgreplay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression", func() {
+	const payload = "2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: select 1\n"
+
+	DescribeTable("Round-trips through NewDecompressingReader",
+		func(format string) {
+			var compressed bytes.Buffer
+
+			writer, err := NewCompressingWriter(&compressed, format)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = io.WriteString(writer, payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Close()).To(Succeed())
+
+			Expect(DetectCompression(bufio.NewReader(bytes.NewReader(compressed.Bytes())))).To(Equal(format))
+
+			reader, err := NewDecompressingReader(&compressed)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(reader)).To(BeEquivalentTo(payload))
+		},
+		Entry("none", CompressionNone),
+		Entry("gzip", CompressionGzip),
+		Entry("zstd", CompressionZstd),
+		Entry("xz", CompressionXz),
+	)
+
+	It("Decompresses bzip2", func() {
+		if _, err := exec.LookPath("bzip2"); err != nil {
+			Skip("bzip2 is not installed")
+		}
+
+		cmd := exec.Command("bzip2", "-c")
+		cmd.Stdin = strings.NewReader(payload)
+		compressed, err := cmd.Output()
+		Expect(err).NotTo(HaveOccurred())
+
+		reader, err := NewDecompressingReader(bytes.NewReader(compressed))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(io.ReadAll(reader)).To(BeEquivalentTo(payload))
+	})
+
+	It("Keeps uncompressed input seekable", func() {
+		reader, err := NewDecompressingReader(bytes.NewReader([]byte(payload)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reader).To(BeAssignableToTypeOf(nopSeekCloser{}))
+		Expect(io.ReadAll(reader)).To(BeEquivalentTo(payload))
+	})
+
+	DescribeTable("CompressionFromPath",
+		func(path, expected string) {
+			Expect(CompressionFromPath(path)).To(Equal(expected))
+		},
+		Entry("gzip", "out.jsonl.gz", CompressionGzip),
+		Entry("zstd", "out.jsonl.zst", CompressionZstd),
+		Entry("xz", "out.jsonl.xz", CompressionXz),
+		Entry("uncompressed", "out.jsonl", CompressionNone),
+	)
+})
@@ -0,0 +1,72 @@
+package pgreplay
+
+import (
+	"fmt"
+)
+
+// CsvLogLayout describes the columns of a csvlog line. Postgres appends new columns to
+// the csvlog as it evolves, so while the leading columns never move, we need to know the
+// layout to find those added since.
+//
+// Columns that a layout doesn't have are given an index of -1.
+type CsvLogLayout struct {
+	Version         int // the first major version to write this layout
+	Columns         int
+	ApplicationName int
+	BackendType     int
+	QueryID         int
+}
+
+// CsvLogLayouts are the layouts written by each supported Postgres version, in order
+var CsvLogLayouts = []CsvLogLayout{
+	// PostgreSQL 9.0 added application_name as the last of 23 columns
+	{Version: 9, Columns: 23, ApplicationName: 22, BackendType: -1, QueryID: -1},
+	// PostgreSQL 13 added backend_type
+	{Version: 13, Columns: 24, ApplicationName: 22, BackendType: 23, QueryID: -1},
+	// PostgreSQL 14 added leader_pid and query_id, which is only populated when
+	// compute_query_id is enabled
+	{Version: 14, Columns: 26, ApplicationName: 22, BackendType: 23, QueryID: 25},
+}
+
+// LatestCsvLogVersion is the most recent major version whose csvlog layout we've verified
+const LatestCsvLogVersion = 17
+
+// CsvLogLayoutForVersion returns the layout written by the given Postgres major version
+func CsvLogLayoutForVersion(version int) (CsvLogLayout, error) {
+	if version < CsvLogLayouts[0].Version || version > LatestCsvLogVersion {
+		return CsvLogLayout{}, fmt.Errorf(
+			"unsupported csvlog version %d, must be between %d and %d",
+			version, CsvLogLayouts[0].Version, LatestCsvLogVersion,
+		)
+	}
+
+	layout := CsvLogLayouts[0]
+	for _, candidate := range CsvLogLayouts {
+		if candidate.Version <= version {
+			layout = candidate
+		}
+	}
+
+	return layout, nil
+}
+
+// DetectCsvLogLayout identifies the layout of a csvlog line from its number of columns
+func DetectCsvLogLayout(columns int) (CsvLogLayout, error) {
+	for _, layout := range CsvLogLayouts {
+		if layout.Columns == columns {
+			return layout, nil
+		}
+	}
+
+	return CsvLogLayout{}, fmt.Errorf("unrecognised csvlog layout with %d columns", columns)
+}
+
+// column returns the value at the given index, or an empty string if the layout doesn't
+// have the column.
+func (l CsvLogLayout) column(logline []string, idx int) string {
+	if idx < 0 {
+		return ""
+	}
+
+	return logline[idx]
+}
@@ -0,0 +1,107 @@
+package pgreplay
+
+import (
+	"encoding/csv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CsvLogLayout", func() {
+	DescribeTable("Layout for version",
+		func(version, columns int) {
+			layout, err := CsvLogLayoutForVersion(version)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(layout.Columns).To(Equal(columns))
+		},
+		Entry("PostgreSQL 12", 12, 23),
+		Entry("PostgreSQL 13", 13, 24),
+		Entry("PostgreSQL 14", 14, 26),
+		Entry("PostgreSQL 17", 17, 26),
+	)
+
+	It("Rejects versions we don't know the layout of", func() {
+		_, err := CsvLogLayoutForVersion(8)
+		Expect(err).To(MatchError(ContainSubstring("unsupported csvlog version 8")))
+
+		_, err = CsvLogLayoutForVersion(18)
+		Expect(err).To(MatchError(ContainSubstring("unsupported csvlog version 18")))
+	})
+
+	It("Rejects lines with an unrecognised number of columns", func() {
+		_, err := DetectCsvLogLayout(15)
+		Expect(err).To(MatchError("unrecognised csvlog layout with 15 columns"))
+	})
+})
+
+var _ = Describe("ParseCsvItem", func() {
+	const (
+		pg12 = `2019-02-25 15:08:27.222 GMT,"alice","pgreplay_test",7283,"127.0.0.1:57426",6480e39e.1c73,1,"SELECT",2019-02-25 15:08:27 GMT,4/286618,0,LOG,00000,"statement: select 1",,,,,,,,,"psql"`
+		pg13 = pg12 + `,"client backend"`
+		pg14 = pg13 + `,,5774081526858323261`
+	)
+
+	var (
+		record = func(line string) []string {
+			logline, err := csv.NewReader(strings.NewReader(line)).Read()
+			Expect(err).NotTo(HaveOccurred())
+
+			return logline
+		}
+		parse = func(line string, layout *CsvLogLayout) (Item, error) {
+			return ParseCsvItem(record(line), layout, map[SessionID]*Unbound{}, make([]byte, MaxLogLineSize))
+		}
+	)
+
+	DescribeTable("Detects the layout of each line",
+		func(line string) {
+			item, err := parse(line, nil)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item).To(BeAssignableToTypeOf(Statement{}))
+			Expect(item.(Statement).Query).To(Equal("select 1"))
+			Expect(item.GetUser()).To(Equal("alice"))
+		},
+		Entry("PostgreSQL 12", pg12),
+		Entry("PostgreSQL 13", pg13),
+		Entry("PostgreSQL 14", pg14),
+	)
+
+	It("Rejects lines that don't match the given layout", func() {
+		layout, _ := CsvLogLayoutForVersion(14)
+
+		_, err := parse(pg13, &layout)
+		Expect(err).To(MatchError(ContainSubstring("expected 26 columns for PostgreSQL 14 csvlog, found 24")))
+	})
+
+	DescribeTable("Reads the application name through the layout",
+		func(line string, version int) {
+			layout, err := CsvLogLayoutForVersion(version)
+			Expect(err).NotTo(HaveOccurred())
+
+			item, err := parse(line, &layout)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(item.GetApplicationName()).To(Equal("psql"))
+		},
+		Entry("PostgreSQL 13", pg13, 13),
+		Entry("PostgreSQL 14", pg14, 14),
+	)
+
+	DescribeTable("Exposes the columns of later layouts",
+		func(line, applicationName, backendType, queryID string) {
+			layout, err := DetectCsvLogLayout(len(record(line)))
+			Expect(err).NotTo(HaveOccurred())
+
+			logline := record(line)
+			Expect(layout.column(logline, layout.ApplicationName)).To(Equal(applicationName))
+			Expect(layout.column(logline, layout.BackendType)).To(Equal(backendType))
+			Expect(layout.column(logline, layout.QueryID)).To(Equal(queryID))
+		},
+		Entry("PostgreSQL 12", pg12, "psql", "", ""),
+		Entry("PostgreSQL 13", pg13, "psql", "client backend", ""),
+		Entry("PostgreSQL 14", pg14, "psql", "client backend", "5774081526858323261"),
+	)
+})
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/eapache/channels"
 	pgx "github.com/jackc/pgx/v5"
@@ -36,6 +37,13 @@ var (
 			Help: "Most recent timestamp of processed items",
 		},
 	)
+	itemsDurationRatio = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "pgreplay_items_duration_ratio",
+			Help:    "Ratio of replayed to original duration, for items that recorded how long they originally took",
+			Buckets: prometheus.ExponentialBuckets(0.125, 2, 10),
+		},
+	)
 )
 
 func NewDatabase(ctx context.Context, cfg DatabaseConnConfig) (*Database, error) {
@@ -49,7 +57,12 @@ func NewDatabase(ctx context.Context, cfg DatabaseConnConfig) (*Database, error)
 		return nil, err
 	}
 
-	return &Database{connConfig, map[SessionID]*Conn{}}, conn.Close(ctx)
+	parameterTypes := cfg.ParameterTypes
+	if parameterTypes == "" {
+		parameterTypes = ParameterTypesCaptured
+	}
+
+	return &Database{connConfig, parameterTypes, cfg.Pool, map[SessionID]*Conn{}}, conn.Close(ctx)
 }
 
 func ParseConnData(cfg DatabaseConnConfig) string {
@@ -59,9 +72,26 @@ func ParseConnData(cfg DatabaseConnConfig) string {
 	)
 }
 
+// How bind parameters are typed when we replay them
+const (
+	// ParameterTypesCaptured sends parameters with the types we captured, where the
+	// source provided them, and otherwise leaves pgx to type them as it would any query
+	ParameterTypesCaptured = "captured"
+	// ParameterTypesDescribe is ParameterTypesCaptured, but describes each query without
+	// captured types once per connection, and sends its parameters with those types
+	ParameterTypesDescribe = "describe"
+	// ParameterTypesUntyped ignores captured types, replaying as we did before we had them
+	ParameterTypesUntyped = "untyped"
+)
+
+// ParameterTypeModes are the ways we can type bind parameters
+var ParameterTypeModes = []string{ParameterTypesCaptured, ParameterTypesDescribe, ParameterTypesUntyped}
+
 type Database struct {
-	cfg   *pgx.ConnConfig
-	conns map[SessionID]*Conn
+	cfg            *pgx.ConnConfig
+	parameterTypes string
+	pool           PoolConfig
+	conns          map[SessionID]*Conn
 }
 
 // Consume iterates through all the items in the given channel and attempts to process
@@ -71,6 +101,10 @@ type Database struct {
 //
 // Once all items have finished processing, both channels will be closed.
 func (d *Database) Consume(ctx context.Context, items chan Item) (chan error, chan error) {
+	if d.pool.Size > 0 {
+		return d.consumePooled(ctx, items)
+	}
+
 	var wg sync.WaitGroup
 
 	errs, done := make(chan error, 10), make(chan error)
@@ -132,7 +166,10 @@ func (d *Database) Connect(ctx context.Context, item Item) (*Conn, error) {
 		return nil, err
 	}
 
-	return &Conn{conn, channels.NewInfiniteChannel(), sync.Once{}}, nil
+	return &Conn{
+		conn, channels.NewInfiniteChannel(), sync.Once{},
+		map[string]preparedStatement{}, d.parameterTypes, map[string][]uint32{},
+	}, nil
 }
 
 // Conn represents a single database connection handling a stream of work Items
@@ -140,6 +177,157 @@ type Conn struct {
 	*pgx.Conn
 	channels.Channel
 	sync.Once
+
+	// prepared maps the name of each statement we've prepared on this connection to its
+	// query, allowing us to prepare once and then execute by name.
+	prepared map[string]preparedStatement
+
+	// parameterTypes is how we type bind parameters, and described caches the parameter
+	// types of each query we've described when doing so
+	parameterTypes string
+	described      map[string][]uint32
+}
+
+type preparedStatement struct {
+	query string
+	typed bool // prepared with explicit parameter types, so pgx doesn't know of it
+}
+
+// prepare creates the named statement unless we've already prepared it with the same
+// query. If the name was previously used for a different query then we must have missed
+// its deallocation, and should release the old statement before preparing the new one.
+func (c *Conn) prepare(ctx context.Context, name, query string, types []uint32) error {
+	if existing, ok := c.prepared[name]; ok {
+		if existing.query == query {
+			return nil
+		}
+
+		if err := c.deallocate(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	if c.parameterTypes == ParameterTypesUntyped || len(types) == 0 {
+		if _, err := c.Conn.Prepare(ctx, name, query); err != nil {
+			return err
+		}
+
+		c.prepared[name] = preparedStatement{query, false}
+
+		return nil
+	}
+
+	if _, err := c.PgConn().Prepare(ctx, name, query, types); err != nil {
+		return err
+	}
+
+	c.prepared[name] = preparedStatement{query, true}
+
+	return nil
+}
+
+// execute runs the query with the given parameters, which are sent with explicit types
+// when we know them
+func (c *Conn) execute(ctx context.Context, query string, parameters []interface{}, types []uint32) error {
+	switch c.parameterTypes {
+	case ParameterTypesUntyped:
+		types = nil
+	case ParameterTypesDescribe:
+		if len(types) == 0 && len(parameters) > 0 {
+			var err error
+			if types, err = c.describe(ctx, query); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(types) == 0 {
+		_, err := c.Exec(ctx, query, parameters...)
+		return err
+	}
+
+	values, err := textParameters(parameters)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.PgConn().ExecParams(ctx, query, values, types, nil, nil).Close()
+	return err
+}
+
+// executePrepared runs a statement we've prepared. Statements we prepared with explicit
+// types are unknown to pgx, so we send their parameters as text, leaving Postgres to
+// parse them as the types we prepared them with.
+func (c *Conn) executePrepared(ctx context.Context, name string, parameters []interface{}) error {
+	if !c.prepared[name].typed {
+		_, err := c.Exec(ctx, name, parameters...)
+		return err
+	}
+
+	values, err := textParameters(parameters)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.PgConn().ExecPrepared(ctx, name, values, nil, nil).Close()
+	return err
+}
+
+// describe asks Postgres for the parameter types of the query, using the unnamed
+// statement so nothing is left prepared, and remembers them for the connection
+func (c *Conn) describe(ctx context.Context, query string) ([]uint32, error) {
+	if types, ok := c.described[query]; ok {
+		return types, nil
+	}
+
+	description, err := c.PgConn().Prepare(ctx, "", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.described[query] = description.ParamOIDs
+
+	return description.ParamOIDs, nil
+}
+
+// deallocate releases the named statement if we prepared it on this connection. Pooled
+// sessions deallocate on whichever connection they hold, which may never have prepared
+// the statement.
+func (c *Conn) deallocate(ctx context.Context, name string) error {
+	if _, ok := c.prepared[name]; !ok {
+		return nil
+	}
+
+	delete(c.prepared, name)
+	return c.Conn.Deallocate(ctx, name)
+}
+
+func (c *Conn) deallocateAll(ctx context.Context) error {
+	c.prepared = map[string]preparedStatement{}
+	return c.Conn.DeallocateAll(ctx)
+}
+
+// textParameters renders parameters in the text format, as Postgres would receive them
+// from our logs. Values we parsed from JSON that aren't strings, such as numbers, are
+// rendered as JSON, which Postgres parses the same way.
+func textParameters(parameters []interface{}) ([][]byte, error) {
+	values := make([][]byte, len(parameters))
+	for idx, parameter := range parameters {
+		switch parameter := parameter.(type) {
+		case nil:
+		case string:
+			values[idx] = []byte(parameter)
+		default:
+			encoded, err := json.Marshal(parameter)
+			if err != nil {
+				return nil, err
+			}
+
+			values[idx] = encoded
+		}
+	}
+
+	return values, nil
 }
 
 func (c *Conn) Close() {
@@ -161,7 +349,14 @@ func (c *Conn) Start(ctx context.Context) error {
 		itemsProcessedTotal.Inc()
 		itemsMostRecentTimestamp.Set(float64(item.GetTimestamp().Unix()))
 
-		err := item.Handle(ctx, c.Conn)
+		began := time.Now()
+		err := item.Handle(ctx, c)
+
+		// Compare against the original duration, to see how the replay target performs
+		// relative to where the logs were captured
+		if original := OriginalDuration(item); original > 0 && err == nil {
+			itemsDurationRatio.Observe(float64(time.Since(began)) / float64(original))
+		}
 
 		// If we're no longer alive, then we know we can no longer process items
 		if c.IsClosed() {
@@ -174,7 +369,7 @@ func (c *Conn) Start(ctx context.Context) error {
 	// terminate ourselves by handling our own disconnect, so we can know when all our
 	// connection are done.
 	if !c.IsClosed() {
-		Disconnect{}.Handle(ctx, c.Conn)
+		Disconnect{}.Handle(ctx, c)
 	}
 
 	return nil
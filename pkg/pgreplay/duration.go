@@ -0,0 +1,226 @@
+package pgreplay
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var itemsDurationFilteredTotal = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "pgreplay_items_duration_filtered_total",
+		Help: "Number of items filtered by min/max original duration",
+	},
+)
+
+// loggedDuration matches the duration Postgres logs when a statement completes, either
+// alone or followed by the statement when log_statement didn't already log it
+var loggedDuration = regexp.MustCompile(`^duration: (\d+\.\d+) ms`)
+
+// parseLoggedDuration extracts the duration from a 'duration: X ms' log message, returning
+// zero if the message doesn't begin with one.
+func parseLoggedDuration(msg string) time.Duration {
+	matches := loggedDuration.FindStringSubmatch(strings.TrimPrefix(msg, ActionLog))
+	if matches == nil {
+		return 0
+	}
+
+	ms, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// durationLog is produced by parsing a bare 'duration: X ms' line, which completes the
+// statement that the session most recently logged. It is never emitted by our parsers,
+// as durationTracker attaches it to the statement it completes.
+type durationLog struct {
+	Details
+	Duration time.Duration
+}
+
+func (durationLog) Handle(context.Context, *Conn) error { return nil }
+
+// MaxDurationWait is how long, in log time, we hold a statement for the duration that
+// completes it. Statements that run for longer lose their duration, but we can't hold
+// them forever, as every item logged after them waits behind them.
+const MaxDurationWait = time.Minute
+
+// durationTracker attaches the durations of bare duration lines to the statements that
+// preceded them. Once we've seen a duration we hold each session's most recent statement
+// until its duration arrives, the session logs something else, or MaxDurationWait has
+// passed. Items are emitted in the order they were logged, so those of other sessions
+// queue behind held statements, and durations that arrive after their statement was
+// emitted are dropped.
+//
+// Logs without durations never see their statements held, as we don't want to delay
+// statements behind those of other sessions unless we have to.
+//
+// When both log_statement and log_min_duration_statement are enabled, a statement can be
+// logged once on its own and again alongside its duration. If the first is still held
+// then the second completes it instead of replaying the statement twice.
+type durationTracker struct {
+	queue           []*queuedItem
+	held            map[SessionID]*queuedItem
+	expectDurations bool
+}
+
+type queuedItem struct {
+	Item
+	held bool // whether we're waiting for the item's duration
+}
+
+func newDurationTracker() *durationTracker {
+	return &durationTracker{held: map[SessionID]*queuedItem{}}
+}
+
+// track receives each parsed item in turn, returning those ready to be emitted
+func (t *durationTracker) track(item Item) []Item {
+	if item == nil {
+		return nil
+	}
+
+	if duration, ok := item.(durationLog); ok {
+		t.expectDurations = true
+		if held, ok := t.held[duration.SessionID]; ok {
+			t.release(held, duration.Duration)
+		}
+
+		return t.ready(duration.Timestamp)
+	}
+
+	held, isHeld := t.held[item.GetSessionID()]
+
+	// Any item that arrives with its duration tells us this log includes them
+	if duration := OriginalDuration(item); duration > 0 {
+		t.expectDurations = true
+
+		if isHeld && sameStatement(held.Item, item) {
+			t.release(held, duration)
+			return t.ready(item.GetTimestamp())
+		}
+	}
+
+	// The session has moved on, so its held statement won't see a duration
+	if isHeld {
+		t.release(held, 0)
+	}
+
+	queued := &queuedItem{Item: item}
+	if t.expectDurations && awaitsDuration(item) {
+		queued.held = true
+		t.held[item.GetSessionID()] = queued
+	}
+
+	t.queue = append(t.queue, queued)
+
+	return t.ready(item.GetTimestamp())
+}
+
+// release stops holding the item, attaching the duration if we have one
+func (t *durationTracker) release(queued *queuedItem, duration time.Duration) {
+	if duration > 0 {
+		queued.Item = WithOriginalDuration(queued.Item, duration)
+	}
+
+	queued.held = false
+	delete(t.held, queued.GetSessionID())
+}
+
+// ready pops every item from the front of the queue that is no longer held, giving up on
+// the durations of those logged more than MaxDurationWait before now
+func (t *durationTracker) ready(now time.Time) []Item {
+	var ready []Item
+	for len(t.queue) > 0 {
+		queued := t.queue[0]
+		if queued.held {
+			if now.Sub(queued.GetTimestamp()) <= MaxDurationWait {
+				break
+			}
+
+			t.release(queued, 0)
+		}
+
+		t.queue[0] = nil
+		t.queue = t.queue[1:]
+		ready = append(ready, queued.Item)
+	}
+
+	return ready
+}
+
+// flush returns every queued item, for when the log has ended
+func (t *durationTracker) flush() []Item {
+	ready := make([]Item, 0, len(t.queue))
+	for _, queued := range t.queue {
+		ready = append(ready, queued.Item)
+	}
+
+	t.queue, t.held = nil, map[SessionID]*queuedItem{}
+
+	return ready
+}
+
+func awaitsDuration(item Item) bool {
+	return RecordsDuration(item) && OriginalDuration(item) == 0
+}
+
+// sameStatement reports whether two items log the same statement, regardless of when they
+// were logged or the duration they recorded.
+func sameStatement(a, b Item) bool {
+	switch a := a.(type) {
+	case Statement:
+		b, ok := b.(Statement)
+		return ok && a.Query == b.Query
+	case BoundExecute:
+		b, ok := b.(BoundExecute)
+		return ok && a.Query == b.Query && reflect.DeepEqual(a.Parameters, b.Parameters)
+	case ExecutePrepared:
+		b, ok := b.(ExecutePrepared)
+		return ok && a.Name == b.Name && a.Query == b.Query && reflect.DeepEqual(a.Parameters, b.Parameters)
+	}
+
+	return false
+}
+
+// FilterDuration removes the statements and executes whose original duration falls outside
+// the given range, where a zero bound is ignored. Statements that didn't record a duration
+// are removed whenever a minimum is given, as we can't know they were expensive. Every
+// other item is kept, as they manage the sessions that the remaining statements run in.
+func FilterDuration(items chan Item, min, max time.Duration) chan Item {
+	if min == 0 && max == 0 {
+		return items
+	}
+
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			if RecordsDuration(item) {
+				duration := OriginalDuration(item)
+				if (min > 0 && duration < min) || (max > 0 && duration > max) {
+					itemsDurationFilteredTotal.Inc()
+					continue
+				}
+			}
+
+			out <- item
+		}
+
+		close(out)
+	}()
+
+	return out
+}
@@ -0,0 +1,154 @@
+package pgreplay
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("durationTracker", func() {
+	var (
+		tracker *durationTracker
+		details = func(session SessionID) Details {
+			return Details{Timestamp: time20190225, SessionID: session}
+		}
+	)
+
+	BeforeEach(func() {
+		tracker = newDurationTracker()
+	})
+
+	It("Emits statements immediately until the log includes durations", func() {
+		Expect(tracker.track(Statement{details("a"), "select 1", 0})).To(HaveLen(1))
+		Expect(tracker.track(durationLog{details("a"), time.Millisecond})).To(BeEmpty())
+	})
+
+	It("Attaches durations to the statement the session last logged", func() {
+		tracker.track(durationLog{details("a"), time.Millisecond})
+
+		Expect(tracker.track(Statement{details("a"), "select 1", 0})).To(BeEmpty())
+		Expect(tracker.track(Statement{details("b"), "select 2", 0})).To(BeEmpty())
+		Expect(tracker.track(durationLog{details("a"), 2 * time.Millisecond})).To(Equal(
+			[]Item{Statement{details("a"), "select 1", 2 * time.Millisecond}},
+		))
+
+		// A session that logs something else before the duration releases its statement
+		Expect(tracker.track(Disconnect{details("b")})).To(Equal(
+			[]Item{Statement{details("b"), "select 2", 0}, Disconnect{details("b")}},
+		))
+	})
+
+	It("Completes statements logged again alongside their duration", func() {
+		Expect(tracker.track(Statement{details("a"), "select 1", time.Millisecond})).To(HaveLen(1))
+
+		Expect(tracker.track(Statement{details("a"), "select 2", 0})).To(BeEmpty())
+		Expect(tracker.track(Statement{details("a"), "select 2", 2 * time.Millisecond})).To(Equal(
+			[]Item{Statement{details("a"), "select 2", 2 * time.Millisecond}},
+		))
+
+		// Different statements are both replayed
+		Expect(tracker.track(Statement{details("a"), "select 3", 0})).To(BeEmpty())
+		Expect(tracker.track(Statement{details("a"), "select 4", time.Millisecond})).To(Equal(
+			[]Item{Statement{details("a"), "select 3", 0}, Statement{details("a"), "select 4", time.Millisecond}},
+		))
+	})
+
+	It("Only remembers statements until they're emitted", func() {
+		tracker.track(durationLog{details("a"), time.Millisecond})
+		tracker.track(Statement{details("a"), "select 1", 0})
+		tracker.track(Statement{details("b"), "select 2", 0})
+
+		later := Details{Timestamp: time20190225.Add(MaxDurationWait + time.Second), SessionID: "c"}
+		Expect(tracker.track(Connect{later})).To(HaveLen(3))
+		Expect(tracker.held).To(BeEmpty())
+		Expect(tracker.queue).To(BeEmpty())
+
+		// Idle sessions are forgotten, so their statements can't be completed any more
+		Expect(tracker.track(Statement{details("a"), "select 1", time.Millisecond})).To(HaveLen(1))
+	})
+
+	It("Emits items in the order they were logged", func() {
+		tracker.track(durationLog{details("a"), time.Millisecond})
+
+		Expect(tracker.track(Statement{details("a"), "select 1", 0})).To(BeEmpty())
+		Expect(tracker.track(Statement{details("b"), "select 2", 0})).To(BeEmpty())
+		Expect(tracker.track(Disconnect{details("c")})).To(BeEmpty())
+
+		// Releasing a later statement doesn't emit it ahead of those logged before it
+		Expect(tracker.track(durationLog{details("b"), 2 * time.Millisecond})).To(BeEmpty())
+		Expect(tracker.track(durationLog{details("a"), time.Millisecond})).To(Equal([]Item{
+			Statement{details("a"), "select 1", time.Millisecond},
+			Statement{details("b"), "select 2", 2 * time.Millisecond},
+			Disconnect{details("c")},
+		}))
+	})
+
+	It("Stops waiting for durations after MaxDurationWait", func() {
+		tracker.track(durationLog{details("a"), time.Millisecond})
+		Expect(tracker.track(Statement{details("a"), "select 1", 0})).To(BeEmpty())
+
+		later := Details{Timestamp: time20190225.Add(MaxDurationWait + time.Second), SessionID: "b"}
+		Expect(tracker.track(Connect{later})).To(Equal([]Item{
+			Statement{details("a"), "select 1", 0}, Connect{later},
+		}))
+
+		// The statement was emitted without it, so a late duration is dropped
+		Expect(tracker.track(durationLog{details("a"), time.Hour})).To(BeEmpty())
+	})
+
+	It("Attaches durations to copies of pointer items", func() {
+		tracker.track(durationLog{details("a"), time.Millisecond})
+
+		statement := &Statement{details("a"), "select 1", 0}
+		tracker.track(statement)
+
+		Expect(tracker.track(durationLog{details("a"), time.Millisecond})).To(Equal(
+			[]Item{&Statement{details("a"), "select 1", time.Millisecond}},
+		))
+		Expect(statement.OriginalDuration).To(BeZero())
+	})
+
+	It("Flushes held statements at the end of the log", func() {
+		tracker.track(durationLog{details("a"), time.Millisecond})
+		tracker.track(Statement{details("b"), "select 2", 0})
+		tracker.track(Statement{details("a"), "select 1", 0})
+
+		Expect(tracker.flush()).To(Equal([]Item{
+			Statement{details("b"), "select 2", 0},
+			Statement{details("a"), "select 1", 0},
+		}))
+	})
+})
+
+var _ = Describe("FilterDuration", func() {
+	DescribeTable("Filters statements by original duration",
+		func(min, max time.Duration, expected []string) {
+			details := Details{Timestamp: time20190225, SessionID: "a"}
+			items := make(chan Item, 5)
+			items <- Connect{details}
+			items <- Statement{details, "fast", time.Millisecond}
+			items <- Statement{details, "slow", time.Second}
+			items <- Statement{details, "unknown", 0}
+			items <- Disconnect{details}
+			close(items)
+
+			var kept []string
+			for item := range FilterDuration(items, min, max) {
+				switch item := item.(type) {
+				case Statement:
+					kept = append(kept, item.Query)
+				default:
+					kept = append(kept, fmt.Sprintf("%T", item))
+				}
+			}
+
+			Expect(kept).To(Equal(expected))
+		},
+		Entry("no bounds", time.Duration(0), time.Duration(0), []string{"pgreplay.Connect", "fast", "slow", "unknown", "pgreplay.Disconnect"}),
+		Entry("minimum", 10*time.Millisecond, time.Duration(0), []string{"pgreplay.Connect", "slow", "pgreplay.Disconnect"}),
+		Entry("maximum", time.Duration(0), 10*time.Millisecond, []string{"pgreplay.Connect", "fast", "unknown", "pgreplay.Disconnect"}),
+	)
+})
@@ -0,0 +1,46 @@
+package pgreplay
+
+import (
+	"github.com/gocardless/pgreplay-go/pkg/fingerprint"
+)
+
+// FingerprintItems records the fingerprint of the query of every statement and execute,
+// replacing any fingerprint they had from before their query was transformed.
+func FingerprintItems(items chan Item) chan Item {
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			if query, ok := itemQuery(item); ok {
+				details := item.GetDetails()
+				details.Fingerprint = fingerprint.Compute(query).ID
+				item = WithDetails(item, details)
+			}
+
+			out <- item
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+// QueryFingerprint returns the fingerprint of the item's query, computing it if the item
+// wasn't fingerprinted when it was written.
+func QueryFingerprint(item Item) (string, bool) {
+	query, ok := itemQuery(item)
+	if !ok {
+		return "", false
+	}
+
+	if id := item.GetDetails().Fingerprint; id != "" {
+		return id, true
+	}
+
+	return fingerprint.Compute(query).ID, true
+}
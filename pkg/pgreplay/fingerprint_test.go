@@ -0,0 +1,43 @@
+package pgreplay
+
+import (
+	"github.com/gocardless/pgreplay-go/pkg/fingerprint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FingerprintItems", func() {
+	var details = Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+
+	It("Fingerprints the queries of statements and executes", func() {
+		items := make(chan Item, 4)
+		items <- Connect{details}
+		items <- Statement{details, "select * from logs where id = 1", 0}
+		items <- Execute{details, "select * from logs where id = $1", 0}.Bind([]interface{}{"2"})
+		items <- &Statement{Details{Fingerprint: "stale"}, "select 1", 0}
+		close(items)
+
+		var fingerprinted []Item
+		for item := range FingerprintItems(items) {
+			fingerprinted = append(fingerprinted, item)
+		}
+
+		expected := fingerprint.Compute("select * from logs where id = ?").ID
+
+		Expect(fingerprinted).To(HaveLen(4))
+		Expect(fingerprinted[0].GetDetails().Fingerprint).To(BeEmpty())
+		Expect(fingerprinted[1].GetDetails().Fingerprint).To(Equal(expected))
+		Expect(fingerprinted[2].GetDetails().Fingerprint).To(Equal(expected))
+		Expect(fingerprinted[3].GetDetails().Fingerprint).To(Equal(fingerprint.Compute("select 1").ID))
+	})
+
+	It("Computes fingerprints for items written without them", func() {
+		id, ok := QueryFingerprint(Statement{details, "select 2", 0})
+		Expect(ok).To(BeTrue())
+		Expect(id).To(Equal(fingerprint.Compute("select 1").ID))
+
+		_, ok = QueryFingerprint(Connect{details})
+		Expect(ok).To(BeFalse())
+	})
+})
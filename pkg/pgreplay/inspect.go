@@ -0,0 +1,281 @@
+package pgreplay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gocardless/pgreplay-go/pkg/fingerprint"
+)
+
+// Inspection summarises the contents of a log, to help decide what to replay before
+// committing to a long benchmark.
+type Inspection struct {
+	Start                  time.Time          `json:"start"`
+	Finish                 time.Time          `json:"finish"`
+	Items                  map[string]int     `json:"items"`
+	Sessions               int                `json:"sessions"`
+	Users                  int                `json:"users"`
+	Databases              int                `json:"databases"`
+	PeakConcurrentSessions int                `json:"peak_concurrent_sessions"`
+	QueriesPerSecond       []QueryRate        `json:"queries_per_second"`
+	TopFingerprints        []FingerprintCount `json:"top_fingerprints"`
+	UnmatchedParameters    int                `json:"unmatched_parameters"`
+	ParseErrors            int                `json:"parse_errors"`
+}
+
+// QueryRate is the rate of queries in the interval beginning at Start
+type QueryRate struct {
+	Start   time.Time `json:"start"`
+	Queries int       `json:"queries"`
+	Rate    float64   `json:"rate"`
+}
+
+// FingerprintCount is the number of queries seen with a fingerprint
+type FingerprintCount struct {
+	Fingerprint string `json:"fingerprint"`
+	Query       string `json:"query"`
+	Count       int    `json:"count"`
+}
+
+// Inspector builds an Inspection from a stream of items, along with the errors of the
+// parsers that produced them.
+type Inspector struct {
+	interval time.Duration
+	top      int
+
+	sync.Mutex // parsers report errors concurrently
+	parsers    sync.WaitGroup
+	unmatchedParameters,
+	parseErrors int
+}
+
+// NewInspector creates an Inspector that measures queries per second over the given
+// interval, and reports the top fingerprints by count.
+func NewInspector(interval time.Duration, top int) *Inspector {
+	return &Inspector{interval: interval, top: top}
+}
+
+// Parser wraps a ParserFunc so the inspector can count its errors, which are passed on
+// unchanged.
+func (i *Inspector) Parser(parser ParserFunc) ParserFunc {
+	return func(input io.Reader) (chan Item, chan error, chan error) {
+		items, errs, done := parser(input)
+		observed := make(chan error)
+
+		i.parsers.Add(1)
+		go func() {
+			defer i.parsers.Done()
+
+			for err := range errs {
+				i.Lock()
+				i.parseErrors++
+				if errors.Is(err, ErrUnmatchedParameters) {
+					i.unmatchedParameters++
+				}
+				i.Unlock()
+
+				observed <- err
+			}
+
+			close(observed)
+		}()
+
+		return items, observed, done
+	}
+}
+
+type inspectedSession struct {
+	start, finish time.Time
+}
+
+type inspectedFingerprint struct {
+	query string
+	count int
+}
+
+// Inspect consumes every item, returning the inspection once the channel is closed and
+// the parsers have finished.
+func (i *Inspector) Inspect(items chan Item) Inspection {
+	inspection := Inspection{Items: map[string]int{}}
+
+	var (
+		sessions     = map[SessionID]*inspectedSession{}
+		users        = map[string]struct{}{}
+		databases    = map[string]struct{}{}
+		queries      = map[int64]int{} // by the unix time of each interval
+		fingerprints = map[string]*inspectedFingerprint{}
+	)
+
+	for item := range items {
+		if item == nil {
+			continue
+		}
+
+		ts := item.GetTimestamp()
+		if inspection.Start.IsZero() || ts.Before(inspection.Start) {
+			inspection.Start = ts
+		}
+		if ts.After(inspection.Finish) {
+			inspection.Finish = ts
+		}
+
+		inspection.Items[ItemType(item)]++
+		users[item.GetUser()] = struct{}{}
+		databases[item.GetDatabase()] = struct{}{}
+
+		session, ok := sessions[item.GetSessionID()]
+		if !ok {
+			session = &inspectedSession{start: ts}
+			sessions[item.GetSessionID()] = session
+		}
+		session.finish = ts
+
+		// Statements and executes are the items that run a query, which are also those
+		// that record their duration
+		if !RecordsDuration(item) {
+			continue
+		}
+
+		queries[ts.Truncate(i.interval).UnixNano()]++
+
+		if id, ok := QueryFingerprint(item); ok {
+			if _, ok := fingerprints[id]; !ok {
+				query, _ := itemQuery(item)
+				fingerprints[id] = &inspectedFingerprint{query: fingerprint.Normalise(query)}
+			}
+
+			fingerprints[id].count++
+		}
+	}
+
+	inspection.Sessions, inspection.Users, inspection.Databases = len(sessions), len(users), len(databases)
+	inspection.PeakConcurrentSessions = peakConcurrency(sessions)
+	inspection.QueriesPerSecond = i.queryRates(inspection.Start, inspection.Finish, queries)
+	inspection.TopFingerprints = topFingerprints(fingerprints, i.top)
+
+	// Parsers close their errors after their items, so wait for the last of them
+	i.parsers.Wait()
+
+	i.Lock()
+	inspection.UnmatchedParameters, inspection.ParseErrors = i.unmatchedParameters, i.parseErrors
+	i.Unlock()
+
+	return inspection
+}
+
+// peakConcurrency finds the most sessions that were open at once, where a session is open
+// from its first item to its last.
+func peakConcurrency(sessions map[SessionID]*inspectedSession) int {
+	type event struct {
+		ts    time.Time
+		delta int
+	}
+
+	events := make([]event, 0, 2*len(sessions))
+	for _, session := range sessions {
+		events = append(events, event{session.start, 1}, event{session.finish, -1})
+	}
+
+	// Sessions that open as another closes overlap, so process openings first
+	sort.Slice(events, func(a, b int) bool {
+		if !events[a].ts.Equal(events[b].ts) {
+			return events[a].ts.Before(events[b].ts)
+		}
+
+		return events[a].delta > events[b].delta
+	})
+
+	open, peak := 0, 0
+	for _, event := range events {
+		if open += event.delta; open > peak {
+			peak = open
+		}
+	}
+
+	return peak
+}
+
+// queryRates reports the rate of queries in every interval of the log, including those
+// that had none.
+func (i *Inspector) queryRates(start, finish time.Time, queries map[int64]int) []QueryRate {
+	if len(queries) == 0 {
+		return []QueryRate{}
+	}
+
+	var rates []QueryRate
+	for bucket := start.Truncate(i.interval); !bucket.After(finish); bucket = bucket.Add(i.interval) {
+		rates = append(rates, QueryRate{
+			Start:   bucket,
+			Queries: queries[bucket.UnixNano()],
+			Rate:    float64(queries[bucket.UnixNano()]) / i.interval.Seconds(),
+		})
+	}
+
+	return rates
+}
+
+func topFingerprints(fingerprints map[string]*inspectedFingerprint, top int) []FingerprintCount {
+	counts := make([]FingerprintCount, 0, len(fingerprints))
+	for id, fingerprint := range fingerprints {
+		counts = append(counts, FingerprintCount{id, fingerprint.query, fingerprint.count})
+	}
+
+	sort.Slice(counts, func(a, b int) bool {
+		if counts[a].Count != counts[b].Count {
+			return counts[a].Count > counts[b].Count
+		}
+
+		return counts[a].Fingerprint < counts[b].Fingerprint
+	})
+
+	if len(counts) > top {
+		counts = counts[:top]
+	}
+
+	return counts
+}
+
+// WriteTable renders the inspection as tables for the terminal
+func (i Inspection) WriteTable(output io.Writer) error {
+	w := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Start\t%s\n", i.Start.Format(PostgresTimestampFormat))
+	fmt.Fprintf(w, "Finish\t%s\n", i.Finish.Format(PostgresTimestampFormat))
+	fmt.Fprintf(w, "Duration\t%s\n", i.Finish.Sub(i.Start))
+	fmt.Fprintf(w, "Sessions\t%d\n", i.Sessions)
+	fmt.Fprintf(w, "Users\t%d\n", i.Users)
+	fmt.Fprintf(w, "Databases\t%d\n", i.Databases)
+	fmt.Fprintf(w, "Peak concurrent sessions\t%d\n", i.PeakConcurrentSessions)
+	fmt.Fprintf(w, "Unmatched bind parameters\t%d\n", i.UnmatchedParameters)
+	fmt.Fprintf(w, "Parse errors\t%d\n", i.ParseErrors)
+
+	types := make([]string, 0, len(i.Items))
+	for label := range i.Items {
+		types = append(types, label)
+	}
+
+	sort.Strings(types)
+
+	fmt.Fprintf(w, "\nType\tItems\n")
+	for _, label := range types {
+		fmt.Fprintf(w, "%s\t%d\n", label, i.Items[label])
+	}
+
+	fmt.Fprintf(w, "\nInterval\tQueries\tQueries per second\n")
+	for _, rate := range i.QueriesPerSecond {
+		fmt.Fprintf(w, "%s\t%d\t%.2f\n", rate.Start.Format(PostgresTimestampFormat), rate.Queries, rate.Rate)
+	}
+
+	fmt.Fprintf(w, "\nCount\tFingerprint\tQuery\n")
+	for _, fingerprint := range i.TopFingerprints {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", fingerprint.Count, fingerprint.Fingerprint, strings.Join(strings.Fields(fingerprint.Query), " "))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,109 @@
+package pgreplay
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/gocardless/pgreplay-go/pkg/fingerprint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Inspector", func() {
+	var (
+		at = func(session SessionID, user string, offset time.Duration) Details {
+			return Details{Timestamp: time20190225.Add(offset), SessionID: session, User: user, Database: "pgreplay_test"}
+		}
+		inspect = func(inspector *Inspector, items ...Item) Inspection {
+			in := make(chan Item, len(items))
+			for _, item := range items {
+				in <- item
+			}
+			close(in)
+
+			return inspector.Inspect(in)
+		}
+	)
+
+	It("Summarises the items of a log", func() {
+		inspection := inspect(NewInspector(time.Minute, 1),
+			Connect{at("a", "alice", 0)},
+			Statement{at("a", "alice", time.Second), "select 1", 0},
+			Connect{at("b", "bob", 30*time.Second)},
+			Statement{at("b", "bob", 40*time.Second), "select 2", 0},
+			Execute{at("b", "bob", 50*time.Second), "select $1", 0}.Bind([]interface{}{"3"}),
+			Disconnect{at("a", "alice", time.Minute)},
+			Statement{at("b", "bob", 3*time.Minute), "insert into logs values (1)", 0},
+			Disconnect{at("b", "bob", 4*time.Minute)},
+		)
+
+		Expect(inspection.Start).To(Equal(time20190225))
+		Expect(inspection.Finish).To(Equal(time20190225.Add(4 * time.Minute)))
+		Expect(inspection.Items).To(Equal(map[string]int{
+			"Connect": 2, "Statement": 3, "BoundExecute": 1, "Disconnect": 2,
+		}))
+		Expect(inspection.Sessions).To(Equal(2))
+		Expect(inspection.Users).To(Equal(2))
+		Expect(inspection.Databases).To(Equal(1))
+		Expect(inspection.PeakConcurrentSessions).To(Equal(2))
+
+		Expect(inspection.QueriesPerSecond).To(HaveLen(5))
+		Expect(inspection.QueriesPerSecond[0].Start).To(Equal(time20190225.Truncate(time.Minute)))
+		Expect(inspection.QueriesPerSecond[0].Queries).To(Equal(1))
+		Expect(inspection.QueriesPerSecond[1].Queries).To(Equal(2))
+		Expect(inspection.QueriesPerSecond[1].Rate).To(BeNumerically("~", 2.0/60))
+		Expect(inspection.QueriesPerSecond[2].Queries).To(Equal(0))
+		Expect(inspection.QueriesPerSecond[3].Queries).To(Equal(1))
+
+		Expect(inspection.TopFingerprints).To(Equal([]FingerprintCount{
+			{fingerprint.Compute("select 1").ID, "select ?", 3},
+		}))
+	})
+
+	It("Counts sessions that don't overlap once", func() {
+		inspection := inspect(NewInspector(time.Minute, 10),
+			Connect{at("a", "alice", 0)},
+			Disconnect{at("a", "alice", time.Second)},
+			Connect{at("b", "alice", 2*time.Second)},
+			Disconnect{at("b", "alice", 3*time.Second)},
+		)
+
+		Expect(inspection.PeakConcurrentSessions).To(Equal(1))
+		Expect(inspection.QueriesPerSecond).To(BeEmpty())
+	})
+
+	It("Counts the errors of the parsers it wraps", func() {
+		inspector := NewInspector(time.Minute, 10)
+		items, errs, done := inspector.Parser(ParseErrlog)(strings.NewReader(
+			`2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = '1'
+not a log line
+`))
+
+		go func() {
+			for range errs {
+				// drain
+			}
+		}()
+
+		inspection := inspector.Inspect(items)
+		Expect(<-done).NotTo(HaveOccurred())
+
+		Expect(inspection.UnmatchedParameters).To(Equal(1))
+		Expect(inspection.ParseErrors).To(Equal(2))
+	})
+
+	It("Renders a table", func() {
+		inspection := inspect(NewInspector(time.Minute, 10),
+			Statement{at("a", "alice", 0), "SELECT  *\n FROM logs", 0},
+		)
+
+		var output bytes.Buffer
+		Expect(inspection.WriteTable(&output)).To(Succeed())
+
+		Expect(output.String()).To(ContainSubstring("Peak concurrent sessions   1\n"))
+		Expect(output.String()).To(ContainSubstring("Statement  1\n"))
+		Expect(output.String()).To(ContainSubstring("select * from logs\n"))
+	})
+})
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"strconv"
+	"time"
 
 	kitlog "github.com/go-kit/log"
 	"github.com/gocardless/pgreplay-go/pkg/pgreplay"
@@ -91,6 +92,84 @@ var _ = Describe("pgreplay", func() {
 			matchLog("alice", "sees 0 of bob's logs"),
 		}),
 	)
+
+	It("Replays through a pool of connections", func() {
+		conn, err = pgx.Connect(ctx, pgreplay.ParseConnData(cfg))
+		Expect(err).NotTo(HaveOccurred(), "failed to connect to postgres")
+
+		_, err = conn.Exec(ctx, `TRUNCATE logs;`)
+		Expect(err).NotTo(HaveOccurred(), "failed to truncate logs table")
+
+		pooled := cfg
+		pooled.Pool = pgreplay.PoolConfig{Size: 1}
+
+		database, err := pgreplay.NewDatabase(ctx, pooled)
+		Expect(err).NotTo(HaveOccurred())
+
+		log, err := os.Open("testdata/single_user.log")
+		Expect(err).NotTo(HaveOccurred())
+
+		items, _, _ := pgreplay.ParseErrlog(log)
+		stream, err := pgreplay.NewStreamer(nil, nil, logger).Stream(items, 1.0)
+		Expect(err).NotTo(HaveOccurred())
+
+		errs, consumeDone := database.Consume(ctx, stream)
+		go func() {
+			defer GinkgoRecover()
+			for err := range errs {
+				logger.Log("event", "consume.error", "error", err)
+			}
+		}()
+
+		Eventually(consumeDone).Should(BeClosed())
+
+		logs, err := getLogs(ctx, conn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logs).To(HaveLen(4))
+	})
+
+	It("Deallocates through a pool on connections that never prepared the statement", func() {
+		pooled := cfg
+		pooled.Pool = pgreplay.PoolConfig{Size: 2}
+
+		database, err := pgreplay.NewDatabase(ctx, pooled)
+		Expect(err).NotTo(HaveOccurred())
+
+		began := time.Now()
+		at := func(session pgreplay.SessionID, step int) pgreplay.Details {
+			return pgreplay.Details{
+				Timestamp: began.Add(time.Duration(step) * 100 * time.Millisecond),
+				SessionID: session,
+				User:      cfg.User,
+				Database:  cfg.Database,
+			}
+		}
+
+		// Bob prepares on the pool's first connection and releases it, which alice then
+		// holds in her transaction, so bob deallocates on a second connection
+		items := make(chan pgreplay.Item, 10)
+		items <- pgreplay.Connect{Details: at("alice", 0)}
+		items <- pgreplay.Connect{Details: at("bob", 0)}
+		items <- pgreplay.Prepare{Details: at("bob", 1), Name: "logs_by_author", Query: "select * from logs where author = $1"}
+		items <- pgreplay.Statement{Details: at("alice", 2), Query: "BEGIN"}
+		items <- pgreplay.Deallocate{Details: at("bob", 3), Name: "logs_by_author"}
+		items <- pgreplay.Statement{Details: at("alice", 4), Query: "COMMIT"}
+		items <- pgreplay.Disconnect{Details: at("alice", 5)}
+		items <- pgreplay.Disconnect{Details: at("bob", 5)}
+		close(items)
+
+		stream, err := pgreplay.NewStreamer(nil, nil, logger).Stream(items, 1.0)
+		Expect(err).NotTo(HaveOccurred())
+
+		var consumeErrs []error
+		errs, consumeDone := database.Consume(ctx, stream)
+		for err := range errs {
+			consumeErrs = append(consumeErrs, err)
+		}
+
+		Eventually(consumeDone).Should(BeClosed())
+		Expect(consumeErrs).To(BeEmpty())
+	})
 })
 
 func tryEnviron(key, otherwise string) string {
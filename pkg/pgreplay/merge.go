@@ -0,0 +1,122 @@
+package pgreplay
+
+import (
+	"container/heap"
+	"time"
+)
+
+// MergeItems performs a k-way merge of several item streams into a single stream ordered
+// by timestamp. Each source must already be in chronological order, as is the case for
+// the output of every parser. We only ever hold the head item of each source in memory,
+// so merging many large files costs no more than parsing them one at a time.
+//
+// Items with equal timestamps are emitted in the order of their sources, which keeps
+// the merge stable when the sources are rotated files of the same log.
+func MergeItems(sources ...chan Item) chan Item {
+	if len(sources) == 1 {
+		return sources[0]
+	}
+
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		heads := make(itemHeap, 0, len(sources))
+		for idx, source := range sources {
+			if item, ok := nextItem(source); ok {
+				heads = append(heads, itemHead{item, idx})
+			}
+		}
+
+		heap.Init(&heads)
+
+		for heads.Len() > 0 {
+			head := heads[0]
+			out <- head.item
+
+			if item, ok := nextItem(sources[head.source]); ok {
+				heads[0].item = item
+				heap.Fix(&heads, 0)
+			} else {
+				heap.Pop(&heads)
+			}
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+// nextItem receives the next non-nil item from the source, as our parsers flush their
+// channels with nil values before closing them.
+func nextItem(source chan Item) (Item, bool) {
+	for item := range source {
+		if item != nil {
+			return item, true
+		}
+	}
+
+	return nil, false
+}
+
+type itemHead struct {
+	item   Item
+	source int
+}
+
+// itemHeap is a min-heap of the head item of each source, ordered by timestamp and then
+// by source index.
+type itemHeap []itemHead
+
+func (h itemHeap) Len() int      { return len(h) }
+func (h itemHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h itemHeap) Less(i, j int) bool {
+	ti, tj := h[i].item.GetTimestamp(), h[j].item.GetTimestamp()
+	if ti.Equal(tj) {
+		return h[i].source < h[j].source
+	}
+
+	return ti.Before(tj)
+}
+
+func (h *itemHeap) Push(x interface{}) { *h = append(*h, x.(itemHead)) }
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+
+	return item
+}
+
+// AdjustSource prepares the items of one source for merging with others. Session IDs are
+// prefixed with the namespace, so that sessions from different sources never collide, and
+// timestamps are shifted by the offset, so that logs from separate windows can be
+// overlaid.
+func AdjustSource(items chan Item, namespace string, offset time.Duration) chan Item {
+	if namespace == "" && offset == 0 {
+		return items
+	}
+
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			details := item.GetDetails()
+			details.Timestamp = details.Timestamp.Add(offset)
+			if namespace != "" {
+				details.SessionID = SessionID(namespace) + details.SessionID
+			}
+
+			out <- WithDetails(item, details)
+		}
+
+		close(out)
+	}()
+
+	return out
+}
@@ -0,0 +1,63 @@
+package pgreplay
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MergeItems", func() {
+	var (
+		at = func(seconds int, session SessionID) Item {
+			return Connect{Details{Timestamp: time20190225.Add(time.Duration(seconds) * time.Second), SessionID: session}}
+		}
+
+		source = func(items ...Item) chan Item {
+			out := make(chan Item, len(items)+1)
+			for _, item := range items {
+				out <- item
+			}
+
+			out <- nil // parsers flush their channels with nil values
+			close(out)
+
+			return out
+		}
+	)
+
+	It("Merges sources in timestamp order", func() {
+		merged := MergeItems(
+			source(at(0, "a"), at(3, "a"), at(5, "a")),
+			source(at(1, "b"), at(2, "b")),
+			source(),
+			source(at(3, "c"), at(4, "c")),
+		)
+
+		var sessions []SessionID
+		for item := range merged {
+			sessions = append(sessions, item.GetSessionID())
+		}
+
+		Expect(sessions).To(Equal([]SessionID{"a", "b", "b", "a", "c", "c", "a"}))
+	})
+
+	It("Overlays sources shifted by an offset, keeping their sessions apart", func() {
+		merged := MergeItems(
+			AdjustSource(source(at(0, "a"), at(2, "a")), "primary:", 0),
+			AdjustSource(source(at(86400, "a"), at(86403, "a")), "replica:", -24*time.Hour),
+		)
+
+		var items []Item
+		for item := range merged {
+			items = append(items, item)
+		}
+
+		Expect(items).To(Equal([]Item{
+			Connect{Details{Timestamp: time20190225, SessionID: "primary:a"}},
+			Connect{Details{Timestamp: time20190225, SessionID: "replica:a"}},
+			Connect{Details{Timestamp: time20190225.Add(2 * time.Second), SessionID: "primary:a"}},
+			Connect{Details{Timestamp: time20190225.Add(3 * time.Second), SessionID: "replica:a"}},
+		}))
+	})
+})
@@ -0,0 +1,253 @@
+package pgreplay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	logItems = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_log_items",
+			Help: "Number of items in the logs being replayed, according to their metadata",
+		},
+	)
+	logFirstTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_log_first_timestamp",
+			Help: "Timestamp of the first item in the logs being replayed, according to their metadata",
+		},
+	)
+	logLastTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_log_last_timestamp",
+			Help: "Timestamp of the last item in the logs being replayed, according to their metadata",
+		},
+	)
+)
+
+// JSONFormatVersion is the version of the JSON log format that we write. We can read
+// every version up to and including it, along with logs that predate the metadata
+// header, which we treat as the first version.
+const JSONFormatVersion = 1
+
+// MetadataLabel is the type of the metadata record that begins our JSON logs
+const MetadataLabel = "Metadata"
+
+// JSONMetadata describes how a JSON log was produced and what it holds. It's written as
+// the first line of the log, ahead of every item.
+type JSONMetadata struct {
+	FormatVersion   int      `json:"format_version"`
+	PgreplayVersion string   `json:"pgreplay_version"`
+	SourceFormat    string   `json:"source_format"`
+	SourceFiles     []string `json:"source_files,omitempty"`
+
+	// The --start and --finish that were applied, if any
+	Start  *time.Time `json:"start,omitempty"`
+	Finish *time.Time `json:"finish,omitempty"`
+
+	// Filters and transforms describe the options that changed the items, such as
+	// 'include user=alice' or 'transform-preset strip-transactions'
+	Filters    []string `json:"filters,omitempty"`
+	Transforms []string `json:"transforms,omitempty"`
+
+	// Everything below is tallied from the items as they're written
+	Items    int            `json:"items"`
+	Counts   map[string]int `json:"counts"`
+	Sessions int            `json:"sessions"`
+	First    *time.Time     `json:"first,omitempty"` // nil for empty logs
+	Last     *time.Time     `json:"last,omitempty"`
+	Checksum string         `json:"checksum"`
+}
+
+// Validate checks that we can read a log of this format version
+func (m JSONMetadata) Validate() error {
+	if m.FormatVersion < 1 {
+		return fmt.Errorf("invalid JSON log format version %d", m.FormatVersion)
+	}
+
+	if m.FormatVersion > JSONFormatVersion {
+		return fmt.Errorf(
+			"JSON log has format version %d, written by pgreplay %s, but we only support up to version %d",
+			m.FormatVersion, m.PgreplayVersion, JSONFormatVersion,
+		)
+	}
+
+	return nil
+}
+
+// WriteJSONLog writes the items as lines of JSON, beginning with a metadata header
+// completed from the given metadata. As the header summarises every item, we first write
+// the items to the spool, then copy them to the output after the header. The completed
+// metadata is returned.
+func WriteJSONLog(output io.Writer, spool io.ReadWriteSeeker, metadata JSONMetadata, items chan Item) (JSONMetadata, error) {
+	writer := newJSONLogWriter(spool, metadata)
+	for item := range items {
+		if err := writer.Write(item); err != nil {
+			return writer.metadata, err
+		}
+	}
+
+	return writer.Finish(output)
+}
+
+// jsonLogWriter spools items while tallying the metadata header that will precede them
+type jsonLogWriter struct {
+	spool    io.ReadWriteSeeker
+	metadata JSONMetadata
+	checksum hash.Hash
+	buffer   *bufio.Writer
+	sessions map[SessionID]struct{}
+}
+
+func newJSONLogWriter(spool io.ReadWriteSeeker, metadata JSONMetadata) *jsonLogWriter {
+	metadata.FormatVersion = JSONFormatVersion
+	metadata.Items, metadata.Counts = 0, map[string]int{}
+
+	checksum := sha256.New()
+
+	return &jsonLogWriter{
+		spool:    spool,
+		metadata: metadata,
+		checksum: checksum,
+		buffer:   bufio.NewWriter(io.MultiWriter(spool, checksum)),
+		sessions: map[SessionID]struct{}{},
+	}
+}
+
+func (w *jsonLogWriter) Write(item Item) error {
+	if item == nil {
+		return nil
+	}
+
+	bytes, err := ItemMarshalJSON(item)
+	if err != nil {
+		return err
+	}
+
+	if bytes == nil {
+		return nil // it's not important for us to serialize this
+	}
+
+	if _, err := w.buffer.Write(append(bytes, '\n')); err != nil {
+		return err
+	}
+
+	ts := item.GetTimestamp()
+	if w.metadata.Items == 0 {
+		w.metadata.First = &ts
+	}
+
+	w.metadata.Items++
+	w.metadata.Counts[ItemType(item)]++
+	w.metadata.Last = &ts
+	w.sessions[item.GetSessionID()] = struct{}{}
+
+	return nil
+}
+
+// Finish writes the completed header to the output, followed by the spooled items
+func (w *jsonLogWriter) Finish(output io.Writer) (JSONMetadata, error) {
+	metadata := w.metadata
+	if err := w.buffer.Flush(); err != nil {
+		return metadata, err
+	}
+
+	metadata.Sessions = len(w.sessions)
+	metadata.Checksum = "sha256:" + hex.EncodeToString(w.checksum.Sum(nil))
+
+	header, err := marshalJSONMetadata(metadata)
+	if err != nil {
+		return metadata, err
+	}
+
+	if _, err := output.Write(append(header, '\n')); err != nil {
+		return metadata, err
+	}
+
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return metadata, err
+	}
+
+	_, err = io.Copy(output, w.spool)
+	return metadata, err
+}
+
+// ReadJSONMetadata reads the metadata header from the start of a JSON log, returning nil
+// if the log predates them. Logs we can't read are rejected.
+func ReadJSONMetadata(input io.Reader) (*JSONMetadata, error) {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, InitialScannerBufferSize), MaxLogLineSize)
+
+	if !scanner.Scan() {
+		return nil, scanner.Err()
+	}
+
+	metadata, ok, err := parseJSONMetadata(scanner.Bytes())
+	if !ok || err != nil {
+		return nil, err
+	}
+
+	return &metadata, nil
+}
+
+// ObserveMetadata publishes the size and time range of the logs we're about to replay,
+// which gives a measure of our progress through them
+func ObserveMetadata(headers []JSONMetadata) {
+	var (
+		items       int
+		first, last *time.Time
+	)
+
+	for _, header := range headers {
+		items += header.Items
+		if header.First != nil && (first == nil || header.First.Before(*first)) {
+			first = header.First
+		}
+		if header.Last != nil && (last == nil || header.Last.After(*last)) {
+			last = header.Last
+		}
+	}
+
+	logItems.Set(float64(items))
+	if first != nil {
+		logFirstTimestamp.Set(float64(first.Unix()))
+		logLastTimestamp.Set(float64(last.Unix()))
+	}
+}
+
+func marshalJSONMetadata(metadata JSONMetadata) ([]byte, error) {
+	return json.Marshal(struct {
+		Type string       `json:"type"`
+		Item JSONMetadata `json:"item"`
+	}{MetadataLabel, metadata})
+}
+
+// parseJSONMetadata parses the line as a metadata header, reporting whether it was one.
+// Headers are valid only if we support their version.
+func parseJSONMetadata(line []byte) (metadata JSONMetadata, ok bool, err error) {
+	// Avoid decoding the first item of logs without a header
+	if !bytes.Contains(line, []byte(`"`+MetadataLabel+`"`)) {
+		return metadata, false, nil
+	}
+
+	envelope := struct {
+		Type string        `json:"type"`
+		Item *JSONMetadata `json:"item"`
+	}{Item: &metadata}
+
+	if err := json.Unmarshal(line, &envelope); err != nil || envelope.Type != MetadataLabel {
+		return metadata, false, nil
+	}
+
+	return metadata, true, metadata.Validate()
+}
@@ -0,0 +1,148 @@
+package pgreplay
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON metadata", func() {
+	var (
+		spool     *os.File
+		log       func() []byte
+		parseWith = func(parser ParserFunc, input []byte) ([]Item, error) {
+			items, _, done := parser(bytes.NewReader(input))
+
+			var result []Item
+			for item := range items {
+				result = append(result, item)
+			}
+
+			return result, <-done
+		}
+		parse = func(input []byte) ([]Item, error) {
+			return parseWith(ParseJSON, input)
+		}
+	)
+
+	BeforeEach(func() {
+		var err error
+		spool, err = os.CreateTemp("", "pgreplay-spool")
+		Expect(err).NotTo(HaveOccurred())
+
+		log = func() []byte {
+			in := make(chan Item, 10)
+			for idx, session := range []SessionID{"a", "b", "a"} {
+				details := Details{Timestamp: time20190225.Add(time.Duration(idx) * time.Second), SessionID: session}
+				in <- Statement{details, "select 1", 0}
+			}
+			in <- Disconnect{Details{Timestamp: time20190225.Add(3 * time.Second), SessionID: "a"}}
+			close(in)
+
+			var output bytes.Buffer
+			_, err := WriteJSONLog(&output, spool, JSONMetadata{PgreplayVersion: "dev", SourceFormat: "errlog"}, in)
+			Expect(err).NotTo(HaveOccurred())
+
+			return output.Bytes()
+		}
+	})
+
+	AfterEach(func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	})
+
+	It("Begins the log with a summary of its items", func() {
+		metadata, err := ReadJSONMetadata(bytes.NewReader(log()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metadata).NotTo(BeNil())
+
+		Expect(metadata.FormatVersion).To(Equal(JSONFormatVersion))
+		Expect(metadata.SourceFormat).To(Equal("errlog"))
+		Expect(metadata.Items).To(Equal(4))
+		Expect(metadata.Counts).To(Equal(map[string]int{StatementLabel: 3, DisconnectLabel: 1}))
+		Expect(metadata.Sessions).To(Equal(2))
+		Expect(*metadata.First).To(BeTemporally("==", time20190225))
+		Expect(*metadata.Last).To(BeTemporally("==", time20190225.Add(3*time.Second)))
+		Expect(metadata.Checksum).To(HavePrefix("sha256:"))
+	})
+
+	It("Parses the items that follow the header", func() {
+		items, err := parse(log())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(items).To(HaveLen(4))
+	})
+
+	It("Rejects logs whose items don't match their checksum once read", func() {
+		tampered := bytes.Replace(log(), []byte("select 1"), []byte("select 2"), 1)
+
+		items, err := parse(tampered)
+		Expect(err).To(MatchError(ContainSubstring("does not match its metadata")))
+		Expect(items).To(HaveLen(4))
+	})
+
+	It("Streams items before reaching the end of the log", func() {
+		lines := bytes.SplitAfter(log(), []byte("\n"))
+
+		reader, writer := io.Pipe()
+		defer writer.Close()
+
+		items, _, _ := ParseJSON(reader)
+		go writer.Write(bytes.Join(lines[:2], nil))
+
+		Eventually(items).Should(Receive(BeAssignableToTypeOf(&Statement{})))
+	})
+
+	It("Verifies checksums before emitting any items when asked", func() {
+		input := log()
+		tampered := bytes.Replace(input, []byte("select 1"), []byte("select 2"), 1)
+
+		items, err := parseWith(ParseVerifiedJSON, tampered)
+		Expect(err).To(MatchError(ContainSubstring("does not match its metadata")))
+		Expect(items).To(BeEmpty())
+
+		items, err = parseWith(ParseVerifiedJSON, input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(items).To(HaveLen(4))
+	})
+
+	It("Verifies logs that can't be seeked before parsing them", func() {
+		input := log()
+		items, _, done := ParseVerifiedJSON(io.MultiReader(bytes.NewReader(input)))
+		Eventually(items).Should(HaveLen(4))
+		Expect(<-done).To(Succeed())
+
+		tampered := bytes.Replace(input, []byte("select 1"), []byte("select 2"), 1)
+		items, _, done = ParseVerifiedJSON(io.MultiReader(bytes.NewReader(tampered)))
+		Eventually(items).Should(BeClosed())
+		Expect(<-done).To(MatchError(ContainSubstring("does not match its metadata")))
+	})
+
+	It("Rejects logs written in a newer format", func() {
+		newer := strings.Replace(string(log()), `"format_version":1`, `"format_version":2`, 1)
+
+		items, err := parse([]byte(newer))
+		Expect(err).To(MatchError(ContainSubstring("format version 2")))
+		Expect(items).To(BeEmpty())
+
+		_, err = ReadJSONMetadata(strings.NewReader(newer))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Reads logs without a header", func() {
+		input := []byte(`{"type":"Connect","item":{"timestamp":"2019-02-25T15:08:27.222Z","session_id":"a","user":"alice","database":"pgreplay_test"}}` + "\n")
+
+		metadata, err := ReadJSONMetadata(bytes.NewReader(input))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metadata).To(BeNil())
+
+		items, err := parse(input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(items).To(HaveLen(1))
+	})
+})
@@ -3,10 +3,16 @@ package pgreplay
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,37 +55,189 @@ const (
 type ParserFunc func(io.Reader) (items chan Item, errs chan error, done chan error)
 
 // ParseJSON operates on a file of JSON serialized Item elements, and pushes the parsed
-// items down the returned channel.
+// items down the returned channel. Logs beginning with a metadata header are rejected if
+// we don't support their version, and have their checksum verified once fully read.
 func ParseJSON(jsonlog io.Reader) (items chan Item, errs chan error, done chan error) {
+	return parseJSON(jsonlog, false)
+}
+
+// ParseVerifiedJSON is ParseJSON, but verifies the checksum of logs with a metadata header
+// before emitting any of their items. This means reading the log twice, so logs we can't
+// seek, such as stdin, are first copied to a temporary file.
+func ParseVerifiedJSON(jsonlog io.Reader) (items chan Item, errs chan error, done chan error) {
+	return parseJSON(jsonlog, true)
+}
+
+func parseJSON(jsonlog io.Reader, verify bool) (items chan Item, errs chan error, done chan error) {
 	items, errs, done = make(chan Item, ItemBufferSize), make(chan error), make(chan error)
 
 	go func() {
-		scanner := bufio.NewScanner(jsonlog)
-		scanner.Buffer(make([]byte, InitialScannerBufferSize), MaxLogLineSize)
+		var (
+			body    = jsonlog
+			cleanup = func() {}
+			err     error
+		)
+
+		if verify {
+			body, cleanup, err = verifyJSONLog(jsonlog)
+		}
+		defer cleanup()
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			item, err := ItemUnmarshalJSON([]byte(line))
-			if err != nil {
-				errs <- err
-			} else {
-				items <- item
-			}
+		if err == nil {
+			err = scanJSONLog(body, items, errs)
 		}
 
 		close(items)
 		close(errs)
 
-		done <- scanner.Err()
+		done <- err
 		close(done)
 	}()
 
 	return
 }
 
+// scanJSONLog sends each item of the log down the channel, verifying the checksum of any
+// metadata header once we've read every line it covers.
+func scanJSONLog(jsonlog io.Reader, items chan Item, errs chan error) error {
+	scanner := bufio.NewScanner(jsonlog)
+	scanner.Buffer(make([]byte, InitialScannerBufferSize), MaxLogLineSize)
+
+	var (
+		header   *JSONMetadata
+		checksum hash.Hash
+	)
+
+	for lines := 0; scanner.Scan(); lines++ {
+		line := scanner.Bytes()
+
+		// Logs may begin with a metadata header, whose checksum covers every line that
+		// follows it
+		if lines == 0 {
+			metadata, ok, err := parseJSONMetadata(line)
+			if err != nil {
+				return err
+			}
+			if ok {
+				header, checksum = &metadata, sha256.New()
+				continue
+			}
+		}
+
+		if checksum != nil {
+			checksum.Write(line)
+			checksum.Write([]byte{'\n'})
+		}
+
+		item, err := ItemUnmarshalJSON(line)
+		if err != nil {
+			errs <- err
+		} else {
+			items <- item
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if header != nil {
+		if sum := "sha256:" + hex.EncodeToString(checksum.Sum(nil)); sum != header.Checksum {
+			return fmt.Errorf("JSON log checksum %s does not match its metadata, %s", sum, header.Checksum)
+		}
+	}
+
+	return nil
+}
+
+// verifyJSONLog returns the items of a JSON log, after its metadata header if it has one.
+// The checksum of the header covers every line that follows it, so we read them all to
+// verify it before returning, leaving a body that scanJSONLog won't verify again. Logs we can seek are read twice, and the rest are spooled
+// to a temporary file, which cleanup removes whether or not we succeed.
+func verifyJSONLog(jsonlog io.Reader) (body io.Reader, cleanup func(), err error) {
+	cleanup = func() {}
+
+	var start int64
+	seeker, _ := jsonlog.(io.ReadSeeker)
+	if seeker != nil {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	reader := bufio.NewReader(jsonlog)
+	first, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, cleanup, err
+	}
+
+	metadata, ok, err := parseJSONMetadata(bytes.TrimRight(first, "\r\n"))
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	if !ok {
+		return io.MultiReader(bytes.NewReader(first), reader), cleanup, nil
+	}
+
+	checksum := sha256.New()
+	if seeker != nil {
+		if _, err := io.Copy(checksum, reader); err != nil {
+			return nil, cleanup, err
+		}
+
+		if _, err := seeker.Seek(start+int64(len(first)), io.SeekStart); err != nil {
+			return nil, cleanup, err
+		}
+
+		body = seeker
+	} else {
+		spool, err := os.CreateTemp("", ".pgreplay-spool-*")
+		if err != nil {
+			return nil, cleanup, err
+		}
+
+		cleanup = func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+
+		if _, err := io.Copy(io.MultiWriter(spool, checksum), reader); err != nil {
+			return nil, cleanup, err
+		}
+
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return nil, cleanup, err
+		}
+
+		body = spool
+	}
+
+	if sum := "sha256:" + hex.EncodeToString(checksum.Sum(nil)); sum != metadata.Checksum {
+		return nil, cleanup, fmt.Errorf("JSON log checksum %s does not match its metadata, %s", sum, metadata.Checksum)
+	}
+
+	return body, cleanup, nil
+}
+
+// ParseCsvLog generates a stream of Items from a PostgreSQL csvlog, detecting the layout
+// of each line from its number of columns.
 func ParseCsvLog(csvlog io.Reader) (items chan Item, errs chan error, done chan error) {
+	return parseCsvLog(csvlog, nil)
+}
+
+// NewCsvLogParser builds a ParserFunc for csvlogs that must all have the given layout,
+// rejecting lines that don't instead of relying on detection.
+func NewCsvLogParser(layout CsvLogLayout) ParserFunc {
+	return func(csvlog io.Reader) (items chan Item, errs chan error, done chan error) {
+		return parseCsvLog(csvlog, &layout)
+	}
+}
+
+func parseCsvLog(csvlog io.Reader, layout *CsvLogLayout) (items chan Item, errs chan error, done chan error) {
 	reader := csv.NewReader(csvlog)
-	unbounds := map[SessionID]*Execute{}
+	reader.FieldsPerRecord = -1 // each line is checked against its layout
+	unbounds, durations := map[SessionID]*Unbound{}, newDurationTracker()
 	parsebuffer := make([]byte, MaxLogLineSize)
 	items, errs, done = make(chan Item, ItemBufferSize), make(chan error), make(chan error)
 
@@ -92,19 +250,25 @@ func ParseCsvLog(csvlog io.Reader) (items chan Item, errs chan error, done chan
 			if err != nil {
 				logLinesErrorTotal.Inc()
 				errs <- err
+				continue
 			}
-			item, err := ParseCsvItem(logline, unbounds, parsebuffer)
+			item, err := ParseCsvItem(logline, layout, unbounds, parsebuffer)
 			if err != nil {
 				logLinesErrorTotal.Inc()
 				errs <- err
 			}
 
-			if item != nil {
+			for _, item := range durations.track(item) {
 				logLinesParsedTotal.Inc()
 				items <- item
 			}
 		}
 
+		for _, item := range durations.flush() {
+			logLinesParsedTotal.Inc()
+			items <- item
+		}
+
 		// Flush the item channel by pushing nil values up-to capacity
 		for i := 0; i < ItemBufferSize; i++ {
 			items <- nil
@@ -118,11 +282,84 @@ func ParseCsvLog(csvlog io.Reader) (items chan Item, errs chan error, done chan
 	return
 }
 
+// ParseJsonLog generates a stream of Items from a PostgreSQL jsonlog, the format produced
+// by log_destination = 'jsonlog' since PostgreSQL 15. Each line is a JSON object holding
+// a single log entry.
+func ParseJsonLog(jsonlog io.Reader) (items chan Item, errs chan error, done chan error) {
+	unbounds, durations := map[SessionID]*Unbound{}, newDurationTracker()
+	parsebuffer := make([]byte, MaxLogLineSize)
+	scanner := bufio.NewScanner(jsonlog)
+	scanner.Buffer(make([]byte, InitialScannerBufferSize), MaxLogLineSize)
+
+	items, errs, done = make(chan Item, ItemBufferSize), make(chan error), make(chan error)
+
+	go func() {
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			item, err := ParseJsonLogItem(line, unbounds, parsebuffer)
+			if err != nil {
+				logLinesErrorTotal.Inc()
+				errs <- err
+			}
+
+			for _, item := range durations.track(item) {
+				logLinesParsedTotal.Inc()
+				items <- item
+			}
+		}
+
+		for _, item := range durations.flush() {
+			logLinesParsedTotal.Inc()
+			items <- item
+		}
+
+		// Flush the item channel by pushing nil values up-to capacity
+		for i := 0; i < ItemBufferSize; i++ {
+			items <- nil
+		}
+
+		close(items)
+		close(errs)
+
+		done <- scanner.Err()
+		close(done)
+	}()
+
+	return
+}
+
 // ParseErrlog generates a stream of Items from the given PostgreSQL errlog. Log line
 // parsing errors are returned down the errs channel, and we signal having finished our
 // parsing by sending a value down the done channel.
 func ParseErrlog(errlog io.Reader) (items chan Item, errs chan error, done chan error) {
-	unbounds := map[SessionID]*Execute{}
+	return parseErrlog(errlog, ParseItem)
+}
+
+// NewErrlogParser builds a ParserFunc for errlogs written with the given log_line_prefix.
+// The default prefix is handled by ParseErrlog, which avoids the cost of matching every
+// line against a regular expression.
+func NewErrlogParser(prefix *LogLinePrefix) ParserFunc {
+	if prefix.String() == DefaultLogLinePrefix {
+		return ParseErrlog
+	}
+
+	return func(errlog io.Reader) (items chan Item, errs chan error, done chan error) {
+		pids := map[string]SessionID{}
+
+		return parseErrlog(errlog, func(logline string, unbounds map[SessionID]*Unbound, buffer []byte) (Item, error) {
+			return ParsePrefixedItem(logline, prefix, pids, unbounds, buffer)
+		})
+	}
+}
+
+type errlogItemParser func(logline string, unbounds map[SessionID]*Unbound, buffer []byte) (Item, error)
+
+func parseErrlog(errlog io.Reader, parseItem errlogItemParser) (items chan Item, errs chan error, done chan error) {
+	unbounds, durations := map[SessionID]*Unbound{}, newDurationTracker()
 	loglinebuffer, parsebuffer := make([]byte, MaxLogLineSize), make([]byte, MaxLogLineSize)
 	scanner := NewLogScanner(errlog, loglinebuffer)
 
@@ -130,18 +367,23 @@ func ParseErrlog(errlog io.Reader) (items chan Item, errs chan error, done chan
 
 	go func() {
 		for scanner.Scan() {
-			item, err := ParseItem(scanner.Text(), unbounds, parsebuffer)
+			item, err := parseItem(scanner.Text(), unbounds, parsebuffer)
 			if err != nil {
 				logLinesErrorTotal.Inc()
 				errs <- err
 			}
 
-			if item != nil {
+			for _, item := range durations.track(item) {
 				logLinesParsedTotal.Inc()
 				items <- item
 			}
 		}
 
+		for _, item := range durations.flush() {
+			logLinesParsedTotal.Inc()
+			items <- item
+		}
+
 		// Flush the item channel by pushing nil values up-to capacity
 		for i := 0; i < ItemBufferSize; i++ {
 			items <- nil
@@ -157,10 +399,15 @@ func ParseErrlog(errlog io.Reader) (items chan Item, errs chan error, done chan
 	return
 }
 
+// ErrUnmatchedParameters is returned for a DETAIL of bind parameters that doesn't follow
+// an execute of the same session.
+var ErrUnmatchedParameters = errors.New("cannot process bind parameters without previous execute item")
+
 const (
 	// File Type Conversion
-	ParsedFromCsv    = "csv"
-	ParsedFromErrLog = "errlog"
+	ParsedFromCsv     = "csv"
+	ParsedFromErrLog  = "errlog"
+	ParsedFromJsonLog = "jsonlog"
 	// Log Detail Message
 	ActionLog    = "LOG:  "
 	ActionDetail = "DETAIL:  "
@@ -182,7 +429,7 @@ var (
 	}
 	LogStatement = LogMessage{
 		ActionLog, "statement: ",
-		regexp.MustCompile(`^.*statement\: `),
+		regexp.MustCompile(`^(?:duration\: \d+\.\d+ ms  )?statement\: `),
 	}
 	LogDuration = LogMessage{
 		ActionLog, "duration: ",
@@ -190,7 +437,7 @@ var (
 	}
 	LogExtendedProtocolExecute = LogMessage{
 		ActionLog, "execute <unnamed>: ",
-		regexp.MustCompile(`^.*execute <unnamed>\: `),
+		regexp.MustCompile(`^(?:duration\: \d+\.\d+ ms  )?execute <unnamed>(?:/\S+)?\: `),
 	}
 	LogExtendedProtocolParameters = LogMessage{
 		ActionDetail, "parameters: ",
@@ -198,16 +445,44 @@ var (
 	}
 	LogNamedPrepareExecute = LogMessage{
 		ActionLog, "execute ",
-		regexp.MustCompile(`^.*execute (\w+)\: `),
+		regexp.MustCompile(`^(?:duration\: \d+\.\d+ ms  )?execute ([^\s/]+?)(?:/\S+)?\: `),
+	}
+	LogNamedPrepareParse = LogMessage{
+		ActionLog, "parse ",
+		regexp.MustCompile(`^(?:duration\: \d+\.\d+ ms  )?parse (\S+?)\: `),
+	}
+	LogNamedPrepareBind = LogMessage{
+		ActionLog, "bind ",
+		regexp.MustCompile(`^duration\: \d+\.\d+ ms  bind (\S+?)\: `),
 	}
 	LogError  = LogMessage{ActionError, "", regexp.MustCompile(`^ERROR\: .+`)}
 	LogDetail = LogMessage{ActionDetail, "", regexp.MustCompile(`^DETAIL\: .+`)}
+
+	// Statements that release prepared statements, which we need to replay as their own
+	// items so each connection can keep track of what it has prepared.
+	deallocateStatement = regexp.MustCompile(`(?i)^\s*DEALLOCATE\s+(?:PREPARE\s+)?("(?:[^"]|"")+"|\w+)\s*;?\s*$`)
+	discardAllStatement = regexp.MustCompile(`(?i)^\s*DISCARD\s+ALL\s*;?\s*$`)
+
+	// Queries that take bind parameters, for which Postgres follows the execute log with a
+	// DETAIL of the parameter values.
+	bindPlaceholder = regexp.MustCompile(`\$\d+`)
 )
 
 // ParseCsvItem constructs a Item from a CSV log line. The format we accept is log_destination='csvlog'.
-func ParseCsvItem(logline []string, unbounds map[SessionID]*Execute, buffer []byte) (Item, error) {
-	if len(logline) < 15 {
-		return nil, fmt.Errorf("failed to parse log line: '%s'", logline)
+// Lines must match the given layout, or when nil, the layout is detected from the line.
+func ParseCsvItem(logline []string, layout *CsvLogLayout, unbounds map[SessionID]*Unbound, buffer []byte) (Item, error) {
+	if layout == nil {
+		detected, err := DetectCsvLogLayout(len(logline))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse log line: %v: '%s'", err, logline)
+		}
+
+		layout = &detected
+	} else if len(logline) != layout.Columns {
+		return nil, fmt.Errorf(
+			"failed to parse log line: expected %d columns for PostgreSQL %d csvlog, found %d: '%s'",
+			layout.Columns, layout.Version, len(logline), logline,
+		)
 	}
 
 	ts, err := time.Parse(PostgresTimestampFormat, logline[0])
@@ -220,26 +495,91 @@ func ParseCsvItem(logline []string, unbounds map[SessionID]*Execute, buffer []by
 
 	extractedLog := ExtractedLog{
 		Details: Details{
-			Timestamp: ts,
-			SessionID: SessionID(session),
-			User:      user,
-			Database:  database,
+			Timestamp:       ts,
+			SessionID:       SessionID(session),
+			User:            user,
+			Database:        database,
+			ApplicationName: layout.column(logline, layout.ApplicationName),
+			ClientAddr:      clientHost(logline[4]),
+			BackendPID:      parseOptionalInt(logline[3]),
+			VirtualXID:      logline[9],
+			TransactionID:   parseOptionalUint(logline[10]),
+			QueryID:         parseOptionalInt64(layout.column(logline, layout.QueryID)),
 		},
-		ActionLog:  actionLog,
-		Message:    msg,
-		Parameters: params,
+		ActionLog:   actionLog,
+		Message:     msg,
+		Parameters:  params,
+		BackendType: layout.column(logline, layout.BackendType),
 	}
 
 	return parseDetailToItem(extractedLog, ParsedFromCsv, unbounds, buffer)
 }
 
+// JsonLogLine is a single entry of a PostgreSQL jsonlog. Postgres omits keys whose values
+// are empty, so every field is optional.
+type JsonLogLine struct {
+	Timestamp     string `json:"timestamp"`
+	User          string `json:"user"`
+	Database      string `json:"dbname"`
+	SessionID     string `json:"session_id"`
+	ErrorSeverity string `json:"error_severity"`
+	Message       string `json:"message"`
+	Detail        string `json:"detail"`
+
+	ApplicationName string `json:"application_name"`
+	BackendType     string `json:"backend_type"`
+	RemoteHost      string `json:"remote_host"`
+	PID             int    `json:"pid"`
+	VirtualXID      string `json:"vxid"`
+	TransactionID   uint64 `json:"txid"`
+	QueryID         int64  `json:"query_id"`
+}
+
+// ParseJsonLogItem constructs a Item from a jsonlog line. The format we accept is
+// log_destination='jsonlog'.
+func ParseJsonLogItem(logline []byte, unbounds map[SessionID]*Unbound, buffer []byte) (Item, error) {
+	var entry JsonLogLine
+	if err := json.Unmarshal(logline, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse log line: '%s': %v", logline, err)
+	}
+
+	ts, err := time.Parse(PostgresTimestampFormat, entry.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse log timestamp: '%s': %v", entry.Timestamp, err)
+	}
+
+	// {"timestamp":"2023-06-09 01:50:01.825 UTC","user":"postgres","dbname":"postgres",
+	//  "session_id":"64828549.7698","error_severity":"LOG","message":<msg>,"detail":<params>}
+	extractedLog := ExtractedLog{
+		Details: Details{
+			Timestamp:       ts,
+			SessionID:       SessionID(entry.SessionID),
+			User:            entry.User,
+			Database:        entry.Database,
+			ApplicationName: entry.ApplicationName,
+			ClientAddr:      entry.RemoteHost,
+			BackendPID:      entry.PID,
+			VirtualXID:      entry.VirtualXID,
+			TransactionID:   entry.TransactionID,
+			QueryID:         entry.QueryID,
+		},
+		ActionLog:   entry.ErrorSeverity,
+		Message:     entry.Message,
+		Parameters:  entry.Detail,
+		BackendType: entry.BackendType,
+	}
+
+	return parseDetailToItem(extractedLog, ParsedFromJsonLog, unbounds, buffer)
+}
+
 // ParseItem constructs a Item from Postgres errlogs. The format we accept is
-// log_line_prefix='%m|%u|%d|%c|', so we can split by | to discover each component.
+// log_line_prefix='%m|%u|%d|%c|', so we can split by | to discover each component. Logs
+// written with any other prefix should be parsed with ParsePrefixedItem.
 //
 // The unbounds map allows retrieval of an Execute that was previously parsed for a
 // session, as we expect following log lines to complete the Execute with the parameters
-// it should use.
-func ParseItem(logline string, unbounds map[SessionID]*Execute, buffer []byte) (Item, error) {
+// it should use. A nil entry marks a session whose bind parameters are about to be logged.
+func ParseItem(logline string, unbounds map[SessionID]*Unbound, buffer []byte) (Item, error) {
 	tokens := strings.SplitN(logline, "|", 5)
 	if len(tokens) != 5 {
 		return nil, fmt.Errorf("failed to parse log line: '%s'", logline)
@@ -268,23 +608,108 @@ func ParseItem(logline string, unbounds map[SessionID]*Execute, buffer []byte) (
 	return parseDetailToItem(extractedLog, ParsedFromErrLog, unbounds, buffer)
 }
 
-func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionID]*Execute, buff []byte) (Item, error) {
+// ParsePrefixedItem constructs a Item from Postgres errlogs written with an arbitrary
+// log_line_prefix, such as the pgBadger recommended '%t [%p]: [%l-1] user=%u,db=%d '.
+//
+// When the prefix lacks a session ID (%c) we derive one from the process ID, using the
+// session start time (%s) if present. Otherwise the pids map tracks the session of each
+// process, starting a new session whenever a connection is received so that process IDs
+// reused by the operating system are not mistaken for the previous connection.
+func ParsePrefixedItem(logline string, prefix *LogLinePrefix, pids map[string]SessionID, unbounds map[SessionID]*Unbound, buffer []byte) (Item, error) {
+	fields, msg, err := prefix.Match(logline)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := fields.Timestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse log timestamp: '%s': %v", logline, err)
+	}
+
+	session, err := prefixedSessionID(fields, ts, msg, pids)
+	if err != nil {
+		return nil, err
+	}
+
+	extractedLog := ExtractedLog{
+		Details: Details{
+			Timestamp:       ts,
+			SessionID:       session,
+			User:            fields['u'],
+			Database:        fields['d'],
+			ApplicationName: fields['a'],
+			ClientAddr:      fields.ClientAddr(),
+			BackendPID:      parseOptionalInt(fields['p']),
+			VirtualXID:      fields['v'],
+			TransactionID:   parseOptionalUint(fields['x']),
+			QueryID:         parseOptionalInt64(fields['Q']),
+		},
+		ActionLog:   "",
+		Message:     msg,
+		Parameters:  "",
+		BackendType: fields['b'],
+	}
+
+	return parseDetailToItem(extractedLog, ParsedFromErrLog, unbounds, buffer)
+}
+
+func prefixedSessionID(fields PrefixFields, ts time.Time, msg string, pids map[string]SessionID) (SessionID, error) {
+	if session, ok := fields['c']; ok {
+		return SessionID(session), nil
+	}
+
+	pid := fields['p']
+
+	if sessionStart, ok := fields['s']; ok {
+		start, err := parsePrefixTimestamp(PostgresTimestampSecondsFormat, sessionStart)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse session start: '%s': %v", sessionStart, err)
+		}
+
+		return sessionFromPID(start, pid)
+	}
+
+	session, ok := pids[pid]
+	if !ok || LogConnectionReceived.Match(msg, ParsedFromErrLog) {
+		var err error
+		if session, err = sessionFromPID(ts, pid); err != nil {
+			return "", err
+		}
+
+		pids[pid] = session
+	}
+
+	if LogConnectionDisconnect.Match(msg, ParsedFromErrLog) {
+		delete(pids, pid)
+	}
+
+	return session, nil
+}
+
+func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionID]*Unbound, buff []byte) (Item, error) {
+	// Messages that are prefixed with 'duration: X ms' tell us how long the statement took
+	// to run, which we record as the baseline for the replay.
+	duration := parseLoggedDuration(el.Message)
+
 	// LOG:  duration: 0.043 ms
-	// Duration logs mark completion of replay items, and are not of interest for
-	// reproducing traffic. We should only take an action if there exists an unbound item
-	// for this session, as this log line will confirm the unbound query has no parameters.
+	// Duration logs mark completion of replay items. If there exists an unbound item for
+	// this session then this log line confirms the unbound query has no parameters,
+	// otherwise the duration belongs to the statement the session last logged.
 	if LogDuration.Match(el.Message, parsedFrom) {
-		if unbound, ok := unbounds[el.SessionID]; ok {
+		if unbound, ok := unbounds[el.SessionID]; ok && unbound != nil {
 			delete(unbounds, el.SessionID)
-			return unbound.Bind(nil), nil
+			return WithOriginalDuration(unbound.Bind(nil), duration), nil
 		}
 
-		return nil, nil
+		return durationLog{el.Details, duration}, nil
 	}
 
 	// LOG:  statement: select pg_reload_conf();
+	// LOG:  duration: 0.123 ms  statement: select pg_reload_conf();
+	// Clusters with log_min_duration_statement but not log_statement log the statement
+	// alongside its duration, once it has completed.
 	if LogStatement.Match(el.Message, parsedFrom) {
-		return Statement{el.Details, LogStatement.RenderQuery(el.Message, parsedFrom)}, nil
+		return parseStatement(el.Details, LogStatement.RenderStatement(el.Message, parsedFrom), duration), nil
 	}
 
 	// LOG:  execute <unnamed>: select pg_sleep($1)
@@ -292,45 +717,80 @@ func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionI
 	// even queries that don't have any arguments will be sent as an unamed prepared
 	// statement. We need to wait for a following DETAIL or duration log to confirm the
 	// statement has been executed.
+	//
+	// LOG:  duration: 0.2 ms  execute <unnamed>: select pg_sleep($1)
+	// When logged with its duration the execute has already completed, and Postgres only
+	// follows it with a DETAIL if the query takes parameters.
 	if LogExtendedProtocolExecute.Match(el.Message, parsedFrom) {
-		query := LogExtendedProtocolExecute.RenderQuery(el.Message, parsedFrom)
+		query := LogExtendedProtocolExecute.RenderStatement(el.Message, parsedFrom)
 
-		if parsedFrom == ParsedFromCsv {
+		if isStructuredLog(parsedFrom) {
 			params, err := ParseBindParameters(LogExtendedProtocolParameters.RenderQuery(el.Parameters, parsedFrom), buff)
 			if err != nil {
 				return nil, fmt.Errorf("[UnNamedExecute]: failed to parse bind parameters: %s", err.Error())
 			}
 
-			return Execute{el.Details, query}.Bind(params), nil
+			return Execute{el.Details, query, duration}.Bind(params), nil
 		}
 
-		unbounds[el.SessionID] = &Execute{el.Details, query}
+		if completedWithoutParameters(query, duration) {
+			return Execute{el.Details, query, duration}.Bind(nil), nil
+		}
+
+		unbounds[el.SessionID] = &Unbound{Execute{el.Details, query, duration}, ""}
 
 		return nil, nil
 	}
 
 	// LOG:  execute name: select pg_sleep($1)
+	// LOG:  execute name/portal: select pg_sleep($1)
+	// Executes of named prepared statements are replayed by name, preparing the statement
+	// on the connection the first time we see it. Postgres names the portal too when it
+	// isn't the unnamed portal, such as when a client fetches the rows in batches.
 	if LogNamedPrepareExecute.Match(el.Message, parsedFrom) {
-		if parsedFrom == ParsedFromCsv {
-			query := LogNamedPrepareExecute.RenderQuery(el.Message, parsedFrom)
+		name := LogNamedPrepareExecute.Capture(el.Message, parsedFrom)
+		query := LogNamedPrepareExecute.RenderStatement(el.Message, parsedFrom)
+
+		if isStructuredLog(parsedFrom) {
 			params, err := ParseBindParameters(LogExtendedProtocolParameters.RenderQuery(el.Parameters, parsedFrom), buff)
 			if err != nil {
 				return nil, fmt.Errorf("[NamedExecute]: failed to parse bind parameters: %s", err.Error())
 			}
 
-			return Execute{el.Details, query}.Bind(params), nil
+			return Unbound{Execute{el.Details, query, duration}, name}.Bind(params), nil
 		}
 
-		query := strings.SplitN(
-			LogNamedPrepareExecute.RenderQuery(el.Message, parsedFrom), ":", 2,
-		)[1]
+		if completedWithoutParameters(query, duration) {
+			return Unbound{Execute{el.Details, query, duration}, name}.Bind(nil), nil
+		}
 
-		// TODO: This doesn't exactly replicate what we'd expect from named prepares. Instead
-		// of creating a genuine named prepare, we implement them as unnamed prepared
-		// statements instead. If this parse signature allowed us to return arbitrary items
-		// then we'd be able to create an initial prepare statement followed by a matching
-		// execute, but we can hold off doing this until it becomes a problem.
-		unbounds[el.SessionID] = &Execute{el.Details, query}
+		unbounds[el.SessionID] = &Unbound{Execute{el.Details, query, duration}, name}
+
+		return nil, nil
+	}
+
+	// LOG:  duration: 0.088 ms  parse name: select pg_sleep($1)
+	// Parses are only logged when log_min_duration_statement is enabled, and let us prepare
+	// the named statement at the same point it was prepared in production. Parsing the
+	// unnamed statement is implied by the execute that follows, so we ignore it.
+	if LogNamedPrepareParse.Match(el.Message, parsedFrom) {
+		name := LogNamedPrepareParse.Capture(el.Message, parsedFrom)
+		if name == "<unnamed>" {
+			return nil, nil
+		}
+
+		return Prepare{el.Details, name, LogNamedPrepareParse.RenderStatement(el.Message, parsedFrom), nil}, nil
+	}
+
+	// LOG:  duration: 0.031 ms  bind name: select pg_sleep($1)
+	// DETAIL:  parameters: $1 = '1'
+	// Binds are only logged alongside their duration, and are always followed by the
+	// execute that we replay. Errlogs follow binds that take parameters with a DETAIL of
+	// them, which we mark the session to ignore, as the execute logs the same parameters.
+	if LogNamedPrepareBind.Match(el.Message, parsedFrom) {
+		if !isStructuredLog(parsedFrom) && bindPlaceholder.MatchString(LogNamedPrepareBind.RenderStatement(el.Message, parsedFrom)) {
+			unbounds[el.SessionID] = nil
+		}
 
 		return nil, nil
 	}
@@ -338,29 +798,20 @@ func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionI
 	// DETAIL:  parameters: $1 = '1', $2 = NULL
 	if LogExtendedProtocolParameters.Match(el.Message, parsedFrom) {
 		if unbound, ok := unbounds[el.SessionID]; ok {
+			delete(unbounds, el.SessionID)
+			if unbound == nil {
+				return nil, nil // the parameters of a bind, which its execute logs again
+			}
+
 			parameters, err := ParseBindParameters(LogExtendedProtocolParameters.RenderQuery(el.Message, parsedFrom), buff)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse bind parameters: %s", err.Error())
 			}
 
-			// Remove the unbound from our cache and bind it
-			delete(unbounds, el.SessionID)
 			return unbound.Bind(parameters), nil
 		}
 
-		// It's quite normal for us to get here, as Postgres will log the following when
-		// log_min_duration_statement = 0:
-		//
-		//   1. LOG:  duration: 0.XXX ms  parse name: <statement>
-		//   2. LOG:  duration: 0.XXX ms  bind name: <statement>
-		//   3. DETAIL:  parameters: $1 = '<param>', $2 = '<param>', ...
-		//   4. LOG:  execute name: <statement>
-		//   5. DETAIL:  parameters: $1 = '<param>', $2 = '<param>', ...
-		//
-		// The 3rd and 5th entry are the same, but we expect to be matching our detail against
-		// a prior execute log-line. This is just an artifact of Postgres extended query
-		// protocol and the activation of two logging systems which duplicate the same entry.
-		return nil, fmt.Errorf("cannot process bind parameters without previous execute item: %s", el.Message)
+		return nil, fmt.Errorf("%w: %s", ErrUnmatchedParameters, el.Message)
 	}
 
 	// LOG:  connection authorized: user=postgres database=postgres
@@ -396,6 +847,70 @@ func parseDetailToItem(el ExtractedLog, parsedFrom string, unbounds map[SessionI
 	return nil, fmt.Errorf("no parser matches line: %s", el.Message)
 }
 
+// parseStatement produces the item for a simple query statement. Statements that release
+// prepared statements are replayed as Deallocate or DiscardAll items, so that each
+// connection can keep track of the statements it has prepared.
+func parseStatement(details Details, query string, duration time.Duration) Item {
+	if matches := deallocateStatement.FindStringSubmatch(query); matches != nil {
+		name := matches[1]
+		if strings.EqualFold(name, "all") {
+			name = ""
+		} else if strings.HasPrefix(name, `"`) {
+			name = strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+		}
+
+		return Deallocate{details, name}
+	}
+
+	if discardAllStatement.MatchString(query) {
+		return DiscardAll{details}
+	}
+
+	return Statement{details, query, duration}
+}
+
+// completedWithoutParameters reports whether an execute logged alongside its duration
+// will not be followed by a DETAIL of parameters, as its query takes none.
+func completedWithoutParameters(query string, duration time.Duration) bool {
+	return duration > 0 && !bindPlaceholder.MatchString(query)
+}
+
+// clientHost strips the port from a logged client address, such as the host:port of the
+// csvlog connection_from column. Unix socket connections are logged as [local].
+func clientHost(addr string) string {
+	if idx := strings.LastIndexByte(addr, ':'); idx >= 0 {
+		if _, err := strconv.Atoi(addr[idx+1:]); err == nil {
+			return addr[:idx]
+		}
+	}
+
+	return addr
+}
+
+// parseOptionalInt and friends parse the numeric details that logs may leave empty. The
+// details aren't needed for replay, so anything we can't parse is left as zero.
+func parseOptionalInt(value string) int {
+	parsed, _ := strconv.Atoi(value)
+	return parsed
+}
+
+func parseOptionalUint(value string) uint64 {
+	parsed, _ := strconv.ParseUint(value, 10, 64)
+	return parsed
+}
+
+func parseOptionalInt64(value string) int64 {
+	parsed, _ := strconv.ParseInt(value, 10, 64)
+	return parsed
+}
+
+// isStructuredLog reports whether the log format carries the message and its DETAIL in
+// separate fields of the same record, as csvlog and jsonlog do. Structured logs never
+// need to wait for a following line to bind an execute.
+func isStructuredLog(parsedFrom string) bool {
+	return parsedFrom == ParsedFromCsv || parsedFrom == ParsedFromJsonLog
+}
+
 // ParseBindParameters constructs an interface slice from the suffix of a DETAIL parameter
 // Postgres errlog. An example input to this function would be:
 //
@@ -65,43 +65,64 @@ var _ = Describe("ParseCsvLog", func() {
 			[]Item{
 				Connect{
 					Details{
-						Timestamp: time20190225,
-						SessionID: "6480e39e.1c73",
-						User:      "postgres",
-						Database:  "postgres",
+						Timestamp:  time20190225,
+						SessionID:  "6480e39e.1c73",
+						User:       "postgres",
+						Database:   "postgres",
+						ClientAddr: "199.167.158.43",
+						BackendPID: 7283,
+						VirtualXID: "4/286618",
 					},
 				},
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "65391eda.666f",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:       time20190225,
+							SessionID:       "65391eda.666f",
+							User:            "postgres",
+							Database:        "postgres",
+							ApplicationName: "puma: [app]",
+							ClientAddr:      "172.31.237.67",
+							BackendPID:      26223,
+							VirtualXID:      "706/2676024",
+							QueryID:         5774081526858323261,
 						},
-						Query: "SELECT 1 AS one FROM \"mural_files\" WHERE (\"mural_files\".\"mural_id\" = $1) AND (\"mural_files\".\"embedded\" = $2) LIMIT $3",
+						Query:            "SELECT 1 AS one FROM \"mural_files\" WHERE (\"mural_files\".\"mural_id\" = $1) AND (\"mural_files\".\"embedded\" = $2) LIMIT $3",
+						OriginalDuration: 29 * time.Microsecond,
 					},
 					Parameters: []interface{}{"1072", "f", "1"},
 				},
-				BoundExecute{
-					Execute: Execute{
-						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "6539311d.13d9",
-							User:      "postgres",
-							Database:  "postgres",
+				ExecutePrepared{
+					BoundExecute: BoundExecute{
+						Execute: Execute{
+							Details: Details{
+								Timestamp:       time20190225,
+								SessionID:       "6539311d.13d9",
+								User:            "postgres",
+								Database:        "postgres",
+								ApplicationName: "puma: [app]",
+								ClientAddr:      "172.31.210.83",
+								BackendPID:      5081,
+								VirtualXID:      "595/2810709",
+								QueryID:         -1029561919799294166,
+							},
+							Query:            "SELECT \"roles\".* FROM \"roles\" WHERE \"roles\".\"id\" = $1 LIMIT $2",
+							OriginalDuration: 28 * time.Microsecond,
 						},
-						Query: "SELECT \"roles\".* FROM \"roles\" WHERE \"roles\".\"id\" = $1 LIMIT $2",
+						Parameters: []interface{}{"65", "1"},
 					},
-					Parameters: []interface{}{"65", "1"},
+					Name: "a127",
 				},
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "6480e39e.1c73",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:  time20190225,
+							SessionID:  "6480e39e.1c73",
+							User:       "postgres",
+							Database:   "postgres",
+							ClientAddr: "199.167.158.43",
+							BackendPID: 7283,
+							VirtualXID: "4/286618",
 						},
 						Query: "select t.oid",
 					},
@@ -110,10 +131,13 @@ var _ = Describe("ParseCsvLog", func() {
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "6480e39e.1c73",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:  time20190225,
+							SessionID:  "6480e39e.1c73",
+							User:       "postgres",
+							Database:   "postgres",
+							ClientAddr: "199.167.158.43",
+							BackendPID: 7283,
+							VirtualXID: "4/286618",
 						},
 						Query: "select t.oid from test t where id = $1",
 					},
@@ -122,10 +146,13 @@ var _ = Describe("ParseCsvLog", func() {
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "6480e39e.1c73",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:  time20190225,
+							SessionID:  "6480e39e.1c73",
+							User:       "postgres",
+							Database:   "postgres",
+							ClientAddr: "199.167.158.43",
+							BackendPID: 7283,
+							VirtualXID: "4/286618",
 						},
 						Query: "insert into logs (author, message) ($1, $2)",
 					},
@@ -134,10 +161,15 @@ var _ = Describe("ParseCsvLog", func() {
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "6539079a.1008",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:       time20190225,
+							SessionID:       "6539079a.1008",
+							User:            "postgres",
+							Database:        "postgres",
+							ApplicationName: "puma: cluster worker 0: 1 [app]",
+							ClientAddr:      "172.31.201.153",
+							BackendPID:      4104,
+							VirtualXID:      "9/100797",
+							QueryID:         6288817976122733116,
 						},
 						Query: "UPDATE \"signatures\" SET \"token\" = $1, \"status\" = $2, \"confirmation_code\" = $3, \"updated_at\" = $4, \"code_send_at\" = $5 WHERE \"signatures\".\"id\" = $6",
 					},
@@ -146,10 +178,15 @@ var _ = Describe("ParseCsvLog", func() {
 				BoundExecute{
 					Execute: Execute{
 						Details: Details{
-							Timestamp: time20190225,
-							SessionID: "6538f428.358d",
-							User:      "postgres",
-							Database:  "postgres",
+							Timestamp:       time20190225,
+							SessionID:       "6538f428.358d",
+							User:            "postgres",
+							Database:        "postgres",
+							ApplicationName: "bin/rails",
+							ClientAddr:      "172.31.238.174",
+							BackendPID:      13709,
+							VirtualXID:      "94/34455",
+							QueryID:         942673988706279540,
 						},
 						Query: "DELETE FROM \"messages\" WHERE (\"messages\".\"origin\" = $1) AND (\"messages\".\"id\" = $2) AND (\"messages\".\"type\" = $3)",
 					},
@@ -157,24 +194,166 @@ var _ = Describe("ParseCsvLog", func() {
 				},
 				Statement{
 					Details: Details{
-						Timestamp: time20190225,
-						SessionID: "6480e39e.1c73",
-						User:      "postgres",
-						Database:  "postgres",
+						Timestamp:  time20190225,
+						SessionID:  "6480e39e.1c73",
+						User:       "postgres",
+						Database:   "postgres",
+						ClientAddr: "199.167.158.43",
+						BackendPID: 7283,
+						VirtualXID: "4/286618",
 					},
-					Query: "SELECT p.name, r.rating\n\t\t\t\t\t\tFROM products p\n\t\t\t\t\t\tJOIN reviews r ON p.id = r.product_id\n\t\t\t\t\t\tWHERE r.rating IN (\n\t\t\t\t\t\tSELECT MIN(rating) FROM reviews\n\t\t\t\t\t\tUNION\n\t\t\t\t\t\tSELECT MAX(rating) FROM reviews\n\t\t\t\t\t\t);\n\t\t\t\t",
+					Query:            "SELECT p.name, r.rating\n\t\t\t\t\t\tFROM products p\n\t\t\t\t\t\tJOIN reviews r ON p.id = r.product_id\n\t\t\t\t\t\tWHERE r.rating IN (\n\t\t\t\t\t\tSELECT MIN(rating) FROM reviews\n\t\t\t\t\t\tUNION\n\t\t\t\t\t\tSELECT MAX(rating) FROM reviews\n\t\t\t\t\t\t);\n\t\t\t\t",
+					OriginalDuration: 53774 * time.Microsecond,
 				},
 				Statement{
 					Details: Details{
-						Timestamp: time20190225,
-						SessionID: "6480e39e.1c73",
-						User:      "postgres",
-						Database:  "postgres",
+						Timestamp:  time20190225,
+						SessionID:  "6480e39e.1c73",
+						User:       "postgres",
+						Database:   "postgres",
+						ClientAddr: "199.167.158.43",
+						BackendPID: 7283,
+						VirtualXID: "4/286618",
 					},
 					Query: "SELECT name, email\n\t\t\t\t\t\tFROM users\n\t\t\t\t\t\tWHERE email LIKE '@gmail.com';\n\t\t\t\t",
 				},
 			},
 		),
+		Entry(
+			"statements logged alongside their duration",
+			`
+2019-02-25 15:08:27.222 GMT,"postgres","postgres",7283,"199.167.158.43:57426",6480e39e.1c73,6374,"SELECT",2019-02-25 15:08:27.222 GMT,4/286618,0,LOG,00000,"duration: 0.123 ms  statement: select 1",,,,,,,,,"","client backend"
+2019-02-25 15:08:27.222 GMT,"postgres","postgres",7283,"199.167.158.43:57426",6480e39e.1c73,6375,"SELECT",2019-02-25 15:08:27.222 GMT,4/286618,0,LOG,00000,"duration: 0.031 ms  bind <unnamed>: select $1::int","parameters: $1 = '7'",,,,,,,,"","client backend"
+2019-02-25 15:08:27.222 GMT,"postgres","postgres",7283,"199.167.158.43:57426",6480e39e.1c73,6376,"SELECT",2019-02-25 15:08:27.222 GMT,4/286618,0,LOG,00000,"duration: 0.2 ms  execute <unnamed>: select $1::int","parameters: $1 = '7'",,,,,,,,"","client backend"`,
+			[]Item{
+				Statement{
+					Details: Details{
+						Timestamp:  time20190225,
+						SessionID:  "6480e39e.1c73",
+						User:       "postgres",
+						Database:   "postgres",
+						ClientAddr: "199.167.158.43",
+						BackendPID: 7283,
+						VirtualXID: "4/286618",
+					},
+					Query:            "select 1",
+					OriginalDuration: 123 * time.Microsecond,
+				},
+				BoundExecute{
+					Execute: Execute{
+						Details: Details{
+							Timestamp:  time20190225,
+							SessionID:  "6480e39e.1c73",
+							User:       "postgres",
+							Database:   "postgres",
+							ClientAddr: "199.167.158.43",
+							BackendPID: 7283,
+							VirtualXID: "4/286618",
+						},
+						Query:            "select $1::int",
+						OriginalDuration: 200 * time.Microsecond,
+					},
+					Parameters: []interface{}{"7"},
+				},
+			},
+		),
+	)
+})
+
+var _ = Describe("ParseJsonLog", func() {
+	DescribeTable("Parses",
+		func(input string, expected []Item) {
+			var items = []Item{}
+			itemsChan, errs, done := ParseJsonLog(strings.NewReader(input))
+			go func() {
+				for range errs {
+					// no-op, just drain the channel
+				}
+			}()
+
+			for item := range itemsChan {
+				if item != nil {
+					items = append(items, item)
+				}
+			}
+
+			Eventually(done).Should(BeClosed())
+			Expect(len(items)).To(Equal(len(expected)))
+
+			for idx, item := range items {
+				Expect(item).To(BeEquivalentTo(expected[idx]))
+			}
+		},
+		Entry(
+			"connections, statements and extended protocol",
+			`
+{"timestamp":"2019-02-25 15:08:27.222 GMT","pid":7283,"remote_host":"127.0.0.1","remote_port":59103,"session_id":"6480e39e.1c73","line_num":1,"ps":"","session_start":"2019-02-25 15:08:27 GMT","txid":0,"error_severity":"LOG","message":"connection received: host=127.0.0.1 port=59103","backend_type":"not initialized","query_id":0}
+{"timestamp":"2019-02-25 15:08:27.222 GMT","user":"alice","dbname":"pgreplay_test","pid":7283,"session_id":"6480e39e.1c73","line_num":2,"error_severity":"LOG","message":"connection authorized: user=alice database=pgreplay_test","backend_type":"client backend","query_id":0}
+{"timestamp":"2019-02-25 15:08:27.222 GMT","user":"alice","dbname":"pgreplay_test","pid":7283,"session_id":"6480e39e.1c73","line_num":3,"error_severity":"LOG","message":"statement: select pg_reload_conf();","application_name":"psql","backend_type":"client backend","query_id":0}
+{"timestamp":"2019-02-25 15:08:27.222 GMT","user":"alice","dbname":"pgreplay_test","pid":7283,"session_id":"6480e39e.1c73","line_num":4,"error_severity":"LOG","message":"duration: 0.326 ms","backend_type":"client backend","query_id":0}
+{"timestamp":"2019-02-25 15:08:27.222 GMT","user":"alice","dbname":"pgreplay_test","pid":7283,"session_id":"6480e39e.1c73","line_num":5,"error_severity":"LOG","message":"execute <unnamed>: insert into logs (author, message) ($1, $2)","detail":"parameters: $1 = 'alice', $2 = 'bo''b'","backend_type":"client backend","query_id":0}
+{"timestamp":"2019-02-25 15:08:27.222 GMT","user":"alice","dbname":"pgreplay_test","pid":7283,"session_id":"6480e39e.1c73","line_num":6,"error_severity":"LOG","message":"execute <unnamed>: select t.oid","backend_type":"client backend","query_id":0}
+{"timestamp":"2019-02-25 15:08:27.222 GMT","user":"alice","dbname":"pgreplay_test","pid":7283,"session_id":"6480e39e.1c73","line_num":7,"error_severity":"ERROR","state_code":"42P01","message":"relation \"missing\" does not exist","backend_type":"client backend","query_id":0}
+
+{"timestamp":"2019-02-25 15:08:27.222 GMT","user":"alice","dbname":"pgreplay_test","pid":7283,"session_id":"6480e39e.1c73","line_num":8,"error_severity":"LOG","message":"disconnection: session time: 0:00:03.861 user=alice database=pgreplay_test host=127.0.0.1 port=59103","backend_type":"client backend","query_id":0}`,
+			[]Item{
+				Connect{
+					Details{
+						Timestamp:  time20190225,
+						SessionID:  "6480e39e.1c73",
+						User:       "alice",
+						Database:   "pgreplay_test",
+						BackendPID: 7283,
+					},
+				},
+				Statement{
+					Details: Details{
+						Timestamp:       time20190225,
+						SessionID:       "6480e39e.1c73",
+						User:            "alice",
+						Database:        "pgreplay_test",
+						BackendPID:      7283,
+						ApplicationName: "psql",
+					},
+					Query: "select pg_reload_conf();",
+				},
+				BoundExecute{
+					Execute: Execute{
+						Details: Details{
+							Timestamp:  time20190225,
+							SessionID:  "6480e39e.1c73",
+							User:       "alice",
+							Database:   "pgreplay_test",
+							BackendPID: 7283,
+						},
+						Query: "insert into logs (author, message) ($1, $2)",
+					},
+					Parameters: []interface{}{"alice", "bo'b"},
+				},
+				BoundExecute{
+					Execute: Execute{
+						Details: Details{
+							Timestamp:  time20190225,
+							SessionID:  "6480e39e.1c73",
+							User:       "alice",
+							Database:   "pgreplay_test",
+							BackendPID: 7283,
+						},
+						Query: "select t.oid",
+					},
+					Parameters: []interface{}{},
+				},
+				Disconnect{
+					Details{
+						Timestamp:  time20190225,
+						SessionID:  "6480e39e.1c73",
+						User:       "alice",
+						Database:   "pgreplay_test",
+						BackendPID: 7283,
+					},
+				},
+			},
+		),
 	)
 })
 
@@ -235,7 +414,8 @@ var _ = Describe("ParseErrlog", func() {
 							User:      "alice",
 							Database:  "pgreplay_test",
 						},
-						Query: "select t.oid",
+						Query:            "select t.oid",
+						OriginalDuration: 326 * time.Microsecond,
 					},
 					Parameters: []interface{}{},
 				},
@@ -247,13 +427,214 @@ var _ = Describe("ParseErrlog", func() {
 							User:      "alice",
 							Database:  "pgreplay_test",
 						},
-						Query: "insert into logs (author, message) ($1, $2)",
+						Query:            "insert into logs (author, message) ($1, $2)",
+						OriginalDuration: 42 * time.Microsecond,
 					},
 					Parameters: []interface{}{"alice", "bob"},
 				},
 			},
 		),
+		Entry(
+			"Named prepared statements",
+			`
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.088 ms  parse someone_sees_user: select $1::text
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.093 ms  bind someone_sees_user: select $1::text
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = 'alice'
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  execute someone_sees_user: select $1::text
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = 'alice'
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.079 ms
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: DEALLOCATE someone_sees_user;
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: deallocate all
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: DISCARD ALL`,
+			[]Item{
+				Prepare{
+					Details: Details{
+						Timestamp: time20190225,
+						SessionID: "5c7404eb.d6bd",
+						User:      "alice",
+						Database:  "pgreplay_test",
+					},
+					Name:  "someone_sees_user",
+					Query: "select $1::text",
+				},
+				ExecutePrepared{
+					BoundExecute: BoundExecute{
+						Execute: Execute{
+							Details: Details{
+								Timestamp: time20190225,
+								SessionID: "5c7404eb.d6bd",
+								User:      "alice",
+								Database:  "pgreplay_test",
+							},
+							Query: "select $1::text",
+						},
+						Parameters: []interface{}{"alice"},
+					},
+					Name: "someone_sees_user",
+				},
+				Deallocate{
+					Details: Details{
+						Timestamp: time20190225,
+						SessionID: "5c7404eb.d6bd",
+						User:      "alice",
+						Database:  "pgreplay_test",
+					},
+					Name: "someone_sees_user",
+				},
+				Deallocate{
+					Details: Details{
+						Timestamp: time20190225,
+						SessionID: "5c7404eb.d6bd",
+						User:      "alice",
+						Database:  "pgreplay_test",
+					},
+				},
+				DiscardAll{
+					Details{
+						Timestamp: time20190225,
+						SessionID: "5c7404eb.d6bd",
+						User:      "alice",
+						Database:  "pgreplay_test",
+					},
+				},
+			},
+		),
+		Entry(
+			"Executes of named portals",
+			`
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  execute S_1/C_2: select $1::text
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = 'alice'
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  execute <unnamed>/C_3: select $1::int
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = '7'`,
+			[]Item{
+				ExecutePrepared{
+					BoundExecute: BoundExecute{
+						Execute: Execute{
+							Details: Details{
+								Timestamp: time20190225,
+								SessionID: "5c7404eb.d6bd",
+								User:      "alice",
+								Database:  "pgreplay_test",
+							},
+							Query: "select $1::text",
+						},
+						Parameters: []interface{}{"alice"},
+					},
+					Name: "S_1",
+				},
+				BoundExecute{
+					Execute: Execute{
+						Details: Details{
+							Timestamp: time20190225,
+							SessionID: "5c7404eb.d6bd",
+							User:      "alice",
+							Database:  "pgreplay_test",
+						},
+						Query: "select $1::int",
+					},
+					Parameters: []interface{}{"7"},
+				},
+			},
+		),
+		Entry(
+			"Statements logged alongside their duration",
+			`
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.123 ms  statement: select 1
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.050 ms  parse <unnamed>: select $1::int
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.031 ms  bind <unnamed>: select $1::int
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = '7'
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.2 ms  execute <unnamed>: select $1::int
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = '7'
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.5 ms  execute <unnamed>: select now()
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: select 2
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.300 ms  statement: select 2`,
+			[]Item{
+				Statement{
+					Details: Details{
+						Timestamp: time20190225,
+						SessionID: "5c7404eb.d6bd",
+						User:      "alice",
+						Database:  "pgreplay_test",
+					},
+					Query:            "select 1",
+					OriginalDuration: 123 * time.Microsecond,
+				},
+				BoundExecute{
+					Execute: Execute{
+						Details: Details{
+							Timestamp: time20190225,
+							SessionID: "5c7404eb.d6bd",
+							User:      "alice",
+							Database:  "pgreplay_test",
+						},
+						Query:            "select $1::int",
+						OriginalDuration: 200 * time.Microsecond,
+					},
+					Parameters: []interface{}{"7"},
+				},
+				BoundExecute{
+					Execute: Execute{
+						Details: Details{
+							Timestamp: time20190225,
+							SessionID: "5c7404eb.d6bd",
+							User:      "alice",
+							Database:  "pgreplay_test",
+						},
+						Query:            "select now()",
+						OriginalDuration: 500 * time.Microsecond,
+					},
+					Parameters: []interface{}{},
+				},
+				Statement{
+					Details: Details{
+						Timestamp: time20190225,
+						SessionID: "5c7404eb.d6bd",
+						User:      "alice",
+						Database:  "pgreplay_test",
+					},
+					Query:            "select 2",
+					OriginalDuration: 300 * time.Microsecond,
+				},
+			},
+		),
 	)
+
+	It("Ignores the parameters logged with each bind", func() {
+		input := `2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.031 ms  bind <unnamed>: select $1::int
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = '7'
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.2 ms  execute <unnamed>: select $1::int
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = '7'
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.031 ms  bind <unnamed>: select 1
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  duration: 0.1 ms  execute <unnamed>: select 1
+2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|DETAIL:  parameters: $1 = '8'`
+
+		itemsChan, errs, done := ParseErrlog(strings.NewReader(input))
+
+		var parseErrs []error
+		errsDone := make(chan struct{})
+		go func() {
+			defer close(errsDone)
+			for err := range errs {
+				parseErrs = append(parseErrs, err)
+			}
+		}()
+
+		var queries []string
+		for item := range itemsChan {
+			if item != nil {
+				queries = append(queries, item.(BoundExecute).Query)
+			}
+		}
+
+		Eventually(done).Should(BeClosed())
+		Eventually(errsDone).Should(BeClosed())
+
+		Expect(queries).To(Equal([]string{"select $1::int", "select 1"}))
+
+		// Binds without parameters are followed by no DETAIL, so a stray one is still reported
+		Expect(parseErrs).To(HaveLen(1))
+		Expect(parseErrs[0]).To(MatchError(ErrUnmatchedParameters))
+	})
 })
 
 var _ = Describe("ParseBindParameters", func() {
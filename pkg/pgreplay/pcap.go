@@ -0,0 +1,449 @@
+package pgreplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"time"
+)
+
+// PostgresPort is the port we expect the server to be listening on in packet captures
+const PostgresPort = 5432
+
+// Link-layer header types we can decode, from https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+
+	ipProtocolTCP = 6
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+
+	// maxPendingSegmentBytes bounds how much out-of-order data we'll hold for a stream
+	// before giving up on the missing segment.
+	maxPendingSegmentBytes = MaxLogLineSize
+)
+
+// ParsePcap generates a stream of Items from a libpcap capture of traffic to a Postgres
+// server on the default port. See NewPcapParser.
+func ParsePcap(capture io.Reader) (items chan Item, errs chan error, done chan error) {
+	return NewPcapParser(PostgresPort)(capture)
+}
+
+// NewPcapParser returns a parser for libpcap captures (such as those written by tcpdump -w)
+// of traffic to a Postgres server on the given port. We reassemble each TCP connection and
+// decode the wire protocol messages sent by the client, which means we replay exactly
+// what the application sent, including the real values of bound parameters.
+//
+// Connections must be captured from their start, and must not be encrypted. We don't
+// support the pcapng format, which can be converted with `editcap -F pcap`.
+func NewPcapParser(port uint16) ParserFunc {
+	return func(capture io.Reader) (items chan Item, errs chan error, done chan error) {
+		items, errs, done = make(chan Item, ItemBufferSize), make(chan error), make(chan error)
+
+		go func() {
+			err := parsePcap(capture, port, items, errs)
+
+			// Flush the item channel by pushing nil values up-to capacity
+			for i := 0; i < ItemBufferSize; i++ {
+				items <- nil
+			}
+
+			close(items)
+			close(errs)
+
+			done <- err
+			close(done)
+		}()
+
+		return
+	}
+}
+
+func parsePcap(capture io.Reader, port uint16, items chan Item, errs chan error) error {
+	reader, err := newPcapReader(capture)
+	if err != nil {
+		return err
+	}
+
+	connections := map[string]*pcapConnection{}
+
+	emit := func(item Item, err error) {
+		if err != nil {
+			logLinesErrorTotal.Inc()
+			errs <- err
+		}
+
+		if item != nil {
+			logLinesParsedTotal.Inc()
+			items <- item
+		}
+	}
+
+	for {
+		ts, packet, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		segment, ok := decodePacket(reader.linkType, packet)
+		if !ok {
+			continue
+		}
+
+		var (
+			fromClient bool
+			key        string
+		)
+
+		switch port {
+		case segment.dstPort:
+			fromClient, key = true, segment.src()+"-"+segment.dst()
+		case segment.srcPort:
+			fromClient, key = false, segment.dst()+"-"+segment.src()
+		default:
+			continue
+		}
+
+		conn, ok := connections[key]
+		if !ok {
+			if segment.flags&tcpFlagSYN == 0 && len(segment.payload) == 0 {
+				continue // the tail of a connection we've already closed
+			}
+
+			conn = newPcapConnection(ts, key)
+			connections[key] = conn
+		}
+
+		stream := conn.server
+		if fromClient {
+			stream = conn.client
+		}
+
+		data, err := stream.reassemble(segment)
+		if err != nil {
+			emit(nil, fmt.Errorf("session %s: %v", conn.session.id, err))
+		}
+
+		if len(data) > 0 {
+			if fromClient {
+				sessionItems, err := conn.session.Frontend(ts, data)
+				for _, item := range sessionItems {
+					emit(item, nil)
+				}
+
+				if err != nil {
+					emit(nil, err)
+				}
+			} else if err := conn.session.Backend(ts, data); err != nil {
+				emit(nil, fmt.Errorf("session %s: %v", conn.session.id, err))
+			}
+		}
+
+		if segment.flags&(tcpFlagFIN|tcpFlagRST) != 0 {
+			emit(conn.session.Close(ts), nil)
+			delete(connections, key)
+		}
+	}
+}
+
+// pcapConnection tracks both directions of a TCP connection between a client and the
+// Postgres server
+type pcapConnection struct {
+	session        *WireSession
+	client, server *tcpStream
+}
+
+func newPcapConnection(ts time.Time, key string) *pcapConnection {
+	// Mirror the Postgres session ID format of start time and pid, using a hash of the
+	// client address in place of a pid
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return &pcapConnection{
+		session: NewWireSession(SessionID(fmt.Sprintf("%x.%x", ts.Unix(), hash.Sum32()))),
+		client:  &tcpStream{pending: map[uint32][]byte{}},
+		server:  &tcpStream{pending: map[uint32][]byte{}},
+	}
+}
+
+// tcpStream reassembles the data sent in one direction of a TCP connection, reordering
+// segments that arrived out of order and discarding retransmissions.
+type tcpStream struct {
+	synced       bool
+	nextSeq      uint32
+	pending      map[uint32][]byte
+	pendingBytes int
+}
+
+func (s *tcpStream) reassemble(segment tcpSegment) ([]byte, error) {
+	if segment.flags&tcpFlagSYN != 0 {
+		s.synced, s.nextSeq = true, segment.seq+1
+		return nil, nil
+	}
+
+	if !s.synced {
+		// We missed the handshake, so start from wherever we joined the stream
+		s.synced, s.nextSeq = true, segment.seq
+	}
+
+	if len(segment.payload) == 0 {
+		return nil, nil
+	}
+
+	// Sequence numbers wrap, so compare them by their signed difference
+	if offset := int32(segment.seq - s.nextSeq); offset > 0 {
+		if _, ok := s.pending[segment.seq]; !ok {
+			s.pending[segment.seq] = append([]byte(nil), segment.payload...)
+			s.pendingBytes += len(segment.payload)
+		}
+
+		if s.pendingBytes > maxPendingSegmentBytes {
+			return s.skipGap(), fmt.Errorf("lost TCP segment at sequence %d", s.nextSeq)
+		}
+
+		return nil, nil
+	}
+
+	data := s.advance(nil, segment.seq, segment.payload)
+
+	// Now we've advanced, any pending segments may have become contiguous
+	for len(s.pending) > 0 {
+		var progressed bool
+		for seq, payload := range s.pending {
+			if int32(seq-s.nextSeq) <= 0 {
+				delete(s.pending, seq)
+				s.pendingBytes -= len(payload)
+				data = s.advance(data, seq, payload)
+				progressed = true
+			}
+		}
+
+		if !progressed {
+			break
+		}
+	}
+
+	return data, nil
+}
+
+// advance appends the part of the payload beyond what we've already received
+func (s *tcpStream) advance(data []byte, seq uint32, payload []byte) []byte {
+	overlap := int(int32(s.nextSeq - seq))
+	if overlap >= len(payload) {
+		return data // a retransmission of data we already have
+	}
+
+	s.nextSeq = seq + uint32(len(payload))
+
+	return append(data, payload[overlap:]...)
+}
+
+// skipGap abandons the missing data, resuming from the earliest pending segment
+func (s *tcpStream) skipGap() []byte {
+	var earliest uint32
+	for seq := range s.pending {
+		if earliest == 0 || int32(seq-earliest) < 0 {
+			earliest = seq
+		}
+	}
+
+	s.nextSeq = earliest
+	payload := s.pending[earliest]
+	delete(s.pending, earliest)
+	s.pendingBytes -= len(payload)
+
+	return s.advance(nil, earliest, payload)
+}
+
+type tcpSegment struct {
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+	seq              uint32
+	flags            byte
+	payload          []byte
+}
+
+func (s tcpSegment) src() string { return net.JoinHostPort(s.srcIP.String(), fmt.Sprint(s.srcPort)) }
+func (s tcpSegment) dst() string { return net.JoinHostPort(s.dstIP.String(), fmt.Sprint(s.dstPort)) }
+
+// decodePacket extracts the TCP segment from a captured packet, returning false for any
+// packet that isn't TCP over IPv4 or IPv6.
+func decodePacket(linkType uint32, packet []byte) (segment tcpSegment, ok bool) {
+	var etherType uint16
+
+	switch linkType {
+	case linkTypeEthernet:
+		if len(packet) < 14 {
+			return segment, false
+		}
+
+		etherType, packet = binary.BigEndian.Uint16(packet[12:]), packet[14:]
+		for etherType == etherTypeVLAN && len(packet) >= 4 {
+			etherType, packet = binary.BigEndian.Uint16(packet[2:]), packet[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(packet) < 16 {
+			return segment, false
+		}
+
+		etherType, packet = binary.BigEndian.Uint16(packet[14:]), packet[16:]
+	case linkTypeSLL2:
+		if len(packet) < 20 {
+			return segment, false
+		}
+
+		etherType, packet = binary.BigEndian.Uint16(packet[0:]), packet[20:]
+	case linkTypeNull:
+		// The loopback header is the address family in the capturing host's byte order,
+		// and IPv6 has a different value on each BSD. It's simpler to use the IP version.
+		if len(packet) < 4 {
+			return segment, false
+		}
+
+		packet = packet[4:]
+		fallthrough
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		if len(packet) < 1 {
+			return segment, false
+		}
+
+		switch packet[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	default:
+		return segment, false
+	}
+
+	switch etherType {
+	case etherTypeIPv4:
+		if len(packet) < 20 {
+			return segment, false
+		}
+
+		headerLength, totalLength := int(packet[0]&0x0f)*4, int(binary.BigEndian.Uint16(packet[2:]))
+		fragment := binary.BigEndian.Uint16(packet[6:])
+		if packet[9] != ipProtocolTCP || fragment&0x3fff != 0 || headerLength < 20 || totalLength < headerLength || len(packet) < totalLength {
+			return segment, false // we don't reassemble fragmented packets
+		}
+
+		segment.srcIP, segment.dstIP = net.IP(packet[12:16]), net.IP(packet[16:20])
+		packet = packet[headerLength:totalLength]
+	case etherTypeIPv6:
+		if len(packet) < 40 {
+			return segment, false
+		}
+
+		payloadLength := int(binary.BigEndian.Uint16(packet[4:]))
+		if packet[6] != ipProtocolTCP || len(packet) < 40+payloadLength {
+			return segment, false // we don't follow extension headers
+		}
+
+		segment.srcIP, segment.dstIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+		packet = packet[40 : 40+payloadLength]
+	default:
+		return segment, false
+	}
+
+	if len(packet) < 20 {
+		return segment, false
+	}
+
+	dataOffset := int(packet[12]>>4) * 4
+	if dataOffset < 20 || len(packet) < dataOffset {
+		return segment, false
+	}
+
+	segment.srcPort = binary.BigEndian.Uint16(packet[0:])
+	segment.dstPort = binary.BigEndian.Uint16(packet[2:])
+	segment.seq = binary.BigEndian.Uint32(packet[4:])
+	segment.flags = packet[13]
+	segment.payload = packet[dataOffset:]
+
+	return segment, true
+}
+
+// pcapReader reads packets from the classic libpcap file format
+type pcapReader struct {
+	input       io.Reader
+	order       binary.ByteOrder
+	nanoseconds bool
+	linkType    uint32
+	header      [16]byte
+}
+
+func newPcapReader(input io.Reader) (*pcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(input, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+
+	reader := &pcapReader{input: input}
+
+	switch magic := binary.LittleEndian.Uint32(header[:]); magic {
+	case 0xa1b2c3d4:
+		reader.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		reader.order, reader.nanoseconds = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		reader.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		reader.order, reader.nanoseconds = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, fmt.Errorf("pcapng captures are not supported, convert with: editcap -F pcap")
+	default:
+		return nil, fmt.Errorf("not a pcap capture, unrecognised magic number %x", magic)
+	}
+
+	reader.linkType = reader.order.Uint32(header[20:]) & 0x0fffffff
+
+	return reader, nil
+}
+
+func (r *pcapReader) next() (time.Time, []byte, error) {
+	if _, err := io.ReadFull(r.input, r.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return time.Time{}, nil, fmt.Errorf("truncated pcap record header")
+		}
+
+		return time.Time{}, nil, err
+	}
+
+	seconds, fraction := r.order.Uint32(r.header[0:]), r.order.Uint32(r.header[4:])
+	length := r.order.Uint32(r.header[8:])
+	if length > maxWireMessageSize {
+		return time.Time{}, nil, fmt.Errorf("invalid pcap record length %d", length)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r.input, packet); err != nil {
+		return time.Time{}, nil, fmt.Errorf("truncated pcap record: %v", err)
+	}
+
+	if !r.nanoseconds {
+		fraction *= 1000
+	}
+
+	return time.Unix(int64(seconds), int64(fraction)).UTC(), packet, nil
+}
@@ -0,0 +1,71 @@
+package pgreplay
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParsePcap", func() {
+	var someoneSeesUser = `insert into logs (author, message) (
+  select $1, format('sees %s of %s''s logs', count(*), $2::text) from logs where author = $2
+);`
+
+	It("Decodes the client's messages from a capture", func() {
+		capture, err := os.Open("testdata/single_user.pcap")
+		Expect(err).NotTo(HaveOccurred())
+		defer capture.Close()
+
+		var items, errors = []Item{}, []error{}
+		itemsChan, errs, done := ParsePcap(capture)
+		errsDone := make(chan struct{})
+		go func() {
+			defer close(errsDone)
+			for err := range errs {
+				errors = append(errors, err)
+			}
+		}()
+
+		for item := range itemsChan {
+			if item != nil {
+				items = append(items, item)
+			}
+		}
+
+		Expect(<-done).To(Succeed())
+		<-errsDone
+		Expect(errors).To(BeEmpty())
+		Expect(items).To(HaveLen(6))
+
+		session := items[0].GetSessionID()
+		for _, item := range items {
+			Expect(item.GetSessionID()).To(Equal(session))
+			Expect(item.GetUser()).To(Equal("alice"))
+			Expect(item.GetDatabase()).To(Equal("pgreplay_test"))
+		}
+
+		Expect(items[0]).To(BeAssignableToTypeOf(Connect{}))
+
+		Expect(items[1]).To(BeAssignableToTypeOf(Statement{}))
+		Expect(items[1].(Statement).Query).To(Equal(
+			"insert into logs (author, message) values ('alice', 'says hello');",
+		))
+
+		Expect(items[2]).To(BeAssignableToTypeOf(Prepare{}))
+		Expect(items[2].(Prepare).Name).To(Equal("someone_sees_user"))
+		Expect(items[2].(Prepare).Query).To(Equal(someoneSeesUser))
+
+		Expect(items[3]).To(BeAssignableToTypeOf(ExecutePrepared{}))
+		Expect(items[3].(ExecutePrepared).Name).To(Equal("someone_sees_user"))
+		Expect(items[3].(ExecutePrepared).Parameters).To(Equal([]interface{}{"alice", "alice"}))
+		Expect(items[3].(ExecutePrepared).ParameterTypes).To(Equal([]uint32{oidText, oidText}))
+
+		Expect(items[4]).To(BeAssignableToTypeOf(BoundExecute{}))
+		Expect(items[4].(BoundExecute).Query).To(Equal("select $1::int4 + 1, $2::text"))
+		Expect(items[4].(BoundExecute).Parameters).To(Equal([]interface{}{"41", "bob"}))
+		Expect(items[4].(BoundExecute).ParameterTypes).To(Equal([]uint32{oidInt4, oidText}))
+
+		Expect(items[5]).To(BeAssignableToTypeOf(Disconnect{}))
+	})
+})
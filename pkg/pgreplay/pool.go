@@ -0,0 +1,295 @@
+package pgreplay
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eapache/channels"
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	poolWaitSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pgreplay_pool_wait_seconds",
+			Help:    "Time sessions waited to check out a pooled connection",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"user", "database"},
+	)
+	poolCheckoutsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pgreplay_pool_checkouts_total",
+			Help: "Number of times a session checked out a pooled connection",
+		},
+		[]string{"user", "database"},
+	)
+	poolSaturationRatio = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_pool_saturation_ratio",
+			Help: "Fraction of each pool's connections that are checked out",
+		},
+		[]string{"user", "database"},
+	)
+	poolSessionsWaiting = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pgreplay_pool_sessions_waiting",
+			Help: "Number of sessions waiting to check out a pooled connection",
+		},
+		[]string{"user", "database"},
+	)
+)
+
+// PoolConfig emulates a transaction pooler such as pgbouncer, or an application's own
+// connection pool. Each user and database pair has its own pool of Size connections,
+// unless the user or database has a size of its own, where those of users take
+// precedence as they do in pgbouncer. A Size of zero disables pooling, and each session
+// has its own connection.
+type PoolConfig struct {
+	Size          int
+	UserSizes     map[string]int
+	DatabaseSizes map[string]int
+}
+
+// SizeFor returns the size of the pool for the user and database
+func (c PoolConfig) SizeFor(user, database string) int {
+	if size, ok := c.UserSizes[user]; ok {
+		return size
+	}
+
+	if size, ok := c.DatabaseSizes[database]; ok {
+		return size
+	}
+
+	return c.Size
+}
+
+// ParsePoolSizes parses pool sizes of the form name=size, such as alice=20
+func ParsePoolSizes(sizes []string) (map[string]int, error) {
+	parsed := map[string]int{}
+	for _, entry := range sizes {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("pool size '%s' must be of the form name=size", entry)
+		}
+
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("pool size '%s' must be a positive integer", entry)
+		}
+
+		parsed[name] = size
+	}
+
+	return parsed, nil
+}
+
+type poolKey struct{ user, database string }
+
+// pools creates the pool of each user and database on first use, and tracks the replay
+// state of every connection they open.
+type pools struct {
+	sync.Mutex
+	db    *Database
+	pools map[poolKey]*pgxpool.Pool
+	conns sync.Map // *pgx.Conn to its *Conn
+}
+
+func (p *pools) get(ctx context.Context, user, database string) (*pgxpool.Pool, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	key := poolKey{user, database}
+	if pool, ok := p.pools[key]; ok {
+		return pool, nil
+	}
+
+	cfg := p.db.cfg.Copy()
+	cfg.Database, cfg.User = database, user
+
+	poolConfig, err := pgxpool.ParseConfig(cfg.ConnString())
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig.MaxConns = int32(p.db.pool.SizeFor(user, database))
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		connectionsEstablishedTotal.Inc()
+		connectionsActive.Inc()
+
+		return nil
+	}
+	poolConfig.BeforeClose = func(conn *pgx.Conn) {
+		connectionsActive.Dec()
+		p.conns.Delete(conn)
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	p.pools[key] = pool
+
+	return pool, nil
+}
+
+// conn returns the replay state of a pooled connection, which outlives each checkout so
+// that we remember the statements prepared on it
+func (p *pools) conn(conn *pgx.Conn) *Conn {
+	state, _ := p.conns.LoadOrStore(conn, &Conn{
+		Conn:           conn,
+		prepared:       map[string]preparedStatement{},
+		parameterTypes: p.db.parameterTypes,
+		described:      map[string][]uint32{},
+	})
+
+	return state.(*Conn)
+}
+
+func (p *pools) close() {
+	for _, pool := range p.pools {
+		pool.Close()
+	}
+}
+
+// consumePooled is Consume for when we emulate a transaction pooler. Each session
+// processes its items in order, checking out a connection from its pool for every
+// transaction, or every statement outside of one, and returning it once the connection
+// is idle again. Many sessions therefore share a bounded number of connections, as they
+// would behind pgbouncer in transaction mode.
+func (d *Database) consumePooled(ctx context.Context, items chan Item) (chan error, chan error) {
+	var wg sync.WaitGroup
+
+	errs, done := make(chan error, 10), make(chan error)
+	pools := &pools{db: d, pools: map[poolKey]*pgxpool.Pool{}}
+	sessions := map[SessionID]channels.Channel{}
+
+	go func() {
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			session, ok := sessions[item.GetSessionID()]
+			if !ok {
+				session = channels.NewInfiniteChannel()
+				sessions[item.GetSessionID()] = session
+
+				wg.Add(1)
+				go func(user, database string) {
+					defer wg.Done()
+
+					in := make(chan Item)
+					channels.Unwrap(session, in)
+
+					d.replaySession(ctx, pools, user, database, in, errs)
+				}(item.GetUser(), item.GetDatabase())
+			}
+
+			session.In() <- item
+
+			switch item.(type) {
+			case Disconnect, *Disconnect:
+				session.Close()
+				delete(sessions, item.GetSessionID())
+			}
+		}
+
+		for _, session := range sessions {
+			session.Close()
+		}
+
+		// Wait for every session to finish
+		wg.Wait()
+		pools.close()
+
+		close(errs)
+		close(done)
+	}()
+
+	return errs, done
+}
+
+// replaySession handles the items of one session, holding a pooled connection only while
+// the session is in a transaction
+func (d *Database) replaySession(ctx context.Context, pools *pools, user, database string, items chan Item, errs chan error) {
+	pool, err := pools.get(ctx, user, database)
+	if err != nil {
+		errs <- err
+		for range items {
+			// drain the session, as we can't replay it
+		}
+
+		return
+	}
+
+	labels := prometheus.Labels{"user": user, "database": database}
+	saturation := func() {
+		stat := pool.Stat()
+		poolSaturationRatio.With(labels).Set(float64(stat.AcquiredConns()) / float64(stat.MaxConns()))
+	}
+
+	var held *pgxpool.Conn
+	release := func() {
+		if held != nil {
+			held.Release() // connections left in a transaction are destroyed by the pool
+			held = nil
+			saturation()
+		}
+	}
+
+	defer release()
+
+	for item := range items {
+		switch item.(type) {
+		case Connect, *Connect, Disconnect, *Disconnect:
+			continue // sessions don't own connections, so there's nothing to open or close
+		}
+
+		if held == nil {
+			waiting := poolSessionsWaiting.With(labels)
+			waiting.Inc()
+
+			began := time.Now()
+			held, err = pool.Acquire(ctx)
+			waiting.Dec()
+
+			if err != nil {
+				errs <- err
+				continue
+			}
+
+			poolWaitSeconds.With(labels).Observe(time.Since(began).Seconds())
+			poolCheckoutsTotal.With(labels).Inc()
+			saturation()
+		}
+
+		itemsProcessedTotal.Inc()
+		itemsMostRecentTimestamp.Set(float64(item.GetTimestamp().Unix()))
+
+		began := time.Now()
+		err := item.Handle(ctx, pools.conn(held.Conn()))
+
+		if original := OriginalDuration(item); original > 0 && err == nil {
+			itemsDurationRatio.Observe(float64(time.Since(began)) / float64(original))
+		}
+
+		if err != nil {
+			errs <- err
+		}
+
+		// Return the connection unless we're within a transaction, which must finish on
+		// the connection it began on
+		if conn := held.Conn(); conn.IsClosed() || conn.PgConn().TxStatus() == 'I' {
+			release()
+		}
+	}
+}
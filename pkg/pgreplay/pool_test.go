@@ -0,0 +1,41 @@
+package pgreplay
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PoolConfig", func() {
+	var config = PoolConfig{
+		Size:          5,
+		UserSizes:     map[string]int{"alice": 20},
+		DatabaseSizes: map[string]int{"reporting": 2},
+	}
+
+	DescribeTable("SizeFor",
+		func(user, database string, expected int) {
+			Expect(config.SizeFor(user, database)).To(Equal(expected))
+		},
+		Entry("defaults to the pool size", "bob", "pgreplay_test", 5),
+		Entry("uses the size of the database", "bob", "reporting", 2),
+		Entry("prefers the size of the user", "alice", "reporting", 20),
+	)
+})
+
+var _ = Describe("ParsePoolSizes", func() {
+	It("Parses sizes by name", func() {
+		Expect(ParsePoolSizes([]string{"alice=20", "bob=3"})).To(Equal(map[string]int{"alice": 20, "bob": 3}))
+	})
+
+	DescribeTable("Rejects invalid sizes",
+		func(size string) {
+			_, err := ParsePoolSizes([]string{size})
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("without a name", "=20"),
+		Entry("without a size", "alice"),
+		Entry("with a size that isn't a number", "alice=lots"),
+		Entry("with a size of zero", "alice=0"),
+	)
+})
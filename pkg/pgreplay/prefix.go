@@ -0,0 +1,255 @@
+package pgreplay
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultLogLinePrefix is the log_line_prefix we have always recommended, and which
+	// ParseItem is able to split without the help of a compiled LogLinePrefix.
+	DefaultLogLinePrefix = "%m|%u|%d|%c|"
+
+	// PostgresTimestampSecondsFormat is the format of the %t and %s escapes, which unlike
+	// %m do not include milliseconds.
+	PostgresTimestampSecondsFormat = "2006-01-02 15:04:05 MST"
+)
+
+// prefixEscapes maps each log_line_prefix escape to the regular expression that matches
+// the value Postgres will render for it. Values that may contain arbitrary text are
+// matched lazily, relying on the literal text that follows them in the prefix.
+var prefixEscapes = map[byte]string{
+	'a': `.*?`,                  // application name
+	'u': `.*?`,                  // user name
+	'd': `.*?`,                  // database name
+	'r': `.*?`,                  // remote host and port
+	'h': `.*?`,                  // remote host
+	'b': `.*?`,                  // backend type
+	'p': `\d+`,                  // process ID
+	'P': `\d*`,                  // parallel group leader process ID
+	't': timestampPattern,       // timestamp without milliseconds
+	'm': timestampMillisPattern, // timestamp with milliseconds
+	'n': `\d+\.\d+`,             // timestamp with milliseconds as a Unix epoch
+	'i': `.*?`,                  // command tag
+	'e': `[0-9A-Z]{5}`,          // SQLSTATE error code
+	'c': `[0-9a-f]+\.[0-9a-f]+`, // session ID
+	'l': `\d+`,                  // session line number
+	's': timestampPattern,       // session start timestamp
+	'v': `(?:\d+/\d+)?`,         // virtual transaction ID
+	'x': `\d+`,                  // transaction ID
+	'Q': `-?\d+`,                // query identifier
+}
+
+const (
+	timestampPattern       = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} [A-Za-z0-9+\-:]+`
+	timestampMillisPattern = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3} [A-Za-z0-9+\-:]+`
+)
+
+// LogLinePrefix is a compiled Postgres log_line_prefix, able to extract the values of
+// each escape from an errlog line.
+type LogLinePrefix struct {
+	prefix string
+	regex  *regexp.Regexp
+	groups map[byte]int // escape character to regex submatch index
+}
+
+// ParseLogLinePrefix compiles a Postgres log_line_prefix into a matcher. We reject any
+// prefix that doesn't allow us to recover the timestamp, user, database and session of
+// each log line, as replay is impossible without them.
+func ParseLogLinePrefix(prefix string) (*LogLinePrefix, error) {
+	var (
+		pattern strings.Builder
+		groups  = map[byte]int{}
+		group   = 0
+		closing = ""
+	)
+
+	pattern.WriteString(`(?s)^`)
+
+	for idx := 0; idx < len(prefix); idx++ {
+		if prefix[idx] != '%' {
+			pattern.WriteString(regexp.QuoteMeta(prefix[idx : idx+1]))
+			continue
+		}
+
+		// Postgres allows a padding width between the % and the escape, such as %-10u
+		padded := false
+		for idx+1 < len(prefix) && strings.ContainsRune("-0123456789", rune(prefix[idx+1])) {
+			padded = true
+			idx++
+		}
+
+		if idx+1 >= len(prefix) {
+			return nil, fmt.Errorf("log_line_prefix ends with an incomplete escape: '%s'", prefix)
+		}
+
+		idx++
+		escape := prefix[idx]
+
+		switch escape {
+		case '%':
+			pattern.WriteString(`%`)
+			continue
+		case 'q':
+			// Everything following %q is omitted by non-session processes, which means the
+			// remainder of our prefix is optional.
+			pattern.WriteString(`(?:`)
+			closing += `)?`
+			continue
+		}
+
+		expr, ok := prefixEscapes[escape]
+		if !ok {
+			return nil, fmt.Errorf("log_line_prefix contains unsupported escape '%%%c'", escape)
+		}
+
+		if _, seen := groups[escape]; seen {
+			// Repeated escapes render the same value, so we only capture the first
+			pattern.WriteString(`(?:` + expr + `)`)
+			continue
+		}
+
+		group++
+		groups[escape] = group
+
+		if padded {
+			pattern.WriteString(`\s*(` + expr + `)\s*`)
+		} else {
+			pattern.WriteString(`(` + expr + `)`)
+		}
+	}
+
+	pattern.WriteString(closing)
+	pattern.WriteString(`(.*)$`)
+
+	regex, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile log_line_prefix '%s': %v", prefix, err)
+	}
+
+	p := &LogLinePrefix{prefix: prefix, regex: regex, groups: groups}
+
+	if !p.has('t') && !p.has('m') && !p.has('n') {
+		return nil, fmt.Errorf("log_line_prefix '%s' must include a timestamp (%%t, %%m or %%n)", prefix)
+	}
+	if !p.has('u') {
+		return nil, fmt.Errorf("log_line_prefix '%s' must include the user (%%u)", prefix)
+	}
+	if !p.has('d') {
+		return nil, fmt.Errorf("log_line_prefix '%s' must include the database (%%d)", prefix)
+	}
+	if !p.has('c') && !p.has('p') {
+		return nil, fmt.Errorf("log_line_prefix '%s' must include the session (%%c) or process ID (%%p)", prefix)
+	}
+
+	return p, nil
+}
+
+// MustParseLogLinePrefix is like ParseLogLinePrefix but panics if the prefix is invalid
+func MustParseLogLinePrefix(prefix string) *LogLinePrefix {
+	p, err := ParseLogLinePrefix(prefix)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+func (p *LogLinePrefix) String() string { return p.prefix }
+
+func (p *LogLinePrefix) has(escape byte) bool {
+	_, ok := p.groups[escape]
+	return ok
+}
+
+// PrefixFields holds the values extracted from the prefix of a single errlog line, keyed
+// by their log_line_prefix escape character.
+type PrefixFields map[byte]string
+
+// Match splits the given errlog line into the values of each prefix escape and the
+// message that follows the prefix.
+func (p *LogLinePrefix) Match(logline string) (PrefixFields, string, error) {
+	matches := p.regex.FindStringSubmatch(logline)
+	if matches == nil {
+		return nil, "", fmt.Errorf("failed to parse log line: '%s'", logline)
+	}
+
+	fields := make(PrefixFields, len(p.groups))
+	for escape, group := range p.groups {
+		fields[escape] = matches[group]
+	}
+
+	return fields, matches[len(matches)-1], nil
+}
+
+// Timestamp parses whichever timestamp escape the prefix provides
+func (f PrefixFields) Timestamp() (time.Time, error) {
+	if value, ok := f['m']; ok {
+		return parsePrefixTimestamp(PostgresTimestampFormat, value)
+	}
+
+	if value, ok := f['t']; ok {
+		return parsePrefixTimestamp(PostgresTimestampSecondsFormat, value)
+	}
+
+	if value, ok := f['n']; ok {
+		epoch, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return time.UnixMilli(int64(epoch * 1000)).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("no timestamp in log line prefix")
+}
+
+// numericZone matches the zones Postgres renders as an offset from UTC, for timezones
+// without an abbreviation, such as +03 for Europe/Istanbul or +0530 for Asia/Kolkata
+var numericZone = regexp.MustCompile(`^[+-]\d{2}(:?\d{2})?$`)
+
+// parsePrefixTimestamp parses a timestamp escape with the given layout, whose zone may
+// be written as either an abbreviation or a numeric offset.
+func parsePrefixTimestamp(layout, value string) (time.Time, error) {
+	if idx := strings.LastIndexByte(value, ' '); idx >= 0 {
+		if zone := value[idx+1:]; numericZone.MatchString(zone) {
+			offset := "-07"
+			if len(zone) == 5 {
+				offset = "-0700"
+			} else if len(zone) == 6 {
+				offset = "-07:00"
+			}
+
+			return time.Parse(strings.TrimSuffix(layout, "MST")+offset, value)
+		}
+	}
+
+	return time.Parse(layout, value)
+}
+
+// ClientAddr returns the client host from either the %h escape, or the host(port) of %r
+func (f PrefixFields) ClientAddr() string {
+	if value, ok := f['h']; ok {
+		return value
+	}
+
+	if idx := strings.IndexByte(f['r'], '('); idx >= 0 {
+		return f['r'][:idx]
+	}
+
+	return f['r']
+}
+
+// sessionFromPID generates a session ID in the same format as Postgres' %c, which is
+// the hex encoded session start time followed by the hex encoded process ID.
+func sessionFromPID(start time.Time, pid string) (SessionID, error) {
+	num, err := strconv.ParseInt(pid, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse process ID '%s': %v", pid, err)
+	}
+
+	return SessionID(fmt.Sprintf("%x.%x", start.Unix(), num)), nil
+}
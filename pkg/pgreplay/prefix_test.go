@@ -0,0 +1,133 @@
+package pgreplay
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseLogLinePrefix", func() {
+	DescribeTable("Rejects",
+		func(prefix string) {
+			_, err := ParseLogLinePrefix(prefix)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("missing timestamp", "%u|%d|%c|"),
+		Entry("missing user", "%m|%d|%c|"),
+		Entry("missing database", "%m|%u|%c|"),
+		Entry("missing session and process", "%m|%u|%d|"),
+		Entry("unsupported escape", "%m|%u|%d|%c|%z"),
+		Entry("incomplete escape", "%m|%u|%d|%c|%"),
+	)
+
+	DescribeTable("Matches",
+		func(prefix, logline string, expected PrefixFields, expectedMsg string) {
+			fields, msg, err := MustParseLogLinePrefix(prefix).Match(logline)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fields).To(Equal(expected))
+			Expect(msg).To(Equal(expectedMsg))
+		},
+		Entry(
+			"default prefix",
+			DefaultLogLinePrefix,
+			"2019-02-25 15:08:27.222 GMT|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: select 1",
+			PrefixFields{'m': "2019-02-25 15:08:27.222 GMT", 'u': "alice", 'd': "pgreplay_test", 'c': "5c7404eb.d6bd"},
+			"LOG:  statement: select 1",
+		),
+		Entry(
+			"pgBadger prefix",
+			"%t [%p]: [%l-1] user=%u,db=%d,app=%a,client=%h ",
+			"2019-02-25 15:08:27 UTC [7283]: [3-1] user=alice,db=pgreplay_test,app=psql,client=127.0.0.1 LOG:  statement: select 1",
+			PrefixFields{
+				't': "2019-02-25 15:08:27 UTC", 'p': "7283", 'l': "3", 'u': "alice",
+				'd': "pgreplay_test", 'a': "psql", 'h': "127.0.0.1",
+			},
+			"LOG:  statement: select 1",
+		),
+		Entry(
+			"padded escapes and literal percent",
+			"%m %-6p %% %u@%d ",
+			"2019-02-25 15:08:27.222 GMT 7283   % alice@pgreplay_test LOG:  statement: select 1",
+			PrefixFields{'m': "2019-02-25 15:08:27.222 GMT", 'p': "7283", 'u': "alice", 'd': "pgreplay_test"},
+			"LOG:  statement: select 1",
+		),
+		Entry(
+			"non-session process omitting everything after %q",
+			"%m [%p] %quser=%u,db=%d ",
+			"2019-02-25 15:08:27.222 GMT [7283] LOG:  checkpoint starting: time",
+			PrefixFields{'m': "2019-02-25 15:08:27.222 GMT", 'p': "7283", 'u': "", 'd': ""},
+			"LOG:  checkpoint starting: time",
+		),
+	)
+})
+
+var _ = Describe("PrefixFields", func() {
+	DescribeTable("Parses timestamps with numeric zones",
+		func(fields PrefixFields, expected string) {
+			ts, err := fields.Timestamp()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ts.UTC().Format(time.RFC3339Nano)).To(Equal(expected))
+		},
+		Entry("abbreviation", PrefixFields{'m': "2019-02-25 15:08:27.222 UTC"}, "2019-02-25T15:08:27.222Z"),
+		Entry("hours", PrefixFields{'m': "2019-02-25 18:08:27.222 +03"}, "2019-02-25T15:08:27.222Z"),
+		Entry("hours and minutes", PrefixFields{'t': "2019-02-25 20:38:27 +0530"}, "2019-02-25T15:08:27Z"),
+		Entry("negative hours", PrefixFields{'t': "2019-02-25 12:08:27 -03"}, "2019-02-25T15:08:27Z"),
+	)
+
+	It("Parses lines whose prefix has a numeric zone", func() {
+		prefix := MustParseLogLinePrefix(DefaultLogLinePrefix)
+		item, err := ParsePrefixedItem(
+			"2019-02-25 18:08:27.222 +03|alice|pgreplay_test|5c7404eb.d6bd|LOG:  statement: select 1",
+			prefix, map[string]SessionID{}, map[SessionID]*Unbound{}, make([]byte, MaxLogLineSize),
+		)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(item.GetTimestamp()).To(BeTemporally("==", time20190225))
+	})
+})
+
+var _ = Describe("NewErrlogParser", func() {
+	var (
+		start, _ = time.Parse(PostgresTimestampSecondsFormat, "2019-02-25 15:08:27 UTC")
+	)
+
+	It("derives sessions from the process ID when the prefix lacks %c", func() {
+		input := `
+2019-02-25 15:08:27 UTC [7283]: [1-1] user=[unknown],db=[unknown] LOG:  connection received: host=127.0.0.1 port=59103
+2019-02-25 15:08:27 UTC [7283]: [2-1] user=alice,db=pgreplay_test LOG:  connection authorized: user=alice database=pgreplay_test
+2019-02-25 15:08:28 UTC [7283]: [3-1] user=alice,db=pgreplay_test LOG:  statement: select 1
+2019-02-25 15:08:29 UTC [7283]: [4-1] user=alice,db=pgreplay_test LOG:  disconnection: session time: 0:00:02.000 user=alice database=pgreplay_test host=127.0.0.1 port=59103
+2019-02-25 15:08:30 UTC [7283]: [1-1] user=[unknown],db=[unknown] LOG:  connection received: host=127.0.0.1 port=59104
+2019-02-25 15:08:30 UTC [7283]: [2-1] user=bob,db=pgreplay_test LOG:  connection authorized: user=bob database=pgreplay_test`
+
+		parser := NewErrlogParser(MustParseLogLinePrefix("%t [%p]: [%l-1] user=%u,db=%d "))
+		itemsChan, errs, done := parser(strings.NewReader(input))
+		go func() {
+			for range errs {
+				// no-op, just drain the channel
+			}
+		}()
+
+		var items = []Item{}
+		for item := range itemsChan {
+			if item != nil {
+				items = append(items, item)
+			}
+		}
+
+		Eventually(done).Should(BeClosed())
+		Expect(items).To(HaveLen(4))
+
+		Expect(items[0]).To(BeEquivalentTo(Connect{Details{
+			Timestamp: start, SessionID: "5c7404eb.1c73", User: "alice", Database: "pgreplay_test", BackendPID: 7283,
+		}}))
+		Expect(items[1]).To(BeEquivalentTo(Statement{Details{
+			Timestamp: start.Add(time.Second), SessionID: "5c7404eb.1c73", User: "alice", Database: "pgreplay_test", BackendPID: 7283,
+		}, "select 1", 0}))
+		Expect(items[2].GetSessionID()).To(Equal(SessionID("5c7404eb.1c73")))
+		Expect(items[3].GetSessionID()).To(Equal(SessionID("5c7404ee.1c73")))
+	})
+})
@@ -0,0 +1,270 @@
+package pgreplay
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	captureConnectionsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_capture_connections_total",
+			Help: "Number of client connections proxied by capture",
+		},
+	)
+	captureItemsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_capture_items_total",
+			Help: "Number of replay items recorded by capture",
+		},
+	)
+	captureItemsDroppedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_capture_items_dropped_total",
+			Help: "Number of recorded items dropped as the output couldn't keep up",
+		},
+	)
+	captureErrorsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pgreplay_capture_errors_total",
+			Help: "Number of errors decoding the traffic passing through capture",
+		},
+	)
+)
+
+// Proxy is a transparent Postgres proxy that records the traffic passing through it as
+// replay Items. As we see exactly what clients send, the recording has the real values of
+// every bound parameter, without the cost of logging every statement on the server.
+//
+// We refuse SSL and GSSAPI encryption on behalf of the upstream, so clients must permit
+// unencrypted connections (sslmode=prefer, the default, will do).
+//
+// Recording must never hold up the traffic we're proxying, so items that the output can't
+// keep up with are dropped, and counted in pgreplay_capture_items_dropped_total. Only the
+// connects and disconnects that bound each session wait for the output, as a session
+// missing either can't be replayed.
+type Proxy struct {
+	logger   kitlog.Logger
+	upstream string
+	items    chan Item
+	sync.Mutex
+	sessions uint64
+}
+
+func NewProxy(logger kitlog.Logger, upstream string) *Proxy {
+	return &Proxy{logger: logger, upstream: upstream, items: make(chan Item, ItemBufferSize)}
+}
+
+// Serve accepts connections from the listener, proxying each to the upstream server.
+// Recorded items are sent down the returned channel in the order we observed them within
+// each session, though those of concurrent sessions may interleave out of order by the
+// time it takes to decode them. The channel is closed once the context is cancelled and
+// every open connection has been closed.
+func (p *Proxy) Serve(ctx context.Context, listener net.Listener) chan Item {
+	var wg sync.WaitGroup
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					p.logger.Log("event", "capture.accept_error", "error", err)
+				}
+
+				break
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.proxy(ctx, client)
+			}()
+		}
+
+		wg.Wait()
+		close(p.items)
+	}()
+
+	return p.items
+}
+
+func (p *Proxy) proxy(ctx context.Context, client net.Conn) {
+	defer client.Close()
+
+	var dialer net.Dialer
+	server, err := dialer.DialContext(ctx, "tcp", p.upstream)
+	if err != nil {
+		p.logger.Log("event", "capture.upstream_error", "client", client.RemoteAddr(), "error", err)
+		return
+	}
+
+	defer server.Close()
+
+	captureConnectionsTotal.Inc()
+	session := &capturedSession{WireSession: p.newSession()}
+	logger := kitlog.With(p.logger, "session_id", session.id, "client", client.RemoteAddr())
+	logger.Log("event", "capture.connection")
+
+	clientReader := bufio.NewReader(client)
+	if err := p.refuseEncryption(session, clientReader, client); err != nil {
+		logger.Log("event", "capture.negotiate_error", "error", err)
+		return
+	}
+
+	finished := make(chan struct{}, 2)
+	go func() {
+		p.pipe(clientReader, server, session, session.Frontend)
+		finished <- struct{}{}
+	}()
+	go func() {
+		p.pipe(server, client, session, func(ts time.Time, data []byte) ([]Item, error) {
+			return nil, session.Backend(ts, data)
+		})
+		finished <- struct{}{}
+	}()
+
+	// Once either side hangs up, or we're asked to stop, close both connections to
+	// terminate the other pipe
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+
+	client.Close()
+	server.Close()
+	<-finished
+
+	p.record(session, func(ts time.Time) ([]Item, error) {
+		return []Item{session.Close(ts)}, nil
+	})
+
+	logger.Log("event", "capture.disconnection")
+}
+
+// newSession mirrors the Postgres session ID format of start time and pid, using our count
+// of connections in place of a pid.
+func (p *Proxy) newSession() *WireSession {
+	p.Lock()
+	defer p.Unlock()
+
+	p.sessions++
+
+	return NewWireSession(SessionID(fmt.Sprintf("%x.%x", time.Now().Unix(), p.sessions)))
+}
+
+// refuseEncryption answers any SSLRequest or GSSENCRequest that begins the connection,
+// refusing encryption so the client continues in plaintext and we can decode the session.
+func (p *Proxy) refuseEncryption(session *capturedSession, clientReader *bufio.Reader, client net.Conn) error {
+	for {
+		header, err := clientReader.Peek(8)
+		if err != nil {
+			if err == io.EOF {
+				return nil // the pipe will notice the client has gone
+			}
+
+			return err
+		}
+
+		if code := binary.BigEndian.Uint32(header[4:]); code != wireSSLRequest && code != wireGSSENCRequest {
+			return nil
+		}
+
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(clientReader, request); err != nil {
+			return err
+		}
+
+		if _, err := client.Write([]byte("N")); err != nil {
+			return err
+		}
+
+		p.record(session, func(ts time.Time) ([]Item, error) {
+			items, err := session.Frontend(ts, request)
+			if err != nil {
+				return items, err
+			}
+
+			return items, session.Backend(ts, []byte("N"))
+		})
+	}
+}
+
+// capturedSession guards the decoding of a connection, which sees traffic from both the
+// client and server
+type capturedSession struct {
+	sync.Mutex
+	*WireSession
+}
+
+// pipe copies from src to dst, observing the data before it is forwarded. The server can
+// only answer messages it has received, so this ensures we decode each request before the
+// response that describes it. Failing to decode what we've seen must never interrupt the
+// traffic we're proxying.
+func (p *Proxy) pipe(src io.Reader, dst io.Writer, session *capturedSession, observe func(time.Time, []byte) ([]Item, error)) {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			p.record(session, func(ts time.Time) ([]Item, error) {
+				return observe(ts, buffer[:n])
+			})
+
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// record timestamps and decodes data under the session lock, then hands the items to our
+// output without waiting for it, dropping those it has no room for. Connects and
+// disconnects are the exception, as a session missing either can't be replayed, so we
+// wait for room to send those.
+func (p *Proxy) record(session *capturedSession, decode func(time.Time) ([]Item, error)) {
+	session.Lock()
+	defer session.Unlock()
+
+	items, err := decode(time.Now().UTC())
+	if err != nil {
+		captureErrorsTotal.Inc()
+		p.logger.Log("event", "capture.decode_error", "error", err)
+	}
+
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+
+		if managesSession(item) {
+			p.items <- item
+			captureItemsTotal.Inc()
+			continue
+		}
+
+		select {
+		case p.items <- item:
+			captureItemsTotal.Inc()
+		default:
+			captureItemsDroppedTotal.Inc()
+		}
+	}
+}
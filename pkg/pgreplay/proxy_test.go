@@ -0,0 +1,239 @@
+package pgreplay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+
+	kitlog "github.com/go-kit/log"
+	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgproto3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// standInBackend accepts connections and speaks just enough of the Postgres protocol for
+// pgx to believe it's talking to a real server. Parameter types are described from the
+// given map of query to type OIDs.
+func standInBackend(listener net.Listener, parameterOIDs map[string][]uint32) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			backend := pgproto3.NewBackend(conn, conn)
+			if _, err := backend.ReceiveStartupMessage(); err != nil {
+				return
+			}
+
+			backend.Send(&pgproto3.AuthenticationOk{})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			backend.Flush()
+
+			queries := map[string]string{}
+			for {
+				msg, err := backend.Receive()
+				if err != nil {
+					return
+				}
+
+				switch msg := msg.(type) {
+				case *pgproto3.Query:
+					backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 1")})
+					backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+				case *pgproto3.Parse:
+					queries[msg.Name] = msg.Query
+					backend.Send(&pgproto3.ParseComplete{})
+				case *pgproto3.Describe:
+					if msg.ObjectType == 'S' {
+						backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: parameterOIDs[queries[msg.Name]]})
+					}
+					backend.Send(&pgproto3.NoData{})
+				case *pgproto3.Bind:
+					backend.Send(&pgproto3.BindComplete{})
+				case *pgproto3.Execute:
+					backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+				case *pgproto3.Sync:
+					backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+				case *pgproto3.Terminate:
+					return
+				}
+
+				backend.Flush()
+			}
+		}()
+	}
+}
+
+// writerFunc lets a function observe what is written to it
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(data []byte) (int, error) { return f(data) }
+
+var _ = Describe("Proxy", func() {
+	const (
+		insert      = "insert into logs (author, message) values ('alice', 'says hello');"
+		selectQuery = "select $1::int4 + 1, $2::text"
+	)
+
+	var (
+		ctx      context.Context
+		cancel   func()
+		upstream net.Listener
+		listener net.Listener
+		items    chan Item
+	)
+
+	BeforeEach(func() {
+		var err error
+		ctx, cancel = context.WithCancel(context.Background())
+
+		upstream, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		go standInBackend(upstream, map[string][]uint32{selectQuery: {oidInt4, oidText}})
+
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		items = NewProxy(kitlog.NewNopLogger(), upstream.Addr().String()).Serve(ctx, listener)
+	})
+
+	AfterEach(func() {
+		cancel()
+		upstream.Close()
+	})
+
+	It("Records the sessions of clients connecting through it", func() {
+		conn, err := pgx.Connect(ctx, fmt.Sprintf(
+			"postgres://alice@%s/pgreplay_test?sslmode=prefer&default_query_exec_mode=describe_exec",
+			listener.Addr().String(),
+		))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = conn.Exec(ctx, insert)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = conn.Exec(ctx, selectQuery, 41, "bob")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Close(ctx)).To(Succeed())
+
+		var recorded []Item
+		for idx := 0; idx < 4; idx++ {
+			var item Item
+			Eventually(items).Should(Receive(&item))
+			recorded = append(recorded, item)
+		}
+
+		cancel()
+		Eventually(items).Should(BeClosed())
+
+		for _, item := range recorded {
+			Expect(item.GetSessionID()).To(Equal(recorded[0].GetSessionID()))
+			Expect(item.GetUser()).To(Equal("alice"))
+			Expect(item.GetDatabase()).To(Equal("pgreplay_test"))
+		}
+
+		Expect(recorded[0]).To(BeAssignableToTypeOf(Connect{}))
+		Expect(recorded[1]).To(Equal(Statement{recorded[1].(Statement).Details, insert, 0}))
+		Expect(recorded[2]).To(BeAssignableToTypeOf(BoundExecute{}))
+		Expect(recorded[2].(BoundExecute).Query).To(Equal(selectQuery))
+		Expect(recorded[2].(BoundExecute).Parameters).To(Equal([]interface{}{"41", "bob"}))
+		Expect(recorded[3]).To(BeAssignableToTypeOf(Disconnect{}))
+
+		for idx := 1; idx < len(recorded); idx++ {
+			Expect(recorded[idx].GetTimestamp()).NotTo(BeTemporally("<", recorded[idx-1].GetTimestamp()))
+		}
+	})
+
+	It("Records the parameter types the server describes", func() {
+		conn, err := pgx.Connect(ctx, fmt.Sprintf(
+			"postgres://alice@%s/pgreplay_test?default_query_exec_mode=describe_exec&description_cache_capacity=0",
+			listener.Addr().String(),
+		))
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(items).Should(Receive(BeAssignableToTypeOf(Connect{})))
+
+		// Each execute follows a round trip to describe its statement, which we must have
+		// decoded before the description comes back
+		for idx := 0; idx < 200; idx++ {
+			_, err = conn.Exec(ctx, selectQuery, idx, "bob")
+			Expect(err).NotTo(HaveOccurred())
+
+			var item Item
+			Eventually(items).Should(Receive(&item))
+			Expect(item).To(BeAssignableToTypeOf(BoundExecute{}))
+			Expect(item.(BoundExecute).Parameters).To(Equal([]interface{}{fmt.Sprint(idx), "bob"}))
+			Expect(item.(BoundExecute).ParameterTypes).To(Equal([]uint32{oidInt4, oidText}))
+		}
+
+		Expect(conn.Close(ctx)).To(Succeed())
+		Eventually(items).Should(Receive(BeAssignableToTypeOf(Disconnect{})))
+	})
+
+	It("Decodes what clients send before forwarding it to the server", func() {
+		proxy := NewProxy(kitlog.NewNopLogger(), upstream.Addr().String())
+		session := &capturedSession{WireSession: NewWireSession("a")}
+
+		startup := (&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "alice"},
+		}).Encode(nil)
+
+		var decoded bool
+		forward := writerFunc(func(data []byte) (int, error) {
+			decoded = session.started
+			return len(data), nil
+		})
+
+		proxy.pipe(bytes.NewReader(startup), forward, session, session.Frontend)
+
+		Expect(decoded).To(BeTrue())
+		Expect(proxy.items).To(Receive(BeAssignableToTypeOf(Connect{})))
+	})
+
+	It("Records a disconnect for sessions open when stopped", func() {
+		conn, err := pgx.Connect(ctx, fmt.Sprintf("postgres://alice@%s/pgreplay_test", listener.Addr().String()))
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close(context.Background())
+
+		Eventually(items).Should(Receive(BeAssignableToTypeOf(Connect{})))
+		cancel()
+
+		Eventually(items).Should(Receive(BeAssignableToTypeOf(Disconnect{})))
+		Eventually(items).Should(BeClosed())
+	})
+
+	It("Keeps proxying when the output can't keep up", func() {
+		conn, err := pgx.Connect(ctx, fmt.Sprintf("postgres://alice@%s/pgreplay_test", listener.Addr().String()))
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close(context.Background())
+
+		// Nobody reads our items, so once their buffer fills the rest are dropped
+		for idx := 0; idx < ItemBufferSize+10; idx++ {
+			_, err = conn.Exec(ctx, insert)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(items).To(HaveLen(ItemBufferSize))
+
+		// We never drop the disconnect, which waits until there's room for it
+		Expect(conn.Close(ctx)).To(Succeed())
+
+		var last Item
+		Eventually(func() Item {
+			for {
+				select {
+				case item := <-items:
+					last = item
+				default:
+					return last
+				}
+			}
+		}).Should(BeAssignableToTypeOf(Disconnect{}))
+	})
+})
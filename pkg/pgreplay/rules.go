@@ -0,0 +1,293 @@
+package pgreplay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var itemsRuleFilteredTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pgreplay_items_rule_filtered_total",
+		Help: "Number of items filtered by each include or exclude rule",
+	},
+	[]string{"rule"},
+)
+
+// FilterRuleFields are the item fields that a FilterRule can match against
+var FilterRuleFields = []string{"user", "database", "application_name", "session_id", "query"}
+
+// FilterRule includes or excludes items by one of their fields. Rules are written as
+// 'field=value' to match the value exactly, or 'field~regex' to match a regular
+// expression, such as 'user=alice' or 'query~^SET LOCAL'.
+type FilterRule struct {
+	Exclude bool
+	Field   string
+	Value   string
+	Pattern *regexp.Regexp // nil when matching Value exactly
+}
+
+// ParseFilterRule parses a single 'field=value' or 'field~regex' rule
+func ParseFilterRule(exclude bool, rule string) (FilterRule, error) {
+	idx := strings.IndexAny(rule, "=~")
+	if idx < 0 {
+		return FilterRule{}, fmt.Errorf("rule '%s' must be field=value or field~regex", rule)
+	}
+
+	field, value := rule[:idx], rule[idx+1:]
+
+	known := false
+	for _, candidate := range FilterRuleFields {
+		known = known || field == candidate
+	}
+
+	if !known {
+		return FilterRule{}, fmt.Errorf(
+			"rule '%s' has unknown field '%s', must be one of %s", rule, field, strings.Join(FilterRuleFields, ", "),
+		)
+	}
+
+	parsed := FilterRule{Exclude: exclude, Field: field, Value: value}
+	if rule[idx] == '~' {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return FilterRule{}, fmt.Errorf("rule '%s' has invalid regex: %v", rule, err)
+		}
+
+		parsed.Pattern = pattern
+	}
+
+	return parsed, nil
+}
+
+// LoadFilterRules reads rules from a file with one rule per line, each prefixed by
+// 'include' or 'exclude'. Blank lines and lines beginning with # are ignored:
+//
+//	# Only replay our API, without its health checks
+//	include application_name~^puma
+//	exclude query~^SELECT 1$
+func LoadFilterRules(input io.Reader) ([]FilterRule, error) {
+	var rules []FilterRule
+
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		action, rule, _ := strings.Cut(text, " ")
+		if action != "include" && action != "exclude" {
+			return nil, fmt.Errorf("line %d: rule must begin with include or exclude: '%s'", line, text)
+		}
+
+		parsed, err := ParseFilterRule(action == "exclude", strings.TrimSpace(rule))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		rules = append(rules, parsed)
+	}
+
+	return rules, scanner.Err()
+}
+
+func (r FilterRule) String() string {
+	action, operator := "include", "="
+	if r.Exclude {
+		action = "exclude"
+	}
+	if r.Pattern != nil {
+		operator = "~"
+	}
+
+	return action + " " + r.Field + operator + r.Value
+}
+
+// match reports whether the item has the rule's field and whether its value matches.
+// Query rules only apply to items with a query. Connects and disconnects often don't
+// record every field of their session, such as the application_name that csvlogs leave
+// empty when the connection is authorised, so rules don't apply to those they lack.
+func (r FilterRule) match(item Item) (applies, matches bool) {
+	var value string
+
+	switch r.Field {
+	case "user":
+		value = item.GetUser()
+	case "database":
+		value = item.GetDatabase()
+	case "application_name":
+		value = item.GetApplicationName()
+	case "session_id":
+		value = string(item.GetSessionID())
+	case "query":
+		query, ok := itemQuery(item)
+		if !ok {
+			return false, false
+		}
+
+		value = query
+	}
+
+	if value == "" && managesSession(item) {
+		return false, false
+	}
+
+	if r.Pattern != nil {
+		return true, r.Pattern.MatchString(value)
+	}
+
+	return true, value == r.Value
+}
+
+// ItemFilter applies a set of include and exclude rules to items. Items are dropped if
+// they match any exclude rule. When there are include rules for a field, items must
+// match at least one of them, so rules on different fields must all be satisfied.
+//
+// Filter gives the disconnect of a session the same fate as its connect, so that the
+// statements we keep never lose the connection they run on, and we never leave one open.
+type ItemFilter struct {
+	excludes []FilterRule
+	includes [][]FilterRule // grouped by field
+}
+
+func NewItemFilter(rules []FilterRule) ItemFilter {
+	var filter ItemFilter
+
+	fields := map[string]int{}
+	for _, rule := range rules {
+		// Initialise the counter so every rule is reported, even if it never drops
+		itemsRuleFilteredTotal.WithLabelValues(rule.String())
+
+		if rule.Exclude {
+			filter.excludes = append(filter.excludes, rule)
+			continue
+		}
+
+		idx, ok := fields[rule.Field]
+		if !ok {
+			idx = len(filter.includes)
+			fields[rule.Field] = idx
+			filter.includes = append(filter.includes, nil)
+		}
+
+		filter.includes[idx] = append(filter.includes[idx], rule)
+	}
+
+	return filter
+}
+
+// Drops returns the rule responsible for dropping the item, if it should be dropped.
+// Items that fail to match the include rules of a field are attributed to the first
+// include rule for that field.
+func (f ItemFilter) Drops(item Item) (FilterRule, bool) {
+	for _, rule := range f.excludes {
+		if _, matches := rule.match(item); matches {
+			return rule, true
+		}
+	}
+
+	for _, group := range f.includes {
+		included := false
+		for _, rule := range group {
+			applies, matches := rule.match(item)
+			if !applies || matches {
+				included = true
+				break
+			}
+		}
+
+		if !included {
+			return group[0], true
+		}
+	}
+
+	return FilterRule{}, false
+}
+
+// Filter removes the items dropped by our rules from the stream, along with any nils
+func (f ItemFilter) Filter(items chan Item) chan Item {
+	if len(f.excludes) == 0 && len(f.includes) == 0 {
+		return items
+	}
+
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		// The rule that dropped the connect of each open session, or nil if we kept it
+		connects := map[SessionID]*FilterRule{}
+
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			rule, drop := f.Drops(item)
+
+			switch item.(type) {
+			case Connect, *Connect:
+				connects[item.GetSessionID()] = nil
+				if drop {
+					connects[item.GetSessionID()] = &rule
+				}
+			case Disconnect, *Disconnect:
+				if connect, ok := connects[item.GetSessionID()]; ok {
+					delete(connects, item.GetSessionID())
+					if drop = connect != nil; drop {
+						rule = *connect
+					}
+				}
+			}
+
+			if drop {
+				itemsRuleFilteredTotal.WithLabelValues(rule.String()).Inc()
+				continue
+			}
+
+			out <- item
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+// itemQuery returns the query of items that run or prepare one
+func itemQuery(item Item) (string, bool) {
+	switch item := item.(type) {
+	case Statement:
+		return item.Query, true
+	case *Statement:
+		return item.Query, true
+	case BoundExecute:
+		return item.Query, true
+	case *BoundExecute:
+		return item.Query, true
+	case ExecutePrepared:
+		return item.Query, true
+	case *ExecutePrepared:
+		return item.Query, true
+	case Prepare:
+		return item.Query, true
+	case *Prepare:
+		return item.Query, true
+	default:
+		return "", false
+	}
+}
+
+// managesSession reports whether the item opens or closes a session
+func managesSession(item Item) bool {
+	switch item.(type) {
+	case Connect, *Connect, Disconnect, *Disconnect:
+		return true
+	default:
+		return false
+	}
+}
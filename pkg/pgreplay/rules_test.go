@@ -0,0 +1,170 @@
+package pgreplay
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FilterRule", func() {
+	DescribeTable("Parses",
+		func(rule, expected string) {
+			parsed, err := ParseFilterRule(false, rule)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.String()).To(Equal(expected))
+		},
+		Entry("exact value", "user=alice", "include user=alice"),
+		Entry("regex", "query~^SET LOCAL", "include query~^SET LOCAL"),
+		Entry("value containing operators", "application_name=a=b~c", "include application_name=a=b~c"),
+	)
+
+	DescribeTable("Rejects",
+		func(rule, message string) {
+			_, err := ParseFilterRule(false, rule)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("missing operator", "alice", "must be field=value or field~regex"),
+		Entry("unknown field", "host=db", "unknown field 'host'"),
+		Entry("invalid regex", "query~(", "invalid regex"),
+	)
+
+	It("Loads rules from a file", func() {
+		rules, err := LoadFilterRules(strings.NewReader(`
+# Only replay our API
+include application_name~^puma
+
+exclude query~^SELECT 1$
+`))
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].String()).To(Equal("include application_name~^puma"))
+		Expect(rules[1].String()).To(Equal("exclude query~^SELECT 1$"))
+	})
+
+	It("Reports the line of invalid rules", func() {
+		_, err := LoadFilterRules(strings.NewReader("include user=alice\ndrop user=bob\n"))
+		Expect(err).To(MatchError(ContainSubstring("line 2: rule must begin with include or exclude")))
+	})
+})
+
+var _ = Describe("ItemFilter", func() {
+	var (
+		details = func(user, application string) Details {
+			return Details{Timestamp: time20190225, SessionID: "a", User: user, Database: "pgreplay_test", ApplicationName: application}
+		}
+		mustParse = func(exclude bool, rule string) FilterRule {
+			parsed, err := ParseFilterRule(exclude, rule)
+			Expect(err).NotTo(HaveOccurred())
+
+			return parsed
+		}
+	)
+
+	DescribeTable("Drops",
+		func(rules []string, item Item, expected string) {
+			var parsed []FilterRule
+			for _, rule := range rules {
+				exclude := strings.HasPrefix(rule, "!")
+				parsed = append(parsed, mustParse(exclude, strings.TrimPrefix(rule, "!")))
+			}
+
+			rule, drop := NewItemFilter(parsed).Drops(item)
+			if expected == "" {
+				Expect(drop).To(BeFalse())
+			} else {
+				Expect(drop).To(BeTrue())
+				Expect(rule.String()).To(Equal(expected))
+			}
+		},
+		Entry("no rules",
+			[]string{}, Connect{details("alice", "")}, ""),
+		Entry("matching an exclude",
+			[]string{"!user=alice"}, Connect{details("alice", "")}, "exclude user=alice"),
+		Entry("matching any include of a field",
+			[]string{"user=bob", "user=alice"}, Connect{details("alice", "")}, ""),
+		Entry("failing the includes of a field",
+			[]string{"user=bob", "user=carol"}, Connect{details("alice", "")}, "include user=bob"),
+		Entry("failing the includes of any field",
+			[]string{"user=alice", "application_name~^puma"}, Connect{details("alice", "sidekiq")}, "include application_name~^puma"),
+		Entry("excluded query of a bound execute",
+			[]string{"!query~^SET LOCAL"},
+			Execute{details("alice", ""), "SET LOCAL statement_timeout = $1", 0}.Bind([]interface{}{"1s"}),
+			"exclude query~^SET LOCAL"),
+		Entry("not a connect when including queries",
+			[]string{"query~^select"}, Connect{details("alice", "")}, ""),
+		Entry("statements not matching an included query",
+			[]string{"query~^select"}, Statement{details("alice", ""), "insert into logs", 0}, "include query~^select"),
+		Entry("a connect without the application name of an include",
+			[]string{"application_name~^puma"}, Connect{details("alice", "")}, ""),
+		Entry("a statement without the application name of an include",
+			[]string{"application_name~^puma"}, Statement{details("alice", ""), "select 1", 0}, "include application_name~^puma"),
+	)
+
+	It("Keeps sessions whose connect lacks the application name", func() {
+		items := make(chan Item, 8)
+		for _, application := range []string{"puma: [app]", "sidekiq"} {
+			session := details("alice", application)
+			session.SessionID = SessionID(application)
+
+			connect := session
+			connect.ApplicationName = "" // csvlogs authorise connections before the name is set
+
+			items <- Connect{connect}
+			items <- Statement{session, "select 1", 0}
+			items <- Disconnect{session}
+		}
+		close(items)
+
+		var filtered []Item
+		for item := range NewItemFilter([]FilterRule{mustParse(false, "application_name~^puma")}).Filter(items) {
+			filtered = append(filtered, item)
+		}
+
+		// The sidekiq session is reduced to its connect and disconnect, which we can't
+		// tell apart from those of puma
+		Expect(filtered).To(HaveLen(5))
+		Expect(filtered[1]).To(BeAssignableToTypeOf(Statement{}))
+		Expect(filtered[1].GetApplicationName()).To(Equal("puma: [app]"))
+		for _, item := range filtered[3:] {
+			Expect(item.GetSessionID()).To(Equal(SessionID("sidekiq")))
+		}
+	})
+
+	It("Keeps the disconnect of sessions whose connect was kept", func() {
+		items := make(chan Item, 3)
+		items <- Connect{details("alice", "")}
+		items <- Statement{details("alice", "puma: [app]"), "select 1", 0}
+		items <- Disconnect{details("alice", "puma: [app]")}
+		close(items)
+
+		var filtered []Item
+		for item := range NewItemFilter([]FilterRule{mustParse(true, "application_name~^puma")}).Filter(items) {
+			filtered = append(filtered, item)
+		}
+
+		Expect(filtered).To(Equal([]Item{Connect{details("alice", "")}, Disconnect{details("alice", "puma: [app]")}}))
+	})
+
+	It("Filters items from the stream", func() {
+		items := make(chan Item, 4)
+		items <- Connect{details("alice", "")}
+		items <- nil
+		items <- Statement{details("alice", ""), "SET LOCAL lock_timeout = '1s'", 0}
+		items <- Statement{details("alice", ""), "select 1", 0}
+		close(items)
+
+		var filtered []Item
+		for item := range NewItemFilter([]FilterRule{mustParse(true, "query~^SET LOCAL")}).Filter(items) {
+			filtered = append(filtered, item)
+		}
+
+		Expect(filtered).To(Equal([]Item{
+			Connect{details("alice", "")},
+			Statement{details("alice", ""), "select 1", 0},
+		}))
+	})
+})
@@ -0,0 +1,135 @@
+package pgreplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// SessionSampler keeps a deterministic fraction of whole sessions, so that every item of
+// a kept session survives, from its connection to its disconnection. The same seed always
+// chooses the same sessions.
+//
+// Sessions are chosen by hashing their ID. When stratified by user or database, sessions
+// are instead chosen evenly within each user or database as they first appear, so that
+// each keeps the same fraction of its sessions and the mix of the workload is preserved.
+type SessionSampler struct {
+	fraction float64
+	seed     int64
+	by       string
+
+	kept   map[SessionID]bool
+	strata map[string]*sampleStratum
+}
+
+type sampleStratum struct {
+	offset   float64
+	sessions int
+}
+
+// SampleStrata are the fields that a SessionSampler can stratify by
+var SampleStrata = []string{"user", "database"}
+
+// NewSessionSampler creates a sampler keeping the given fraction of sessions, optionally
+// stratified by user or database.
+func NewSessionSampler(fraction float64, seed int64, by string) (*SessionSampler, error) {
+	if fraction <= 0 || fraction > 1 {
+		return nil, fmt.Errorf("must be greater than 0 and at most 1, not %v", fraction)
+	}
+
+	if by != "" && by != "user" && by != "database" {
+		return nil, fmt.Errorf("cannot stratify sessions by '%s', must be user or database", by)
+	}
+
+	return &SessionSampler{
+		fraction: fraction,
+		seed:     seed,
+		by:       by,
+		kept:     map[SessionID]bool{},
+		strata:   map[string]*sampleStratum{},
+	}, nil
+}
+
+// Sample drops every item of the sessions we don't keep
+func (s *SessionSampler) Sample(items chan Item) chan Item {
+	if s.fraction == 1 {
+		return items
+	}
+
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			if s.Keeps(item) {
+				out <- item
+			}
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+// Keeps reports whether the item belongs to a session we keep
+func (s *SessionSampler) Keeps(item Item) bool {
+	if s.by == "" {
+		return s.hash(string(item.GetSessionID())) < s.fraction
+	}
+
+	kept, ok := s.kept[item.GetSessionID()]
+	if !ok {
+		kept = s.choose(item)
+		s.kept[item.GetSessionID()] = kept
+	}
+
+	// We won't see this session again, so forget it to bound our memory
+	switch item.(type) {
+	case Disconnect, *Disconnect:
+		delete(s.kept, item.GetSessionID())
+	}
+
+	return kept
+}
+
+// choose decides whether to keep a new session of a stratum. Each stratum keeps a session
+// whenever its running total of the fraction passes a whole number, beginning from a
+// seeded offset, so that strata with few sessions aren't always sampled alike.
+func (s *SessionSampler) choose(item Item) bool {
+	key := item.GetUser()
+	if s.by == "database" {
+		key = item.GetDatabase()
+	}
+
+	stratum, ok := s.strata[key]
+	if !ok {
+		stratum = &sampleStratum{offset: s.hash(s.by + "\x00" + key)}
+		s.strata[key] = stratum
+	}
+
+	before := math.Floor(stratum.offset + float64(stratum.sessions)*s.fraction)
+	stratum.sessions++
+
+	return math.Floor(stratum.offset+float64(stratum.sessions)*s.fraction) > before
+}
+
+// hash maps the value and our seed to a number in [0, 1)
+func (s *SessionSampler) hash(value string) float64 {
+	hash := fnv.New64a()
+	binary.Write(hash, binary.BigEndian, s.seed)
+	hash.Write([]byte(value))
+
+	// FNV mixes the last bytes poorly into the high bits, which decide our result, so
+	// finish with the mixing function of splitmix64
+	mixed := hash.Sum64()
+	mixed = (mixed ^ (mixed >> 30)) * 0xbf58476d1ce4e5b9
+	mixed = (mixed ^ (mixed >> 27)) * 0x94d049bb133111eb
+	mixed ^= mixed >> 31
+
+	return float64(mixed>>11) / (1 << 53)
+}
@@ -0,0 +1,99 @@
+package pgreplay
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SessionSampler", func() {
+	var (
+		// sessions creates a connect, statement and disconnect for each session, with the
+		// sessions of each user interleaved
+		sessions = func(users map[string]int) []Item {
+			var items []Item
+			for user, count := range users {
+				for idx := 0; idx < count; idx++ {
+					details := Details{Timestamp: time20190225, SessionID: SessionID(fmt.Sprintf("%s-%d", user, idx)), User: user, Database: "pgreplay_test"}
+					items = append(items, Connect{details}, Statement{details, "select 1", 0}, &Disconnect{details})
+				}
+			}
+
+			return items
+		}
+		sample = func(sampler *SessionSampler, items []Item) []Item {
+			in := make(chan Item, len(items))
+			for _, item := range items {
+				in <- item
+			}
+			close(in)
+
+			var out []Item
+			for item := range sampler.Sample(in) {
+				out = append(out, item)
+			}
+
+			return out
+		}
+		keptSessions = func(items []Item) map[SessionID]int {
+			kept := map[SessionID]int{}
+			for _, item := range items {
+				kept[item.GetSessionID()]++
+			}
+
+			return kept
+		}
+	)
+
+	It("Keeps a deterministic fraction of whole sessions", func() {
+		items := sessions(map[string]int{"alice": 1000})
+
+		sampler, err := NewSessionSampler(0.1, 42, "")
+		Expect(err).NotTo(HaveOccurred())
+
+		kept := keptSessions(sample(sampler, items))
+		Expect(len(kept)).To(BeNumerically("~", 100, 30))
+		for _, count := range kept {
+			Expect(count).To(Equal(3))
+		}
+
+		again, _ := NewSessionSampler(0.1, 42, "")
+		Expect(keptSessions(sample(again, items))).To(Equal(kept))
+
+		reseeded, _ := NewSessionSampler(0.1, 7, "")
+		Expect(keptSessions(sample(reseeded, items))).NotTo(Equal(kept))
+	})
+
+	It("Keeps the same fraction of each user when stratified", func() {
+		sampler, err := NewSessionSampler(0.25, 42, "user")
+		Expect(err).NotTo(HaveOccurred())
+
+		perUser := map[string]int{}
+		for _, item := range sample(sampler, sessions(map[string]int{"alice": 100, "bob": 8, "carol": 2})) {
+			if _, ok := item.(Connect); ok {
+				perUser[item.GetUser()]++
+			}
+		}
+
+		Expect(perUser["alice"]).To(Equal(25))
+		Expect(perUser["bob"]).To(Equal(2))
+		Expect(perUser["carol"]).To(BeNumerically("<=", 1))
+	})
+
+	It("Passes everything through when keeping every session", func() {
+		sampler, err := NewSessionSampler(1, 0, "")
+		Expect(err).NotTo(HaveOccurred())
+
+		in := make(chan Item)
+		Expect(sampler.Sample(in)).To(Equal(in))
+	})
+
+	It("Rejects invalid fractions and strata", func() {
+		_, err := NewSessionSampler(0, 0, "")
+		Expect(err).To(MatchError(ContainSubstring("greater than 0")))
+
+		_, err = NewSessionSampler(0.5, 0, "application_name")
+		Expect(err).To(MatchError(ContainSubstring("cannot stratify sessions by 'application_name'")))
+	})
+})
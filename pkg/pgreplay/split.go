@@ -0,0 +1,115 @@
+package pgreplay
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"time"
+)
+
+// SplitKeys are the fields by which items can be partitioned into shards. Each is
+// constant across a session, so sessions are never split between shards.
+var SplitKeys = []string{"session", "user", "database"}
+
+// ShardSummary describes the items written to one shard
+type ShardSummary struct {
+	Path     string     `json:"path"`
+	Items    int        `json:"items"`
+	Sessions int        `json:"sessions"`
+	Bytes    int64      `json:"bytes"`
+	First    *time.Time `json:"first,omitempty"` // nil for empty shards
+	Last     *time.Time `json:"last,omitempty"`
+}
+
+// ShardManifest records how a log was split, so the shards can be replayed in parallel
+// from several hosts.
+type ShardManifest struct {
+	By     string         `json:"by"`
+	Shards []ShardSummary `json:"shards"`
+}
+
+// ShardOf chooses the shard of an item, by hashing its session ID, user or database
+func ShardOf(item Item, by string, shards int) int {
+	var key string
+	switch by {
+	case "user":
+		key = item.GetUser()
+	case "database":
+		key = item.GetDatabase()
+	default:
+		key = string(item.GetSessionID())
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return int(hash.Sum32() % uint32(shards))
+}
+
+// Shard is one output of SplitItems, along with the spool that holds its items while we
+// tally its metadata header
+type Shard struct {
+	Output io.Writer
+	Spool  io.ReadWriteSeeker
+}
+
+// SplitItems partitions items between the shards, writing each as a JSON log that begins
+// with a metadata header completed from the given metadata. Items are written in the order
+// we receive them, so each shard keeps the timestamp order of the input. The summaries
+// are returned in the order of the shards.
+func SplitItems(items chan Item, by string, metadata JSONMetadata, shards []Shard) ([]ShardSummary, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("must split into at least one shard")
+	}
+
+	writers := make([]*jsonLogWriter, len(shards))
+	for idx, shard := range shards {
+		shardMetadata := metadata
+		shardMetadata.Filters = append(
+			append([]string{}, metadata.Filters...), fmt.Sprintf("shard %d of %d by %s", idx+1, len(shards), by),
+		)
+
+		writers[idx] = newJSONLogWriter(shard.Spool, shardMetadata)
+	}
+
+	for item := range items {
+		if item == nil {
+			continue
+		}
+
+		if err := writers[ShardOf(item, by, len(shards))].Write(item); err != nil {
+			return nil, err
+		}
+	}
+
+	summaries := make([]ShardSummary, len(shards))
+	for idx, writer := range writers {
+		output := &countingWriter{Writer: shards[idx].Output}
+		completed, err := writer.Finish(output)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries[idx] = ShardSummary{
+			Items:    completed.Items,
+			Sessions: completed.Sessions,
+			Bytes:    output.written,
+			First:    completed.First,
+			Last:     completed.Last,
+		}
+	}
+
+	return summaries, nil
+}
+
+type countingWriter struct {
+	io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+
+	return n, err
+}
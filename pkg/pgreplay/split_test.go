@@ -0,0 +1,133 @@
+package pgreplay
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SplitItems", func() {
+	var (
+		logs  [][]byte
+		items = func() chan Item {
+			in := make(chan Item, 40)
+			for idx := 0; idx < 10; idx++ {
+				details := Details{
+					Timestamp: time20190225.Add(time.Duration(idx) * time.Second),
+					SessionID: SessionID(fmt.Sprintf("session-%d", idx)),
+					User:      fmt.Sprintf("user-%d", idx%3),
+					Database:  "pgreplay_test",
+				}
+
+				in <- Connect{details}
+				in <- Statement{details, "select 1", 0}
+				in <- Disconnect{details}
+			}
+			close(in)
+
+			return in
+		}
+		split = func(by string, shards int) ([]ShardSummary, []chan Item) {
+			buffers := make([]*bytes.Buffer, shards)
+			outputs := make([]Shard, shards)
+			for idx := range buffers {
+				spool, err := os.CreateTemp("", "pgreplay-spool")
+				Expect(err).NotTo(HaveOccurred())
+
+				defer os.Remove(spool.Name())
+				defer spool.Close()
+
+				buffers[idx] = &bytes.Buffer{}
+				outputs[idx] = Shard{Output: buffers[idx], Spool: spool}
+			}
+
+			summaries, err := SplitItems(items(), by, JSONMetadata{SourceFormat: "json"}, outputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			logs = make([][]byte, shards)
+			parsed := make([]chan Item, shards)
+			for idx, buffer := range buffers {
+				logs[idx] = buffer.Bytes()
+				parsed[idx], _, _ = ParseJSON(bytes.NewReader(logs[idx]))
+			}
+
+			return summaries, parsed
+		}
+	)
+
+	It("Keeps sessions intact and in order within their shard", func() {
+		summaries, shards := split("session", 3)
+
+		var total, sessions int
+		for idx, shard := range shards {
+			var previous time.Time
+			for item := range shard {
+				if item == nil {
+					continue
+				}
+
+				Expect(ShardOf(item, "session", 3)).To(Equal(idx))
+				Expect(item.GetTimestamp()).NotTo(BeTemporally("<", previous))
+				previous = item.GetTimestamp()
+				total++
+			}
+
+			sessions += summaries[idx].Sessions
+			Expect(summaries[idx].Items).To(Equal(3 * summaries[idx].Sessions))
+		}
+
+		Expect(total).To(Equal(30))
+		Expect(sessions).To(Equal(10))
+	})
+
+	It("Summarises the time range and size of each shard", func() {
+		summaries, _ := split("database", 2)
+
+		shard := ShardOf(Connect{Details{Database: "pgreplay_test"}}, "database", 2)
+		Expect(summaries[shard].Items).To(Equal(30))
+		Expect(*summaries[shard].First).To(Equal(time20190225))
+		Expect(*summaries[shard].Last).To(Equal(time20190225.Add(9 * time.Second)))
+		Expect(summaries[shard].Bytes).To(BeNumerically(">", 0))
+		Expect(summaries[1-shard].Items).To(BeZero())
+		Expect(summaries[1-shard].First).To(BeNil())
+	})
+
+	It("Begins every shard with a metadata header", func() {
+		summaries, _ := split("session", 3)
+
+		for idx, log := range logs {
+			metadata, err := ReadJSONMetadata(bytes.NewReader(log))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata).NotTo(BeNil())
+
+			Expect(metadata.SourceFormat).To(Equal("json"))
+			Expect(metadata.Filters).To(Equal([]string{fmt.Sprintf("shard %d of 3 by session", idx+1)}))
+			Expect(metadata.Items).To(Equal(summaries[idx].Items))
+		}
+	})
+
+	It("Places every session of a user in the same shard", func() {
+		_, shards := split("user", 4)
+
+		users := map[string]int{}
+		for idx, shard := range shards {
+			for item := range shard {
+				if item == nil {
+					continue
+				}
+
+				if previous, ok := users[item.GetUser()]; ok {
+					Expect(previous).To(Equal(idx))
+				}
+
+				users[item.GetUser()] = idx
+			}
+		}
+
+		Expect(users).To(HaveLen(3))
+	})
+})
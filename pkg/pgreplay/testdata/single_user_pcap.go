@@ -0,0 +1,173 @@
+//go:build ignore
+
+// Generates single_user.pcap, a capture of the conversation pgx has with Postgres when
+// running integration/testdata/single_user.go, along with an encrypted session that
+// should be ignored. The client's segments are delivered out of order and retransmitted,
+// as happens in real captures.
+//
+//	go run testdata/single_user_pcap.go > testdata/single_user.pcap
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+var (
+	start  = time.Date(2019, time.February, 25, 15, 8, 27, 0, time.UTC)
+	client = []byte{10, 0, 0, 2}
+	server = []byte{10, 0, 0, 1}
+)
+
+type message struct {
+	fromClient bool
+	data       []byte
+}
+
+func main() {
+	out := new(bytes.Buffer)
+	write := func(data ...interface{}) {
+		for _, value := range data {
+			binary.Write(out, binary.LittleEndian, value)
+		}
+	}
+
+	// Global header: microsecond timestamps, version 2.4, snaplen 65535, ethernet
+	write(uint32(0xa1b2c3d4), uint16(2), uint16(4), int32(0), uint32(0), uint32(65535), uint32(1))
+
+	ts := start
+	packet := func(srcPort, dstPort uint16, seq uint32, flags byte, payload []byte) {
+		ts = ts.Add(time.Millisecond)
+		frame := ethernet(srcPort, dstPort, seq, flags, payload)
+		write(uint32(ts.Unix()), uint32(ts.Nanosecond()/1000), uint32(len(frame)), uint32(len(frame)))
+		out.Write(frame)
+	}
+
+	conversation := func(clientPort uint16, messages []message, reorder bool) {
+		clientSeq, serverSeq := uint32(1000), uint32(5000)
+
+		packet(clientPort, 5432, clientSeq-1, 0x02, nil)
+		packet(5432, clientPort, serverSeq-1, 0x12, nil)
+
+		for _, msg := range messages {
+			if msg.fromClient {
+				if reorder && len(msg.data) > 8 {
+					// Send the second half before the first, then retransmit both
+					half := len(msg.data) / 2
+					packet(clientPort, 5432, clientSeq+uint32(half), 0x18, msg.data[half:])
+					packet(clientPort, 5432, clientSeq, 0x18, msg.data[:half])
+					packet(clientPort, 5432, clientSeq, 0x18, msg.data)
+				} else {
+					packet(clientPort, 5432, clientSeq, 0x18, msg.data)
+				}
+
+				clientSeq += uint32(len(msg.data))
+			} else {
+				packet(5432, clientPort, serverSeq, 0x18, msg.data)
+				serverSeq += uint32(len(msg.data))
+			}
+		}
+
+		packet(clientPort, 5432, clientSeq, 0x11, nil)
+		packet(5432, clientPort, serverSeq, 0x11, nil)
+	}
+
+	someoneSeesUser := `insert into logs (author, message) (
+  select $1, format('sees %s of %s''s logs', count(*), $2::text) from logs where author = $2
+);`
+
+	conversation(51000, []message{
+		{true, sslRequest()},
+		{false, []byte("N")},
+		{true, startup("alice", "pgreplay_test")},
+		{false, typed('R', u32(0))},
+		{false, typed('Z', []byte("I"))},
+		{true, typed('Q', cstring("insert into logs (author, message) values ('alice', 'says hello');"))},
+		{false, typed('C', cstring("INSERT 0 1"))},
+		{false, typed('Z', []byte("I"))},
+		// Named prepared statement, where the server describes the parameter types
+		{true, concat(
+			typed('P', cstring("someone_sees_user"), cstring(someoneSeesUser), u16(0)),
+			typed('D', []byte("S"), cstring("someone_sees_user")),
+			typed('S'),
+		)},
+		{false, concat(typed('1'), typed('t', u16(2), u32(25), u32(25)), typed('n'), typed('Z', []byte("I")))},
+		{true, concat(
+			typed('B', cstring(""), cstring("someone_sees_user"), u16(1), u16(0), u16(2), param("alice"), param("alice"), u16(0)),
+			typed('E', cstring(""), u32(0)),
+			typed('S'),
+		)},
+		{false, concat(typed('2'), typed('C', cstring("INSERT 0 1")), typed('Z', []byte("I")))},
+		// Unnamed statement with binary parameters, one of which has a type from the Parse
+		{true, concat(
+			typed('P', cstring(""), cstring("select $1::int4 + 1, $2::text"), u16(1), u32(23)),
+			typed('D', []byte("S"), cstring("")),
+			typed('S'),
+		)},
+		{false, concat(typed('1'), typed('t', u16(2), u32(23), u32(25)), typed('T', u16(0)), typed('Z', []byte("I")))},
+		{true, concat(
+			typed('B', cstring(""), cstring(""), u16(1), u16(1), u16(2), param(string(u32(41))), param("bob"), u16(0)),
+			typed('E', cstring(""), u32(0)),
+			typed('S'),
+		)},
+		{false, concat(typed('2'), typed('C', cstring("SELECT 1")), typed('Z', []byte("I")))},
+		{true, typed('X')},
+	}, true)
+
+	// An encrypted session, which we can't decode
+	conversation(51001, []message{
+		{true, sslRequest()},
+		{false, []byte("S")},
+		{true, []byte{0x16, 0x03, 0x01, 0x00, 0x05, 1, 2, 3, 4, 5}},
+	}, false)
+
+	os.Stdout.Write(out.Bytes())
+}
+
+func ethernet(srcPort, dstPort uint16, seq uint32, flags byte, payload []byte) []byte {
+	srcIP, dstIP := client, server
+	if srcPort == 5432 {
+		srcIP, dstIP = server, client
+	}
+
+	tcp := concat(u16(srcPort), u16(dstPort), u32(seq), u32(0), []byte{5 << 4, flags}, u16(65535), u16(0), u16(0), payload)
+	ip := concat([]byte{0x45, 0}, u16(uint16(20+len(tcp))), u16(0), u16(0x4000), []byte{64, 6}, u16(0), srcIP, dstIP, tcp)
+
+	return concat([]byte{0, 0, 0, 0, 0, 1}, []byte{0, 0, 0, 0, 0, 2}, u16(0x0800), ip)
+}
+
+func sslRequest() []byte {
+	return concat(u32(8), u32(80877103))
+}
+
+func startup(user, database string) []byte {
+	body := concat(u32(196608), cstring("user"), cstring(user), cstring("database"), cstring(database), []byte{0})
+	return concat(u32(uint32(4+len(body))), body)
+}
+
+func typed(msgType byte, parts ...[]byte) []byte {
+	body := concat(parts...)
+	return concat([]byte{msgType}, u32(uint32(4+len(body))), body)
+}
+
+func param(value string) []byte {
+	return concat(u32(uint32(len(value))), []byte(value))
+}
+
+func cstring(value string) []byte {
+	return append([]byte(value), 0)
+}
+
+func u16(value uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, value)
+}
+
+func u32(value uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, value)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
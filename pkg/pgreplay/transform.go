@@ -0,0 +1,260 @@
+package pgreplay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TransformPresets are named sets of transformation rules for common adjustments to a
+// workload before replay.
+var TransformPresets = map[string][]string{
+	// Removing transactions avoids skipping work when a statement within one fails, as
+	// we replay out of order. SET LOCAL would persist for the whole session without its
+	// transaction, so we drop it too.
+	"strip-transactions": {
+		`drop (?i)^\s*(BEGIN|START\s+TRANSACTION|COMMIT|END|ROLLBACK|ABORT|SAVEPOINT|RELEASE)\b`,
+		`drop (?i)^\s*SET\s+LOCAL\b`,
+	},
+	// Shared advisory locks never block each other, yet ask the database to do similar
+	// work to the exclusive locks taken in production.
+	"shared-advisory-locks": {
+		`rename pg_advisory_lock => pg_advisory_lock_shared`,
+		`rename pg_try_advisory_lock => pg_try_advisory_lock_shared`,
+		`rename pg_advisory_xact_lock => pg_advisory_xact_lock_shared`,
+		`rename pg_try_advisory_xact_lock => pg_try_advisory_xact_lock_shared`,
+		`rename pg_advisory_unlock => pg_advisory_unlock_shared`,
+	},
+}
+
+// TransformRule modifies the queries of the items we replay. Rules are written as one of:
+//
+//	drop <regex>                    drop items whose query matches
+//	rewrite <regex> => <replacement> replace every match, expanding $1 style references
+//	rename <function> => <function>  rename calls to a function
+type TransformRule struct {
+	Drop        bool
+	Pattern     *regexp.Regexp
+	Replacement string
+	text        string
+}
+
+func (r TransformRule) String() string { return r.text }
+
+// ParseTransformRule parses a single drop, rewrite or rename rule
+func ParseTransformRule(rule string) (TransformRule, error) {
+	action, args, _ := strings.Cut(strings.TrimSpace(rule), " ")
+	args = strings.TrimSpace(args)
+
+	if action == "drop" {
+		pattern, err := regexp.Compile(args)
+		if err != nil {
+			return TransformRule{}, fmt.Errorf("rule '%s' has invalid regex: %v", rule, err)
+		}
+
+		return TransformRule{Drop: true, Pattern: pattern, text: rule}, nil
+	}
+
+	from, to, ok := strings.Cut(args, " => ")
+	if !ok || (action != "rewrite" && action != "rename") {
+		return TransformRule{}, fmt.Errorf(
+			"rule '%s' must be 'drop <regex>', 'rewrite <regex> => <replacement>' or 'rename <function> => <function>'", rule,
+		)
+	}
+
+	if action == "rename" {
+		// Match calls to the function whatever the case, and allowing for whitespace
+		// before the arguments
+		from, to = `(?i)\b`+regexp.QuoteMeta(from)+`\s*\(`, strings.ReplaceAll(to, "$", "$$")+"("
+	}
+
+	pattern, err := regexp.Compile(from)
+	if err != nil {
+		return TransformRule{}, fmt.Errorf("rule '%s' has invalid regex: %v", rule, err)
+	}
+
+	return TransformRule{Pattern: pattern, Replacement: to, text: rule}, nil
+}
+
+// LoadTransformRules reads rules from a file with one rule per line, where 'preset <name>'
+// includes the rules of a preset. Blank lines and lines beginning with # are ignored.
+func LoadTransformRules(input io.Reader) ([]TransformRule, error) {
+	var rules []TransformRule
+
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(text, "preset "); ok {
+			preset, err := PresetTransformRules(strings.TrimSpace(name))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+
+			rules = append(rules, preset...)
+			continue
+		}
+
+		rule, err := ParseTransformRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// PresetTransformRules returns the rules of the named preset
+func PresetTransformRules(name string) ([]TransformRule, error) {
+	preset, ok := TransformPresets[name]
+	if !ok {
+		names := make([]string, 0, len(TransformPresets))
+		for name := range TransformPresets {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		return nil, fmt.Errorf("unknown preset '%s', must be one of %s", name, strings.Join(names, ", "))
+	}
+
+	rules := make([]TransformRule, 0, len(preset))
+	for _, rule := range preset {
+		parsed, err := ParseTransformRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, parsed)
+	}
+
+	return rules, nil
+}
+
+// Transformer applies transformation rules in order to the query of each item, counting
+// the items that each rule touched. Items without a query are passed through untouched.
+type Transformer struct {
+	rules   []TransformRule
+	touched []int
+}
+
+// TransformSummary is the number of items a rule dropped or rewrote
+type TransformSummary struct {
+	Rule  string
+	Items int
+}
+
+func NewTransformer(rules []TransformRule) *Transformer {
+	return &Transformer{rules: rules, touched: make([]int, len(rules))}
+}
+
+// Transform applies our rules to the stream of items. Summary may be called once the
+// returned channel has been drained.
+func (t *Transformer) Transform(items chan Item) chan Item {
+	if len(t.rules) == 0 {
+		return items
+	}
+
+	out := make(chan Item, ItemBufferSize)
+
+	go func() {
+		for item := range items {
+			if item == nil {
+				continue
+			}
+
+			if item = t.transform(item); item != nil {
+				out <- item
+			}
+		}
+
+		close(out)
+	}()
+
+	return out
+}
+
+// transform returns the item with its query transformed, or nil if it should be dropped
+func (t *Transformer) transform(item Item) Item {
+	query, ok := itemQuery(item)
+	if !ok {
+		return item
+	}
+
+	rewritten := query
+	for idx, rule := range t.rules {
+		if rule.Drop {
+			if rule.Pattern.MatchString(rewritten) {
+				t.touched[idx]++
+				return nil
+			}
+
+			continue
+		}
+
+		if result := rule.Pattern.ReplaceAllString(rewritten, rule.Replacement); result != rewritten {
+			t.touched[idx]++
+			rewritten = result
+		}
+	}
+
+	if rewritten == query {
+		return item
+	}
+
+	return withQuery(item, rewritten)
+}
+
+// Summary returns how many items each rule touched, in the order of our rules
+func (t *Transformer) Summary() []TransformSummary {
+	summary := make([]TransformSummary, 0, len(t.rules))
+	for idx, rule := range t.rules {
+		summary = append(summary, TransformSummary{rule.String(), t.touched[idx]})
+	}
+
+	return summary
+}
+
+// withQuery returns a copy of the item with its query replaced
+func withQuery(item Item, query string) Item {
+	switch item := item.(type) {
+	case Statement:
+		item.Query = query
+		return item
+	case *Statement:
+		copied := *item
+		copied.Query = query
+		return &copied
+	case BoundExecute:
+		item.Query = query
+		return item
+	case *BoundExecute:
+		copied := *item
+		copied.Query = query
+		return &copied
+	case ExecutePrepared:
+		item.Query = query
+		return item
+	case *ExecutePrepared:
+		copied := *item
+		copied.Query = query
+		return &copied
+	case Prepare:
+		item.Query = query
+		return item
+	case *Prepare:
+		copied := *item
+		copied.Query = query
+		return &copied
+	default:
+		return item
+	}
+}
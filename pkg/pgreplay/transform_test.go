@@ -0,0 +1,122 @@
+package pgreplay
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transformer", func() {
+	var (
+		details = Details{Timestamp: time20190225, SessionID: "a", User: "alice", Database: "pgreplay_test"}
+		presets = func(names ...string) []TransformRule {
+			var rules []TransformRule
+			for _, name := range names {
+				preset, err := PresetTransformRules(name)
+				Expect(err).NotTo(HaveOccurred())
+
+				rules = append(rules, preset...)
+			}
+
+			return rules
+		}
+		transform = func(rules []TransformRule, items ...Item) []Item {
+			in := make(chan Item, len(items))
+			for _, item := range items {
+				in <- item
+			}
+			close(in)
+
+			var out []Item
+			for item := range NewTransformer(rules).Transform(in) {
+				out = append(out, item)
+			}
+
+			return out
+		}
+	)
+
+	DescribeTable("Strips transactions",
+		func(query string, dropped bool) {
+			out := transform(presets("strip-transactions"), Statement{details, query, 0})
+			if dropped {
+				Expect(out).To(BeEmpty())
+			} else {
+				Expect(out).To(HaveLen(1))
+			}
+		},
+		Entry("BEGIN", "BEGIN", true),
+		Entry("lowercase begin", "begin;", true),
+		Entry("START TRANSACTION", "START TRANSACTION ISOLATION LEVEL SERIALIZABLE", true),
+		Entry("COMMIT", "COMMIT", true),
+		Entry("ROLLBACK TO SAVEPOINT", "ROLLBACK TO SAVEPOINT active_record_1", true),
+		Entry("SAVEPOINT", "SAVEPOINT active_record_1", true),
+		Entry("RELEASE SAVEPOINT", "RELEASE SAVEPOINT active_record_1", true),
+		Entry("SET LOCAL", "SET LOCAL statement_timeout = '1s'", true),
+		Entry("SET", "SET statement_timeout = '1s'", false),
+		Entry("queries starting with a keyword", "BEGINNING", false),
+		Entry("select", "select * from transactions", false),
+	)
+
+	DescribeTable("Shares advisory locks",
+		func(query, expected string) {
+			out := transform(presets("shared-advisory-locks"), Execute{details, query, 0}.Bind([]interface{}{"1"}))
+
+			Expect(out).To(HaveLen(1))
+			Expect(out[0].(BoundExecute).Query).To(Equal(expected))
+		},
+		Entry("lock", "SELECT pg_advisory_lock($1)", "SELECT pg_advisory_lock_shared($1)"),
+		Entry("try lock", "select PG_TRY_ADVISORY_LOCK ($1)", "select pg_try_advisory_lock_shared($1)"),
+		Entry("unlock", "SELECT pg_advisory_unlock($1)", "SELECT pg_advisory_unlock_shared($1)"),
+		Entry("unlock all", "SELECT pg_advisory_unlock_all()", "SELECT pg_advisory_unlock_all()"),
+		Entry("already shared", "SELECT pg_advisory_lock_shared($1)", "SELECT pg_advisory_lock_shared($1)"),
+	)
+
+	It("Rewrites queries and summarises the items each rule touched", func() {
+		rules, err := LoadTransformRules(strings.NewReader(`
+# Replay against a fixed clock
+rewrite (?i)\bnow\(\) => '2019-02-25'::timestamptz
+preset strip-transactions
+`))
+		Expect(err).NotTo(HaveOccurred())
+
+		transformer := NewTransformer(rules)
+		in := make(chan Item, 5)
+		in <- Connect{details}
+		in <- Statement{details, "BEGIN", 0}
+		in <- Statement{details, "select now(), NOW()", 0}
+		in <- ExecutePrepared{BoundExecute{Execute{details, "insert into logs values (now())", 0}, nil, nil}, "p"}
+		in <- Statement{details, "COMMIT", 0}
+		close(in)
+
+		var out []Item
+		for item := range transformer.Transform(in) {
+			out = append(out, item)
+		}
+
+		Expect(out).To(Equal([]Item{
+			Connect{details},
+			Statement{details, "select '2019-02-25'::timestamptz, '2019-02-25'::timestamptz", 0},
+			ExecutePrepared{BoundExecute{Execute{details, "insert into logs values ('2019-02-25'::timestamptz)", 0}, nil, nil}, "p"},
+		}))
+
+		Expect(transformer.Summary()).To(Equal([]TransformSummary{
+			{`rewrite (?i)\bnow\(\) => '2019-02-25'::timestamptz`, 2},
+			{TransformPresets["strip-transactions"][0], 2},
+			{TransformPresets["strip-transactions"][1], 0},
+		}))
+	})
+
+	DescribeTable("Rejects invalid rules",
+		func(rules, message string) {
+			_, err := LoadTransformRules(strings.NewReader(rules))
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("unknown action", "replace a => b", "line 1: rule 'replace a => b' must be"),
+		Entry("rewrite without replacement", "rewrite a", "must be"),
+		Entry("invalid regex", "drop (", "invalid regex"),
+		Entry("unknown preset", "preset everything", "unknown preset 'everything'"),
+	)
+})
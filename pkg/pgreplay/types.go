@@ -8,7 +8,6 @@ import (
 	"strings"
 	"time"
 
-	pgx "github.com/jackc/pgx/v5"
 	jsoniter "github.com/json-iterator/go"
 )
 
@@ -25,6 +24,13 @@ type DatabaseConnConfig struct {
 	Database string
 	User     string
 	Password string
+
+	// ParameterTypes chooses how bind parameters are typed, one of ParameterTypeModes.
+	// Defaults to ParameterTypesCaptured.
+	ParameterTypes string
+
+	// Pool multiplexes sessions onto pools of connections, when its Size is set
+	Pool PoolConfig
 }
 
 type ExtractedLog struct {
@@ -32,6 +38,8 @@ type ExtractedLog struct {
 	ActionLog  string
 	Message    string
 	Parameters string
+	// BackendType is only provided by some log formats, and may be empty
+	BackendType string
 }
 
 type LogMessage struct {
@@ -57,38 +65,85 @@ func (lm LogMessage) Match(logline, parsedFrom string) bool {
 }
 
 func (lm LogMessage) RenderQuery(msg, parsedFrom string) string {
-	if parsedFrom == ParsedFromCsv {
+	if isStructuredLog(parsedFrom) {
 		return msg[len(lm.regex.FindString(msg)):]
 	}
 
 	return strings.TrimPrefix(msg, lm.Prefix(parsedFrom))
 }
 
-const (
-	ConnectLabel      = "Connect"
-	StatementLabel    = "Statement"
-	BoundExecuteLabel = "BoundExecute"
-	DisconnectLabel   = "Disconnect"
-)
+// Capture returns the first capture group of the log message regex, such as the name of
+// a prepared statement.
+func (lm LogMessage) Capture(logline, parsedFrom string) string {
+	if parsedFrom == ParsedFromErrLog {
+		logline = strings.TrimPrefix(logline, lm.actionType)
+	}
 
-func ItemMarshalJSON(item Item) ([]byte, error) {
-	type envelope struct {
-		Type string `json:"type"`
-		Item Item   `json:"item"`
+	if matches := lm.regex.FindStringSubmatch(logline); len(matches) > 1 {
+		return matches[1]
 	}
 
+	return ""
+}
+
+// RenderStatement strips everything up to the end of the regex match, which works for
+// messages with variable content before the query such as 'execute name: <query>'.
+func (lm LogMessage) RenderStatement(logline, parsedFrom string) string {
+	if parsedFrom == ParsedFromErrLog {
+		logline = strings.TrimPrefix(logline, lm.actionType)
+	}
+
+	return logline[len(lm.regex.FindString(logline)):]
+}
+
+const (
+	ConnectLabel         = "Connect"
+	StatementLabel       = "Statement"
+	BoundExecuteLabel    = "BoundExecute"
+	PrepareLabel         = "Prepare"
+	ExecutePreparedLabel = "ExecutePrepared"
+	DeallocateLabel      = "Deallocate"
+	DiscardAllLabel      = "DiscardAll"
+	DisconnectLabel      = "Disconnect"
+)
+
+// ItemType returns the label that identifies the type of the item in our JSON format, or
+// an empty string for items we don't serialize.
+func ItemType(item Item) string {
 	switch item.(type) {
 	case Connect, *Connect:
-		return json.Marshal(envelope{Type: ConnectLabel, Item: item})
+		return ConnectLabel
 	case Statement, *Statement:
-		return json.Marshal(envelope{Type: StatementLabel, Item: item})
+		return StatementLabel
 	case BoundExecute, *BoundExecute:
-		return json.Marshal(envelope{Type: BoundExecuteLabel, Item: item})
+		return BoundExecuteLabel
+	case Prepare, *Prepare:
+		return PrepareLabel
+	case ExecutePrepared, *ExecutePrepared:
+		return ExecutePreparedLabel
+	case Deallocate, *Deallocate:
+		return DeallocateLabel
+	case DiscardAll, *DiscardAll:
+		return DiscardAllLabel
 	case Disconnect, *Disconnect:
-		return json.Marshal(envelope{Type: DisconnectLabel, Item: item})
+		return DisconnectLabel
 	default:
+		return ""
+	}
+}
+
+func ItemMarshalJSON(item Item) ([]byte, error) {
+	type envelope struct {
+		Type string `json:"type"`
+		Item Item   `json:"item"`
+	}
+
+	label := ItemType(item)
+	if label == "" {
 		return nil, nil // it's not important for us to serialize this
 	}
+
+	return json.Marshal(envelope{Type: label, Item: item})
 }
 
 func ItemUnmarshalJSON(payload []byte) (Item, error) {
@@ -110,6 +165,14 @@ func ItemUnmarshalJSON(payload []byte) (Item, error) {
 		item = &Statement{}
 	case BoundExecuteLabel:
 		item = &BoundExecute{}
+	case PrepareLabel:
+		item = &Prepare{}
+	case ExecutePreparedLabel:
+		item = &ExecutePrepared{}
+	case DeallocateLabel:
+		item = &Deallocate{}
+	case DiscardAllLabel:
+		item = &DiscardAll{}
 	case DisconnectLabel:
 		item = &Disconnect{}
 	default:
@@ -124,13 +187,19 @@ var _ Item = &Connect{}
 var _ Item = &Disconnect{}
 var _ Item = &Statement{}
 var _ Item = &BoundExecute{}
+var _ Item = &Prepare{}
+var _ Item = &ExecutePrepared{}
+var _ Item = &Deallocate{}
+var _ Item = &DiscardAll{}
 
 type Item interface {
 	GetTimestamp() time.Time
 	GetSessionID() SessionID
 	GetUser() string
 	GetDatabase() string
-	Handle(context.Context, *pgx.Conn) error
+	GetApplicationName() string
+	GetDetails() Details
+	Handle(context.Context, *Conn) error
 }
 
 type Details struct {
@@ -138,31 +207,113 @@ type Details struct {
 	SessionID SessionID `json:"session_id"`
 	User      string    `json:"user"`
 	Database  string    `json:"database"`
+
+	// Optional details that only some log formats and log_line_prefixes provide, which
+	// help tell apart the clients of a database
+	ApplicationName string `json:"application_name,omitempty"`
+	ClientAddr      string `json:"client_addr,omitempty"`
+	BackendPID      int    `json:"backend_pid,omitempty"`
+	VirtualXID      string `json:"virtual_xid,omitempty"`
+	TransactionID   uint64 `json:"transaction_id,omitempty"`
+	QueryID         int64  `json:"query_id,omitempty"`
+
+	// Fingerprint identifies the query of statements and executes, such that queries
+	// differing only in their constants share a fingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
 }
 
-func (e Details) GetTimestamp() time.Time { return e.Timestamp }
-func (e Details) GetSessionID() SessionID { return e.SessionID }
-func (e Details) GetUser() string         { return e.User }
-func (e Details) GetDatabase() string     { return e.Database }
+func (e Details) GetTimestamp() time.Time    { return e.Timestamp }
+func (e Details) GetSessionID() SessionID    { return e.SessionID }
+func (e Details) GetUser() string            { return e.User }
+func (e Details) GetDatabase() string        { return e.Database }
+func (e Details) GetApplicationName() string { return e.ApplicationName }
+func (e Details) GetDetails() Details        { return e }
+
+// WithDetails returns a copy of the item with its Details replaced
+func WithDetails(item Item, details Details) Item {
+	switch item := item.(type) {
+	case Connect:
+		item.Details = details
+		return item
+	case *Connect:
+		copied := *item
+		copied.Details = details
+		return &copied
+	case Disconnect:
+		item.Details = details
+		return item
+	case *Disconnect:
+		copied := *item
+		copied.Details = details
+		return &copied
+	case Statement:
+		item.Details = details
+		return item
+	case *Statement:
+		copied := *item
+		copied.Details = details
+		return &copied
+	case BoundExecute:
+		item.Details = details
+		return item
+	case *BoundExecute:
+		copied := *item
+		copied.Details = details
+		return &copied
+	case Prepare:
+		item.Details = details
+		return item
+	case *Prepare:
+		copied := *item
+		copied.Details = details
+		return &copied
+	case ExecutePrepared:
+		item.Details = details
+		return item
+	case *ExecutePrepared:
+		copied := *item
+		copied.Details = details
+		return &copied
+	case Deallocate:
+		item.Details = details
+		return item
+	case *Deallocate:
+		copied := *item
+		copied.Details = details
+		return &copied
+	case DiscardAll:
+		item.Details = details
+		return item
+	case *DiscardAll:
+		copied := *item
+		copied.Details = details
+		return &copied
+	default:
+		return item
+	}
+}
 
 type Connect struct{ Details }
 
-func (Connect) Handle(context.Context, *pgx.Conn) error {
+func (Connect) Handle(context.Context, *Conn) error {
 	return nil // Database will manage opening connections
 }
 
 type Disconnect struct{ Details }
 
-func (Disconnect) Handle(ctx context.Context, conn *pgx.Conn) error {
-	return conn.Close(ctx)
+func (Disconnect) Handle(ctx context.Context, conn *Conn) error {
+	return conn.Conn.Close(ctx)
 }
 
 type Statement struct {
 	Details
 	Query string `json:"query"`
+	// OriginalDuration is how long the statement took to run when it was logged, if
+	// Postgres logged its duration
+	OriginalDuration time.Duration `json:"original_duration,omitempty"`
 }
 
-func (s Statement) Handle(ctx context.Context, conn *pgx.Conn) error {
+func (s Statement) Handle(ctx context.Context, conn *Conn) error {
 	_, err := conn.Exec(ctx, s.Query)
 	return err
 }
@@ -172,7 +323,8 @@ func (s Statement) Handle(ctx context.Context, conn *pgx.Conn) error {
 // or detail line that bound it.
 type Execute struct {
 	Details
-	Query string `json:"query"`
+	Query            string        `json:"query"`
+	OriginalDuration time.Duration `json:"original_duration,omitempty"`
 }
 
 func (e Execute) Bind(parameters []interface{}) BoundExecute {
@@ -180,16 +332,209 @@ func (e Execute) Bind(parameters []interface{}) BoundExecute {
 		parameters = make([]interface{}, 0)
 	}
 
-	return BoundExecute{e, parameters}
+	return BoundExecute{e, parameters, nil}
+}
+
+// Unbound is an Execute that is waiting for a following log line to provide its
+// parameters, along with the name of the prepared statement it will execute. An empty
+// Name denotes the unnamed statement.
+type Unbound struct {
+	Execute
+	Name string
+}
+
+// Bind produces a BoundExecute for the unnamed statement, or an ExecutePrepared for a
+// named prepared statement.
+func (u Unbound) Bind(parameters []interface{}) Item {
+	bound := u.Execute.Bind(parameters)
+	if u.Name == "" {
+		return bound
+	}
+
+	return ExecutePrepared{bound, u.Name}
 }
 
 // BoundExecute represents an Execute that is now successfully bound with parameters
 type BoundExecute struct {
 	Execute
 	Parameters []interface{} `json:"parameters"`
+	// ParameterTypes are the type OIDs of the parameters, where the source told us them.
+	// Zero leaves the type of a parameter for Postgres to infer.
+	ParameterTypes []uint32 `json:"parameter_types,omitempty"`
 }
 
-func (e BoundExecute) Handle(ctx context.Context, conn *pgx.Conn) error {
-	_, err := conn.Exec(ctx, e.Query, e.Parameters...)
-	return err
+// itemParameterTypes returns the types of the prepare or execute's parameters, if we know
+// them
+func itemParameterTypes(item Item) []uint32 {
+	switch item := item.(type) {
+	case Prepare:
+		return item.ParameterTypes
+	case *Prepare:
+		return item.ParameterTypes
+	case BoundExecute:
+		return item.ParameterTypes
+	case *BoundExecute:
+		return item.ParameterTypes
+	case ExecutePrepared:
+		return item.ParameterTypes
+	case *ExecutePrepared:
+		return item.ParameterTypes
+	default:
+		return nil
+	}
+}
+
+// withParameterTypes returns the prepare or execute with the types of its parameters.
+// Pointers are copied rather than modified, as the item may be shared.
+func withParameterTypes(item Item, types []uint32) Item {
+	switch item := item.(type) {
+	case Prepare:
+		item.ParameterTypes = types
+		return item
+	case *Prepare:
+		copied := *item
+		copied.ParameterTypes = types
+		return &copied
+	case BoundExecute:
+		item.ParameterTypes = types
+		return item
+	case *BoundExecute:
+		copied := *item
+		copied.ParameterTypes = types
+		return &copied
+	case ExecutePrepared:
+		item.ParameterTypes = types
+		return item
+	case *ExecutePrepared:
+		copied := *item
+		copied.ParameterTypes = types
+		return &copied
+	default:
+		return item
+	}
+}
+
+// RecordsDuration reports whether the item is one that records how long it originally
+// took to run.
+func RecordsDuration(item Item) bool {
+	switch item.(type) {
+	case Statement, *Statement, BoundExecute, *BoundExecute, ExecutePrepared, *ExecutePrepared:
+		return true
+	default:
+		return false
+	}
+}
+
+// WithOriginalDuration returns the item with the duration it originally took to run, for
+// those items that record it.
+func WithOriginalDuration(item Item, duration time.Duration) Item {
+	switch item := item.(type) {
+	case Statement:
+		item.OriginalDuration = duration
+		return item
+	case *Statement:
+		copied := *item
+		copied.OriginalDuration = duration
+		return &copied
+	case BoundExecute:
+		item.OriginalDuration = duration
+		return item
+	case *BoundExecute:
+		copied := *item
+		copied.OriginalDuration = duration
+		return &copied
+	case ExecutePrepared:
+		item.OriginalDuration = duration
+		return item
+	case *ExecutePrepared:
+		copied := *item
+		copied.OriginalDuration = duration
+		return &copied
+	default:
+		return item
+	}
+}
+
+// OriginalDuration returns how long the item took to run when it was logged, or zero if
+// we don't know.
+func OriginalDuration(item Item) time.Duration {
+	switch item := item.(type) {
+	case Statement:
+		return item.OriginalDuration
+	case *Statement:
+		return item.OriginalDuration
+	case BoundExecute:
+		return item.OriginalDuration
+	case *BoundExecute:
+		return item.OriginalDuration
+	case ExecutePrepared:
+		return item.OriginalDuration
+	case *ExecutePrepared:
+		return item.OriginalDuration
+	default:
+		return 0
+	}
+}
+
+func (e BoundExecute) Handle(ctx context.Context, conn *Conn) error {
+	return conn.execute(ctx, e.Query, e.Parameters, e.ParameterTypes)
+}
+
+// Prepare creates a named prepared statement, as parsed from the 'parse name:' logs that
+// Postgres emits when log_min_duration_statement is enabled.
+type Prepare struct {
+	Details
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// ParameterTypes are the type OIDs the client specified when preparing, if we know
+	// them, where zero leaves the type for Postgres to infer
+	ParameterTypes []uint32 `json:"parameter_types,omitempty"`
+}
+
+func (p Prepare) Handle(ctx context.Context, conn *Conn) error {
+	return conn.prepare(ctx, p.Name, p.Query, p.ParameterTypes)
+}
+
+// ExecutePrepared executes a named prepared statement with bound parameters. We carry the
+// query so the statement can be prepared on first use, as logs captured with only
+// log_statement = 'all' never include the original parse.
+type ExecutePrepared struct {
+	BoundExecute
+	Name string `json:"name"`
+}
+
+func (e ExecutePrepared) Handle(ctx context.Context, conn *Conn) error {
+	if err := conn.prepare(ctx, e.Name, e.Query, e.ParameterTypes); err != nil {
+		return err
+	}
+
+	return conn.executePrepared(ctx, e.Name, e.Parameters)
+}
+
+// Deallocate releases a named prepared statement, or every prepared statement on the
+// connection when Name is empty.
+type Deallocate struct {
+	Details
+	Name string `json:"name,omitempty"`
+}
+
+func (d Deallocate) Handle(ctx context.Context, conn *Conn) error {
+	if d.Name == "" {
+		return conn.deallocateAll(ctx)
+	}
+
+	return conn.deallocate(ctx, d.Name)
+}
+
+// DiscardAll resets the session state, which includes dropping all prepared statements.
+type DiscardAll struct{ Details }
+
+func (d DiscardAll) Handle(ctx context.Context, conn *Conn) error {
+	if _, err := conn.Exec(ctx, "DISCARD ALL"); err != nil {
+		return err
+	}
+
+	// The server has forgotten every statement, including those pgx prepared implicitly
+	// for its statement cache, so we need to forget them too.
+	return conn.deallocateAll(ctx)
 }
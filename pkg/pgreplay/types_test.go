@@ -1,7 +1,11 @@
 package pgreplay
 
 import (
+	"context"
+	"time"
+
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
@@ -16,7 +20,7 @@ var _ = Describe("Item JSON", func() {
 	)
 
 	Context("Statement", func() {
-		var item = Statement{details, "select now()"}
+		var item = Statement{details, "select now()", 0}
 
 		It("Generates JSON", func() {
 			Expect(ItemMarshalJSON(item)).To(
@@ -36,7 +40,7 @@ var _ = Describe("Item JSON", func() {
 	})
 
 	Context("BoundExecute", func() {
-		var item = BoundExecute{Execute{details, "select $1"}, []interface{}{"hello"}}
+		var item = BoundExecute{Execute{details, "select $1", 1500 * time.Microsecond}, []interface{}{"hello"}, nil}
 
 		It("Generates JSON", func() {
 			Expect(ItemMarshalJSON(item)).To(
@@ -49,10 +53,145 @@ var _ = Describe("Item JSON", func() {
     "user": "alice",
     "database": "pgreplay_test",
     "query": "select $1",
+    "original_duration": 1500000,
 		"parameters": ["hello"]
   }
 }`),
 			)
 		})
+
+		It("Round-trips the original duration", func() {
+			bytes, err := ItemMarshalJSON(item)
+			Expect(err).NotTo(HaveOccurred())
+
+			parsed, err := ItemUnmarshalJSON(bytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(OriginalDuration(parsed)).To(Equal(1500 * time.Microsecond))
+		})
+
+		It("Round-trips parameter types", func() {
+			typed := item
+			typed.ParameterTypes = []uint32{3802}
+
+			bytes, err := ItemMarshalJSON(typed)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(bytes)).To(ContainSubstring(`"parameter_types":[3802]`))
+
+			parsed, err := ItemUnmarshalJSON(bytes)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.(*BoundExecute).ParameterTypes).To(Equal([]uint32{3802}))
+		})
+	})
+
+	Context("ExecutePrepared", func() {
+		var item = ExecutePrepared{BoundExecute{Execute{details, "select $1", 0}, []interface{}{"hello"}, nil}, "greet"}
+
+		It("Generates JSON", func() {
+			Expect(ItemMarshalJSON(item)).To(
+				MatchJSON(`
+{
+  "type": "ExecutePrepared",
+  "item": {
+    "timestamp": "2019-02-25T15:08:27.222Z",
+    "session_id": "5c7404eb.d6bd",
+    "user": "alice",
+    "database": "pgreplay_test",
+    "query": "select $1",
+    "parameters": ["hello"],
+    "name": "greet"
+  }
+}`),
+			)
+		})
+
+		It("Round-trips through JSON", func() {
+			payload, err := ItemMarshalJSON(item)
+			Expect(err).NotTo(HaveOccurred())
+
+			parsed, err := ItemUnmarshalJSON(payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(BeAssignableToTypeOf(&ExecutePrepared{}))
+			Expect(parsed.(*ExecutePrepared).Name).To(Equal("greet"))
+			Expect(parsed.(*ExecutePrepared).Parameters).To(Equal([]interface{}{"hello"}))
+		})
+	})
+
+	Context("Connect with optional details", func() {
+		var item = Connect{Details{
+			Timestamp:       time20190225,
+			SessionID:       "5c7404eb.d6bd",
+			User:            "alice",
+			Database:        "pgreplay_test",
+			ApplicationName: "puma: [app]",
+			ClientAddr:      "172.31.237.67",
+			BackendPID:      26223,
+			VirtualXID:      "706/2676024",
+			TransactionID:   1234,
+			QueryID:         -1029561919799294166,
+		}}
+
+		It("Generates JSON", func() {
+			Expect(ItemMarshalJSON(item)).To(
+				MatchJSON(`
+{
+  "type": "Connect",
+  "item": {
+    "timestamp": "2019-02-25T15:08:27.222Z",
+    "session_id": "5c7404eb.d6bd",
+    "user": "alice",
+    "database": "pgreplay_test",
+    "application_name": "puma: [app]",
+    "client_addr": "172.31.237.67",
+    "backend_pid": 26223,
+    "virtual_xid": "706/2676024",
+    "transaction_id": 1234,
+    "query_id": -1029561919799294166
+  }
+}`),
+			)
+		})
+
+		It("Round-trips through JSON", func() {
+			payload, err := ItemMarshalJSON(item)
+			Expect(err).NotTo(HaveOccurred())
+
+			parsed, err := ItemUnmarshalJSON(payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(BeAssignableToTypeOf(&Connect{}))
+
+			// Timestamps are parsed into UTC, losing the GMT location of our fixture
+			details := parsed.(*Connect).Details
+			Expect(details.Timestamp).To(BeTemporally("==", item.Timestamp))
+			details.Timestamp = item.Timestamp
+			Expect(details).To(Equal(item.Details))
+		})
+	})
+})
+
+var _ = Describe("Deallocate", func() {
+	It("Skips statements the connection never prepared", func() {
+		// Without a database connection, we'd fail if we tried to deallocate
+		conn := &Conn{prepared: map[string]preparedStatement{}}
+
+		Expect(Deallocate{Name: "someone_sees_user"}.Handle(context.Background(), conn)).To(Succeed())
 	})
 })
+
+var _ = Describe("withParameterTypes", func() {
+	types := []uint32{oidInt4}
+	details := Details{Timestamp: time20190225, SessionID: "a"}
+	bound := BoundExecute{Execute{details, "select $1", 0}, []interface{}{"1"}, nil}
+
+	DescribeTable("Attaches types to prepares and executes",
+		func(item Item) {
+			Expect(itemParameterTypes(withParameterTypes(item, types))).To(Equal(types))
+			Expect(itemParameterTypes(item)).To(BeEmpty())
+		},
+		Entry("Prepare", Prepare{details, "s", "select $1", nil}),
+		Entry("*Prepare", &Prepare{details, "s", "select $1", nil}),
+		Entry("BoundExecute", bound),
+		Entry("*BoundExecute", &bound),
+		Entry("ExecutePrepared", ExecutePrepared{bound, "s"}),
+		Entry("*ExecutePrepared", &ExecutePrepared{bound, "s"}),
+	)
+})
@@ -0,0 +1,824 @@
+package pgreplay
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Codes sent in place of a protocol version by the untyped startup packets
+	wireProtocolVersion = 196608 // 3.0
+	wireSSLRequest      = 80877103
+	wireGSSENCRequest   = 80877104
+	wireCancelRequest   = 80877102
+
+	// maxWireMessageSize guards against decoding garbage as an enormous message, which is
+	// what we'd see if we lost track of message boundaries.
+	maxWireMessageSize = MaxLogLineSize
+)
+
+// WireSession decodes the Postgres wire protocol messages of a single client connection
+// into replay Items. It must be fed both directions of the conversation in the order they
+// were observed, as the parameter types of a prepared statement are often only described
+// by the server.
+//
+// We don't support encrypted connections. Sessions that negotiate TLS or GSSAPI are
+// detected and ignored.
+type WireSession struct {
+	id               SessionID
+	user, database   string
+	applicationName  string
+	frontend         []byte
+	backend          []byte
+	started          bool // received the StartupMessage
+	ignored          bool // encrypted or unsynchronised, so we can't decode it
+	disconnected     bool
+	backendSingles   int // single byte responses to SSLRequest or GSSENCRequest
+	statements       map[string]wireStatement
+	portals          map[string]wirePortal
+	pendingDescribes []pendingDescribe
+}
+
+// pendingDescribe is a statement Describe awaiting its ParameterDescription, or marks a
+// Sync or Query, which the server answers with ReadyForQuery. Once a message fails, the
+// server skips everything up to the next Sync, including any describes we're awaiting.
+type pendingDescribe struct {
+	statement string
+	sync      bool
+}
+
+type wireStatement struct {
+	query string
+	oids  []uint32
+}
+
+type wirePortal struct {
+	statement  string
+	parameters []interface{}
+}
+
+func NewWireSession(id SessionID) *WireSession {
+	return &WireSession{
+		id:         id,
+		statements: map[string]wireStatement{},
+		portals:    map[string]wirePortal{},
+	}
+}
+
+func (s *WireSession) details(ts time.Time) Details {
+	return Details{
+		Timestamp:       ts,
+		SessionID:       s.id,
+		User:            s.user,
+		Database:        s.database,
+		ApplicationName: s.applicationName,
+	}
+}
+
+// Frontend consumes data sent by the client, returning any Items that were completed by
+// it. Incomplete messages are buffered until the next call. A message we fail to decode
+// doesn't stop us decoding those that follow it, so its error is returned alongside them.
+func (s *WireSession) Frontend(ts time.Time, data []byte) ([]Item, error) {
+	if s.ignored || s.disconnected {
+		return nil, nil
+	}
+
+	s.frontend = append(s.frontend, data...)
+
+	var (
+		items []Item
+		errs  []error
+	)
+
+	for {
+		if !s.started {
+			if len(s.frontend) > 0 && s.frontend[0] == 0x16 && s.backendSingles > 0 {
+				// A TLS handshake record following our SSLRequest means the session is
+				// encrypted, and there's nothing more we can decode.
+				s.ignore()
+				return items, errors.Join(errs...)
+			}
+
+			item, ok, err := s.startup(ts)
+			if err != nil {
+				s.ignore()
+				return items, errors.Join(append(errs, err)...)
+			}
+			if !ok {
+				return items, errors.Join(errs...)
+			}
+			if item != nil {
+				items = append(items, item)
+			}
+
+			continue
+		}
+
+		// Once we lose track of message boundaries, nothing that follows can be decoded
+		msgType, payload, ok, err := readTypedMessage(&s.frontend)
+		if err != nil {
+			s.ignore()
+			return items, errors.Join(append(errs, err)...)
+		}
+		if !ok {
+			return items, errors.Join(errs...)
+		}
+
+		// Whereas a message we can't decode is skipped by its length
+		item, err := s.frontendMessage(ts, msgType, payload)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if item != nil {
+			items = append(items, item)
+		}
+		if s.disconnected {
+			return items, errors.Join(errs...)
+		}
+	}
+}
+
+// Backend consumes data sent by the server. We only decode the ParameterDescription that
+// describes the parameter types of a prepared statement, along with the ErrorResponse and
+// ReadyForQuery that tell us which descriptions won't arrive.
+func (s *WireSession) Backend(ts time.Time, data []byte) error {
+	if s.ignored || s.disconnected {
+		return nil
+	}
+
+	s.backend = append(s.backend, data...)
+
+	for {
+		if s.backendSingles > 0 {
+			if len(s.backend) == 0 {
+				return nil
+			}
+
+			if response := s.backend[0]; response == 'S' || response == 'G' {
+				s.ignore() // the server agreed to encrypt the session
+				return nil
+			}
+
+			s.backend, s.backendSingles = s.backend[1:], s.backendSingles-1
+			continue
+		}
+
+		msgType, payload, ok, err := readTypedMessage(&s.backend)
+		if err != nil {
+			s.ignore()
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		switch msgType {
+		case 't': // ParameterDescription
+			if len(s.pendingDescribes) == 0 || s.pendingDescribes[0].sync {
+				continue // we've lost track of what this describes
+			}
+
+			name := s.pendingDescribes[0].statement
+			s.pendingDescribes = s.pendingDescribes[1:]
+
+			oids, err := decodeParameterDescription(payload)
+			if err != nil {
+				return err
+			}
+
+			if statement, ok := s.statements[name]; ok {
+				statement.oids = mergeOIDs(statement.oids, oids)
+				s.statements[name] = statement
+			}
+
+		case 'E': // ErrorResponse
+			s.skipDescribes(false)
+
+		case 'Z': // ReadyForQuery
+			s.skipDescribes(true)
+		}
+	}
+}
+
+// skipDescribes forgets the describes that the server won't answer, being every one
+// before the next Sync, which we also forget once the server is ready for more queries
+func (s *WireSession) skipDescribes(ready bool) {
+	for len(s.pendingDescribes) > 0 {
+		sync := s.pendingDescribes[0].sync
+		if sync && !ready {
+			return
+		}
+
+		s.pendingDescribes = s.pendingDescribes[1:]
+		if sync {
+			return
+		}
+	}
+}
+
+// Close is called when the underlying connection terminates, returning a Disconnect if the
+// client didn't already send a Terminate message.
+func (s *WireSession) Close(ts time.Time) Item {
+	if !s.started || s.ignored || s.disconnected {
+		return nil
+	}
+
+	s.disconnected = true
+
+	return Disconnect{s.details(ts)}
+}
+
+func (s *WireSession) ignore() {
+	s.ignored = true
+	s.frontend, s.backend = nil, nil
+}
+
+// startup decodes the untyped messages that begin a connection. Returns ok = false if we
+// need more data to decode the next message.
+func (s *WireSession) startup(ts time.Time) (item Item, ok bool, err error) {
+	if len(s.frontend) < 8 {
+		return nil, false, nil
+	}
+
+	length := int(binary.BigEndian.Uint32(s.frontend))
+	if length < 8 || length > maxWireMessageSize {
+		return nil, false, fmt.Errorf("session %s: not a startup message, was the capture started mid-connection?", s.id)
+	}
+	if len(s.frontend) < length {
+		return nil, false, nil
+	}
+
+	payload := s.frontend[8:length]
+	code := binary.BigEndian.Uint32(s.frontend[4:])
+	s.frontend = s.frontend[length:]
+
+	switch code {
+	case wireSSLRequest, wireGSSENCRequest:
+		s.backendSingles++
+		return nil, true, nil
+	case wireCancelRequest:
+		// Cancel requests arrive on their own connection, and are not a session
+		s.ignore()
+		return nil, true, nil
+	case wireProtocolVersion:
+	default:
+		return nil, false, fmt.Errorf("session %s: unsupported protocol version %d", s.id, code)
+	}
+
+	params := strings.Split(string(payload), "\x00")
+	for idx := 0; idx+1 < len(params); idx += 2 {
+		switch params[idx] {
+		case "user":
+			s.user = params[idx+1]
+		case "database":
+			s.database = params[idx+1]
+		case "application_name":
+			s.applicationName = params[idx+1]
+		}
+	}
+
+	if s.database == "" {
+		s.database = s.user
+	}
+
+	s.started = true
+
+	return Connect{s.details(ts)}, true, nil
+}
+
+func (s *WireSession) frontendMessage(ts time.Time, msgType byte, payload []byte) (Item, error) {
+	reader := wireReader{payload}
+
+	switch msgType {
+	case 'Q': // Query
+		query, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+
+		s.pendingDescribes = append(s.pendingDescribes, pendingDescribe{sync: true})
+
+		return parseStatement(s.details(ts), query, 0), nil
+
+	case 'P': // Parse
+		name, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+		query, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+		count, err := reader.int16()
+		if err != nil {
+			return nil, err
+		}
+
+		oids := make([]uint32, count)
+		for idx := range oids {
+			if oids[idx], err = reader.uint32(); err != nil {
+				return nil, err
+			}
+		}
+
+		s.statements[name] = wireStatement{query, oids}
+		if name == "" {
+			return nil, nil // the unnamed statement is replayed by the execute that follows
+		}
+
+		return Prepare{s.details(ts), name, query, capturedTypes(oids)}, nil
+
+	case 'D': // Describe
+		kind, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+		name, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+
+		// Only statement describes receive a ParameterDescription from the server
+		if kind == 'S' {
+			s.pendingDescribes = append(s.pendingDescribes, pendingDescribe{statement: name})
+		}
+
+		return nil, nil
+
+	case 'B': // Bind
+		return nil, s.bind(&reader)
+
+	case 'E': // Execute
+		portalName, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+
+		portal, ok := s.portals[portalName]
+		if !ok {
+			return nil, fmt.Errorf("session %s: execute of unknown portal '%s'", s.id, portalName)
+		}
+
+		statement, ok := s.statements[portal.statement]
+		if !ok {
+			return nil, fmt.Errorf("session %s: execute of unknown statement '%s'", s.id, portal.statement)
+		}
+
+		bound := Unbound{Execute{s.details(ts), statement.query, 0}, portal.statement}.Bind(portal.parameters)
+		return withParameterTypes(bound, capturedTypes(statement.oids)), nil
+
+	case 'C': // Close
+		kind, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+		name, err := reader.string()
+		if err != nil {
+			return nil, err
+		}
+
+		if kind == 'P' {
+			delete(s.portals, name)
+			return nil, nil
+		}
+
+		delete(s.statements, name)
+		if name == "" {
+			return nil, nil
+		}
+
+		return Deallocate{s.details(ts), name}, nil
+
+	case 'S': // Sync
+		s.pendingDescribes = append(s.pendingDescribes, pendingDescribe{sync: true})
+		return nil, nil
+
+	case 'X': // Terminate
+		s.disconnected = true
+		return Disconnect{s.details(ts)}, nil
+
+	default:
+		// Flush, password and copy messages don't need replaying
+		return nil, nil
+	}
+}
+
+// bind decodes the parameters of a Bind message into the values we'll replay, converting
+// binary parameters into their text representation so every parameter can be serialised
+// the same way as those we parse from logs.
+func (s *WireSession) bind(reader *wireReader) error {
+	portal, err := reader.string()
+	if err != nil {
+		return err
+	}
+	name, err := reader.string()
+	if err != nil {
+		return err
+	}
+
+	formatCount, err := reader.int16()
+	if err != nil {
+		return err
+	}
+
+	formats := make([]int16, formatCount)
+	for idx := range formats {
+		if formats[idx], err = reader.int16(); err != nil {
+			return err
+		}
+	}
+
+	paramCount, err := reader.int16()
+	if err != nil {
+		return err
+	}
+
+	statement := s.statements[name]
+	parameters := make([]interface{}, paramCount)
+
+	for idx := range parameters {
+		value, err := reader.bytes()
+		if err != nil {
+			return err
+		}
+
+		if value == nil {
+			continue // NULL
+		}
+
+		var format int16
+		switch len(formats) {
+		case 0:
+		case 1:
+			format = formats[0]
+		default:
+			format = formats[idx]
+		}
+
+		if format == 0 {
+			parameters[idx] = string(value)
+			continue
+		}
+
+		var oid uint32
+		if idx < len(statement.oids) {
+			oid = statement.oids[idx]
+		}
+
+		if parameters[idx], err = DecodeBinaryParameter(oid, value); err != nil {
+			return fmt.Errorf("session %s: parameter $%d: %v", s.id, idx+1, err)
+		}
+	}
+
+	s.portals[portal] = wirePortal{name, parameters}
+
+	return nil
+}
+
+// readTypedMessage pops a complete message from the buffer, where every message is a type
+// byte followed by a length that includes itself.
+func readTypedMessage(buffer *[]byte) (msgType byte, payload []byte, ok bool, err error) {
+	if len(*buffer) < 5 {
+		return 0, nil, false, nil
+	}
+
+	length := int(binary.BigEndian.Uint32((*buffer)[1:]))
+	if length < 4 || length > maxWireMessageSize {
+		return 0, nil, false, fmt.Errorf("invalid message length %d for type '%c'", length, (*buffer)[0])
+	}
+	if len(*buffer) < length+1 {
+		return 0, nil, false, nil
+	}
+
+	msgType, payload = (*buffer)[0], (*buffer)[5:length+1]
+	*buffer = (*buffer)[length+1:]
+
+	return msgType, payload, true, nil
+}
+
+func decodeParameterDescription(payload []byte) ([]uint32, error) {
+	reader := wireReader{payload}
+	count, err := reader.int16()
+	if err != nil {
+		return nil, err
+	}
+
+	oids := make([]uint32, count)
+	for idx := range oids {
+		if oids[idx], err = reader.uint32(); err != nil {
+			return nil, err
+		}
+	}
+
+	return oids, nil
+}
+
+// mergeOIDs prefers the types the client specified in its Parse, falling back to the
+// types the server inferred for any the client left unspecified.
+func mergeOIDs(specified, described []uint32) []uint32 {
+	merged := make([]uint32, len(described))
+	for idx := range described {
+		if idx < len(specified) && specified[idx] != 0 {
+			merged[idx] = specified[idx]
+		} else {
+			merged[idx] = described[idx]
+		}
+	}
+
+	return merged
+}
+
+// capturedTypes returns the parameter types worth recording, which are none if we know
+// the type of no parameter
+func capturedTypes(oids []uint32) []uint32 {
+	for _, oid := range oids {
+		if oid != 0 {
+			return oids
+		}
+	}
+
+	return nil
+}
+
+type wireReader struct{ data []byte }
+
+var errWireShortMessage = fmt.Errorf("message too short")
+
+func (r *wireReader) byte() (byte, error) {
+	if len(r.data) < 1 {
+		return 0, errWireShortMessage
+	}
+
+	value := r.data[0]
+	r.data = r.data[1:]
+
+	return value, nil
+}
+
+func (r *wireReader) int16() (int16, error) {
+	if len(r.data) < 2 {
+		return 0, errWireShortMessage
+	}
+
+	value := int16(binary.BigEndian.Uint16(r.data))
+	r.data = r.data[2:]
+
+	return value, nil
+}
+
+func (r *wireReader) uint32() (uint32, error) {
+	if len(r.data) < 4 {
+		return 0, errWireShortMessage
+	}
+
+	value := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+
+	return value, nil
+}
+
+func (r *wireReader) string() (string, error) {
+	for idx, b := range r.data {
+		if b == 0 {
+			value := string(r.data[:idx])
+			r.data = r.data[idx+1:]
+
+			return value, nil
+		}
+	}
+
+	return "", errWireShortMessage
+}
+
+// bytes reads a length prefixed value, where a length of -1 denotes NULL
+func (r *wireReader) bytes() ([]byte, error) {
+	length, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	if int32(length) == -1 {
+		return nil, nil
+	}
+
+	if int(length) > len(r.data) {
+		return nil, errWireShortMessage
+	}
+
+	value := r.data[:length]
+	r.data = r.data[length:]
+
+	return value, nil
+}
+
+// Type OIDs of the builtin types we can decode from their binary representation
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidName        = 19
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidText        = 25
+	oidOID         = 26
+	oidJSON        = 114
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidBPChar      = 1042
+	oidVarchar     = 1043
+	oidDate        = 1082
+	oidTimestamp   = 1114
+	oidTimestampTZ = 1184
+	oidNumeric     = 1700
+	oidUUID        = 2950
+	oidJSONB       = 3802
+)
+
+// postgresEpoch is the zero point of Postgres' binary date and timestamp representations
+var postgresEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// DecodeBinaryParameter converts a parameter sent in the binary format into its text
+// representation. Values of types we don't recognise are rendered as bytea hex, which is
+// the best we can do without knowing how the client encoded them.
+func DecodeBinaryParameter(oid uint32, value []byte) (string, error) {
+	expect := func(size int) error {
+		if len(value) != size {
+			return fmt.Errorf("expected %d bytes for type %d, got %d", size, oid, len(value))
+		}
+
+		return nil
+	}
+
+	switch oid {
+	case oidText, oidVarchar, oidBPChar, oidName, oidJSON:
+		return string(value), nil
+	case oidJSONB:
+		if len(value) < 1 || value[0] != 1 {
+			return "", fmt.Errorf("unsupported jsonb version")
+		}
+
+		return string(value[1:]), nil
+	case oidBool:
+		if err := expect(1); err != nil {
+			return "", err
+		}
+
+		if value[0] == 0 {
+			return "f", nil
+		}
+
+		return "t", nil
+	case oidInt2:
+		if err := expect(2); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(value))), 10), nil
+	case oidInt4:
+		if err := expect(4); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(value))), 10), nil
+	case oidOID:
+		if err := expect(4); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10), nil
+	case oidInt8:
+		if err := expect(8); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(value)), 10), nil
+	case oidFloat4:
+		if err := expect(4); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 'g', -1, 32), nil
+	case oidFloat8:
+		if err := expect(8); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 'g', -1, 64), nil
+	case oidUUID:
+		if err := expect(16); err != nil {
+			return "", err
+		}
+
+		encoded := hex.EncodeToString(value)
+		return fmt.Sprintf("%s-%s-%s-%s-%s", encoded[0:8], encoded[8:12], encoded[12:16], encoded[16:20], encoded[20:32]), nil
+	case oidDate:
+		if err := expect(4); err != nil {
+			return "", err
+		}
+
+		switch days := int32(binary.BigEndian.Uint32(value)); days {
+		case math.MaxInt32:
+			return "infinity", nil
+		case math.MinInt32:
+			return "-infinity", nil
+		default:
+			return postgresEpoch.AddDate(0, 0, int(days)).Format("2006-01-02"), nil
+		}
+	case oidTimestamp, oidTimestampTZ:
+		if err := expect(8); err != nil {
+			return "", err
+		}
+
+		switch micros := int64(binary.BigEndian.Uint64(value)); micros {
+		case math.MaxInt64:
+			return "infinity", nil
+		case math.MinInt64:
+			return "-infinity", nil
+		default:
+			ts := postgresEpoch.Add(time.Duration(micros) * time.Microsecond)
+			if oid == oidTimestampTZ {
+				return ts.Format("2006-01-02 15:04:05.999999Z07:00"), nil
+			}
+
+			return ts.Format("2006-01-02 15:04:05.999999"), nil
+		}
+	case oidNumeric:
+		return decodeBinaryNumeric(value)
+	default:
+		return `\x` + hex.EncodeToString(value), nil
+	}
+}
+
+// decodeBinaryNumeric renders the binary numeric format, which is a sequence of base
+// 10000 digits along with the weight of the first digit, a sign and the display scale.
+func decodeBinaryNumeric(value []byte) (string, error) {
+	reader := wireReader{value}
+	ndigits, err := reader.int16()
+	if err != nil {
+		return "", err
+	}
+	weight, err := reader.int16()
+	if err != nil {
+		return "", err
+	}
+	sign, err := reader.int16()
+	if err != nil {
+		return "", err
+	}
+	dscale, err := reader.int16()
+	if err != nil {
+		return "", err
+	}
+
+	switch uint16(sign) {
+	case 0xC000:
+		return "NaN", nil
+	case 0xD000:
+		return "Infinity", nil
+	case 0xF000:
+		return "-Infinity", nil
+	}
+
+	unscaled := new(big.Int)
+	for idx := 0; idx < int(ndigits); idx++ {
+		digit, err := reader.int16()
+		if err != nil {
+			return "", err
+		}
+
+		unscaled.Mul(unscaled, big.NewInt(10000))
+		unscaled.Add(unscaled, big.NewInt(int64(digit)))
+	}
+
+	// The digits represent unscaled * 10000^(weight - ndigits + 1), which we shift to be
+	// an integer of dscale decimal places.
+	exponent := 4*(int(weight)-int(ndigits)+1) + int(dscale)
+	if exponent >= 0 {
+		unscaled.Mul(unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil))
+	} else {
+		unscaled.Quo(unscaled, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exponent)), nil))
+	}
+
+	digits := unscaled.String()
+	if dscale > 0 {
+		if len(digits) <= int(dscale) {
+			digits = strings.Repeat("0", int(dscale)-len(digits)+1) + digits
+		}
+
+		digits = digits[:len(digits)-int(dscale)] + "." + digits[len(digits)-int(dscale):]
+	}
+
+	if sign == 0x4000 {
+		digits = "-" + digits
+	}
+
+	return digits, nil
+}
@@ -0,0 +1,107 @@
+package pgreplay
+
+import (
+	"encoding/hex"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DecodeBinaryParameter", func() {
+	DescribeTable("Renders binary values as text",
+		func(oid uint32, encoded string, expected string) {
+			value, err := hex.DecodeString(encoded)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(DecodeBinaryParameter(oid, value)).To(Equal(expected))
+		},
+		Entry("bool", uint32(oidBool), "01", "t"),
+		Entry("int2", uint32(oidInt2), "fffe", "-2"),
+		Entry("int4", uint32(oidInt4), "00000029", "41"),
+		Entry("int8", uint32(oidInt8), "00000000499602d2", "1234567890"),
+		Entry("float8", uint32(oidFloat8), "3ff8000000000000", "1.5"),
+		Entry("text", uint32(oidText), "616c696365", "alice"),
+		Entry("jsonb", uint32(oidJSONB), "017b7d", "{}"),
+		Entry("uuid", uint32(oidUUID), "a0eebc999c0b4ef8bb6d6bb9bd380a11", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"),
+		Entry("date", uint32(oidDate), "00001b53", "2019-02-25"),
+		Entry("timestamp", uint32(oidTimestamp), "000225b814d653f0", "2019-02-25 15:08:27.222"),
+		Entry("timestamptz", uint32(oidTimestampTZ), "000225b814d653f0", "2019-02-25 15:08:27.222Z"),
+		Entry("numeric", uint32(oidNumeric), "000300010000000300010d801388", "13456.500"),
+		Entry("negative numeric", uint32(oidNumeric), "0001ffff4000000403e8", "-0.1000"),
+		Entry("unknown", uint32(0), "dead", `\xdead`),
+	)
+})
+
+var _ = Describe("WireSession", func() {
+	var (
+		session  *WireSession
+		frontend = func(messages ...pgproto3.FrontendMessage) []Item {
+			var data []byte
+			for _, message := range messages {
+				data = message.Encode(data)
+			}
+
+			items, err := session.Frontend(time20190225, data)
+			Expect(err).NotTo(HaveOccurred())
+
+			return items
+		}
+		backend = func(messages ...pgproto3.BackendMessage) {
+			var data []byte
+			for _, message := range messages {
+				data = message.Encode(data)
+			}
+
+			Expect(session.Backend(time20190225, data)).To(Succeed())
+		}
+	)
+
+	BeforeEach(func() {
+		session = NewWireSession("a")
+		frontend(&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": "alice", "database": "pgreplay_test"},
+		})
+	})
+
+	It("Skips the describes of messages that failed", func() {
+		frontend(
+			&pgproto3.Parse{Name: "broken", Query: "select $1::nonsense"},
+			&pgproto3.Describe{ObjectType: 'S', Name: "broken"},
+			&pgproto3.Sync{},
+			&pgproto3.Parse{Name: "valid", Query: "select $1::int4"},
+			&pgproto3.Describe{ObjectType: 'S', Name: "valid"},
+			&pgproto3.Sync{},
+		)
+
+		backend(
+			&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42704", Message: `type "nonsense" does not exist`},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+			&pgproto3.ParseComplete{},
+			&pgproto3.ParameterDescription{ParameterOIDs: []uint32{oidInt4}},
+			&pgproto3.NoData{},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+
+		items := frontend(
+			&pgproto3.Bind{PreparedStatement: "valid", Parameters: [][]byte{[]byte("1")}},
+			&pgproto3.Execute{},
+		)
+
+		Expect(items).To(HaveLen(1))
+		Expect(items[0].(ExecutePrepared).ParameterTypes).To(Equal([]uint32{oidInt4}))
+		Expect(session.pendingDescribes).To(BeEmpty())
+	})
+
+	It("Decodes the messages that follow one it couldn't", func() {
+		data := (&pgproto3.Execute{Portal: "missing"}).Encode(nil)
+		data = (&pgproto3.Terminate{}).Encode(data)
+
+		items, err := session.Frontend(time20190225, data)
+		Expect(err).To(MatchError(ContainSubstring("execute of unknown portal 'missing'")))
+		Expect(items).To(ConsistOf(BeAssignableToTypeOf(Disconnect{})))
+	})
+})